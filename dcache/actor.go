@@ -2,110 +2,699 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/anthdm/hollywood/actor"
 	"github.com/anthdm/hollywood/cluster"
+	"github.com/dmitrorezn/dcache/clusterpb"
 	"github.com/dmitrorezn/dcache/storage"
-	"log"
+	"github.com/dmitrorezn/dcache/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	pids     map[*actor.PID]struct{}
-	commands chan storage.Command
-	store    storage.IStorage
-	cancel   context.CancelFunc
-	cluster  *cluster.Cluster
+	self    *actor.PID
+	repl    *Replication
+	store   storage.IStorage
+	cancel  context.CancelFunc
+	cluster *cluster.Cluster
+
+	chunkSize    int
+	maxValueSize int
+	chunkID      atomic.Uint64
+	chunks       map[chunkKey]*partial
+	forwards     map[chunkKey]*partialForward
+	outputs      *forwardOutputs
+
+	peers       *peerTable
+	log         *slog.Logger
+	writes      storage.IStorage
+	url         string
+	antiEntropy *AntiEntropy
+	bootstrap   *Bootstrap
+	partitions  *Partitions
 }
 
-func NewServer(store storage.IStorage, cluster *cluster.Cluster, commands chan storage.Command) actor.Producer {
+type ServerCfg struct {
+	ChunkSize    int
+	MaxValueSize int
+	Logger       *slog.Logger
+	// Writes applies the commands forwarded by followers, they are rejected
+	// if nil.
+	Writes storage.IStorage
+	// URL is where clients reach the HTTP API of the node.
+	URL string
+	// AntiEntropy serves the anti-entropy requests of peers, they are
+	// rejected if nil.
+	AntiEntropy *AntiEntropy
+	// Bootstrap buffers the replicated writes while the node syncs and
+	// serves snapshots to joining peers, they are rejected if nil.
+	Bootstrap *Bootstrap
+	// Partitions, if set, follows the members joining and leaving.
+	Partitions *Partitions
+}
+
+func NewServer(store storage.IStorage, cluster *cluster.Cluster, repl *Replication, cfg ServerCfg) actor.Producer {
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = storage.DefaultChunkSize
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	outputs := newForwardOutputs()
 	return func() actor.Receiver {
 		return &Server{
-			cluster:  cluster,
-			commands: commands,
-			store:    store,
-			pids:     make(map[*actor.PID]struct{}),
+			cluster:      cluster,
+			repl:         repl,
+			store:        store,
+			chunkSize:    cfg.ChunkSize,
+			maxValueSize: cfg.MaxValueSize,
+			chunks:       make(map[chunkKey]*partial),
+			forwards:     make(map[chunkKey]*partialForward),
+			outputs:      outputs,
+			peers:        repl.peers,
+			log:          cfg.Logger,
+			writes:       cfg.Writes,
+			url:          cfg.URL,
+			antiEntropy:  cfg.AntiEntropy,
+			bootstrap:    cfg.Bootstrap,
+			partitions:   cfg.Partitions,
 		}
 	}
 }
 
-type ReplicateCommand struct {
-	Cmd     int
-	Payload []byte
+type chunkKey struct {
+	addr string
+	id   uint64
+}
+
+const (
+	// maxChunks bounds the size of a reassembled command to maxChunks
+	// times the chunk size, also when values are not limited.
+	maxChunks = 1 << 14
+	// chunkTimeout drops a command whose next chunk did not arrive in time,
+	// the sender resends it whole with a new id.
+	chunkTimeout = time.Minute
+)
+
+// partial is a command being reassembled from its chunks.
+type partial struct {
+	cmd     *clusterpb.Command
+	epoch   int64
+	total   int64
+	updated time.Time
+}
+
+// versioned is implemented by the messages exchanged with peers.
+type versioned interface {
+	GetVersion() uint32
 }
 
 func (s *Server) Receive(c *actor.Context) {
+	if msg, ok := c.Message().(versioned); ok && c.Sender() != nil {
+		if !clusterpb.Supported(msg.GetVersion()) {
+			s.log.Warn("dropping message of an unsupported protocol version",
+				"sender", c.Sender(), "type", fmt.Sprintf("%T", msg), "version", msg.GetVersion())
+			return
+		}
+		if addr := c.Sender().GetAddress(); addr != s.cluster.PID().GetAddress() {
+			s.peers.version(addr, msg.GetVersion())
+		}
+	}
+
 	switch msg := c.Message().(type) {
 	case actor.Started:
-
+		s.self = c.PID()
 	case *cluster.Activation, cluster.ActivationEvent:
-		ctx, cancel := context.WithCancel(context.Background())
-		s.cancel = cancel
-		for i := 0; i < 10; i++ {
-			go func() {
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case cmd := <-s.commands:
-						for pid := range s.pids {
-							log.Println("REPLICATE TO", pid.Address, string(cmd.Payload))
-							s.cluster.Engine().Send(pid, ReplicateCommand{
-								Cmd:     int(cmd.Cmd),
-								Payload: cmd.Payload,
-							})
-						}
-					}
-				}
-			}()
-		}
+		// the streams are shared by all Server instances of the node
+		s.repl.once.Do(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			s.cancel = cancel
+			s.repl.Start(ctx, s.sendBatch)
+		})
 	case cluster.MemberJoinEvent:
 		workerID := s.cluster.Activate("worker", cluster.NewActivationConfig().
-			WithID(*nodeID),
+			WithID(s.cluster.ID()),
 		)
-		fmt.Println("MemberJoinEvent workerID", workerID, msg)
+		s.log.Info("member joined", "member", msg.Member, "worker", workerID)
 
-		s.pids[c.Sender()] = struct{}{}
-		fmt.Println("PIDS", s.pids)
-		c.Send(workerID, Connect{})
+		s.peers.join(msg.Member.ID, msg.Member.Host)
+		s.partitions.update(msg.Member, true)
+		if msg.Member.ID != s.cluster.ID() {
+			if n := s.repl.unacked(msg.Member.Host); n > 0 {
+				s.log.Info("resending unacknowledged commands", "peer", msg.Member.Host, "commands", n)
+			}
+			s.repl.join(msg.Member.ID, serverPID(msg.Member.Host, msg.Member.ID))
+		}
+		c.Send(workerID, &clusterpb.Connect{Version: clusterpb.Version})
+	case cluster.MemberLeaveEvent:
+		s.repl.leave(msg.Member.Host)
+		s.partitions.update(msg.Member, false)
+		s.log.Info("member left", "member", msg.Member, "unacked", s.repl.unacked(msg.Member.Host))
 	case actor.Stopped:
-		s.cancel()
-		if err := s.store.CloseAndWait(); err != nil {
-			fmt.Println("CloseAndWait", err)
+		if s.cancel != nil {
+			s.cancel()
+		}
+	case Leave:
+		for _, pid := range s.repl.targets() {
+			c.Send(pid, &clusterpb.Disconnect{Version: clusterpb.Version})
 		}
-	case ReplicateCommand:
+		c.Respond(Leave{})
+	case *clusterpb.ReplicateBatch:
 		if c.Sender().GetAddress() == s.cluster.PID().GetAddress() {
-			fmt.Println("LOCAL")
+			s.log.Debug("skip local replicate")
 		} else {
-			s.replicate(c.Context(), msg)
+			s.peers.received(c.Sender().GetAddress(), len(msg.GetCommands()))
+			c.Respond(s.receive(c.Context(), msg))
+		}
+	case *clusterpb.ReplicateChunk:
+		if c.Sender().GetAddress() == s.cluster.PID().GetAddress() {
+			break
 		}
-	case Connect:
-		fmt.Println("Connect", msg, "id", c.Sender().ID)
+		s.peers.seen(c.Sender().GetAddress())
+		if batch, ok := s.reassemble(c.Sender().GetAddress(), msg); ok {
+			s.peers.received(c.Sender().GetAddress(), 1)
+			c.Respond(s.receive(c.Context(), batch))
+		}
+	case *clusterpb.ReplicateAck:
+		s.repl.ack(c.Sender().GetAddress(), msg)
+	case *clusterpb.StatusRequest:
+		c.Respond(s.status().proto())
+	case *clusterpb.ForwardCommand:
+		s.forwarded(c, msg)
+	case *clusterpb.ForwardChunk:
+		cmd, done, err := s.reassembleForward(c.Sender().GetAddress(), msg)
+		switch {
+		case err != nil:
+			s.log.Warn("forwarded part", "sender", c.Sender(), "id", msg.GetId(), "err", err)
+			c.Respond(newForwardResult(nil, err))
+		case done:
+			s.forwarded(c, cmd)
+		default:
+			c.Respond(&clusterpb.ForwardResult{Version: clusterpb.Version})
+		}
+	case *clusterpb.ForwardRead:
+		c.Respond(s.outputs.read(msg))
+	case *clusterpb.RootsRequest, *clusterpb.TreeRequest, *clusterpb.DigestsRequest,
+		*clusterpb.EntriesRequest, *clusterpb.RepairRequest:
+		sender, engine := c.Sender(), c.Engine()
+		go func() {
+			engine.Send(sender, s.antiEntropy.serve(context.Background(), msg.(proto.Message)))
+		}()
+	case *clusterpb.SnapshotRequest:
+		// taking the snapshot waits for the storage
+		sender, engine := c.Sender(), c.Engine()
+		go func() {
+			engine.Send(sender, s.bootstrap.serve(context.Background(), msg))
+		}()
+	case *clusterpb.Connect:
+		s.peers.seen(c.Sender().GetAddress())
+		s.log.Info("connect", "sender", c.Sender())
+
+	case *clusterpb.Disconnect:
+		addr := c.Sender().GetAddress()
+		s.repl.leave(addr)
+		s.peers.seen(addr)
+		s.log.Info("disconnect", "sender", c.Sender())
+	}
+}
+
+// forwarded applies a command forwarded by a follower. Applying waits for
+// the raft commit, so it responds without blocking the actor.
+func (s *Server) forwarded(c *actor.Context, msg *clusterpb.ForwardCommand) {
+	sender, engine := c.Sender(), c.Engine()
+	go func() {
+		value, err := applyForward(context.Background(), s.writes, msg)
+		if err != nil && !errors.Is(err, storage.ErrNIL) {
+			s.log.Warn("forwarded command", "cmd", storage.Cmd(msg.GetCmd()), "sender", sender, "err", err)
+		}
+		engine.Send(sender, s.outputs.result(value, int(msg.GetChunkSize()), err))
+	}()
+}
+
+// chunkLimit is the largest command reassembled from chunks.
+func (s *Server) chunkLimit() int64 {
+	limit := int64(s.chunkSize) * maxChunks
+	if s.maxValueSize > 0 {
+		limit = min(limit, int64(s.maxValueSize+s.chunkSize))
+	}
+
+	return limit
+}
 
-	case Disconnect:
-		fmt.Println("Disconnect", msg)
+// sendBatch sends batch to pid, a command too large for a message is sent
+// alone in chunks.
+func (s *Server) sendBatch(pid *actor.PID, batch *clusterpb.ReplicateBatch) {
+	engine := s.cluster.Engine()
+	cmd := batch.Commands[0]
+	if len(batch.Commands) > 1 || len(cmd.Payload) <= s.chunkSize {
+		s.log.Debug("replicate", "peer", pid.Address, "seq", cmd.Seq, "commands", len(batch.Commands))
+		engine.SendWithSender(pid, batch, s.self)
+		return
 	}
+
+	id := s.chunkID.Add(1)
+	for off := 0; off < len(cmd.Payload); off += s.chunkSize {
+		engine.SendWithSender(pid, &clusterpb.ReplicateChunk{
+			Version: clusterpb.Version,
+			Id:      id,
+			Origin:  batch.Origin,
+			Epoch:   batch.Epoch,
+			Base:    batch.Base,
+			Command: &clusterpb.Command{
+				Seq:       cmd.Seq,
+				Cmd:       cmd.Cmd,
+				Codec:     cmd.Codec,
+				Namespace: cmd.Namespace,
+				Trace:     cmd.Trace,
+				Modified:  cmd.Modified,
+				Payload:   cmd.Payload[off:min(off+s.chunkSize, len(cmd.Payload))],
+			},
+			Total:  int64(len(cmd.Payload)),
+			Offset: int64(off),
+		}, s.self)
+	}
+}
+
+// reassemble adds the chunk msg to the command it is part of and returns
+// the command once complete. Chunks out of order, of an earlier epoch of
+// the sender or of a command that is too large drop the command.
+func (s *Server) reassemble(addr string, msg *clusterpb.ReplicateChunk) (*clusterpb.ReplicateBatch, bool) {
+	now := time.Now()
+	for key, p := range s.chunks {
+		if now.Sub(p.updated) > chunkTimeout || key.addr == addr && p.epoch != msg.GetEpoch() {
+			s.log.Warn("drop partial replicated command", "sender", key.addr, "id", key.id,
+				"received", len(p.cmd.Payload), "size", p.total)
+			delete(s.chunks, key)
+		}
+	}
+
+	key := chunkKey{addr: addr, id: msg.GetId()}
+	p, ok := s.chunks[key]
+	if !ok {
+		if msg.GetTotal() <= 0 || msg.GetTotal() > s.chunkLimit() {
+			s.log.Warn("replicated value too large", "sender", addr, "size", msg.GetTotal())
+			return nil, false
+		}
+		p = &partial{
+			cmd: &clusterpb.Command{
+				Seq:       msg.GetCommand().GetSeq(),
+				Cmd:       msg.GetCommand().GetCmd(),
+				Codec:     msg.GetCommand().GetCodec(),
+				Namespace: msg.GetCommand().GetNamespace(),
+				Trace:     msg.GetCommand().GetTrace(),
+				Modified:  msg.GetCommand().GetModified(),
+				Payload:   make([]byte, 0, msg.GetTotal()),
+			},
+			epoch: msg.GetEpoch(),
+			total: msg.GetTotal(),
+		}
+	}
+	part := msg.GetCommand().GetPayload()
+	if msg.GetOffset() != int64(len(p.cmd.Payload)) || msg.GetTotal() != p.total ||
+		int64(len(p.cmd.Payload)+len(part)) > p.total {
+		s.log.Warn("replicated chunk out of order", "sender", addr, "id", key.id,
+			"offset", msg.GetOffset(), "received", len(p.cmd.Payload), "size", msg.GetTotal())
+		delete(s.chunks, key)
+		return nil, false
+	}
+	p.cmd.Payload = append(p.cmd.Payload, part...)
+	p.updated = now
+	if int64(len(p.cmd.Payload)) < p.total {
+		s.chunks[key] = p
+		return nil, false
+	}
+	delete(s.chunks, key)
+
+	return &clusterpb.ReplicateBatch{
+		Version:  msg.GetVersion(),
+		Origin:   msg.GetOrigin(),
+		Epoch:    msg.GetEpoch(),
+		Base:     msg.GetBase(),
+		Commands: []*clusterpb.Command{p.cmd},
+	}, true
+}
+
+// receive applies the commands of msg that follow the last one applied from
+// its origin, in order, and returns the acknowledgement for the sender.
+func (s *Server) receive(ctx context.Context, msg *clusterpb.ReplicateBatch) *clusterpb.ReplicateAck {
+	ack := &clusterpb.ReplicateAck{Version: clusterpb.Version, Epoch: msg.GetEpoch()}
+	w := s.repl.window(msg.GetOrigin(), msg.GetEpoch())
+	if w == nil {
+		s.log.Debug("replicate from an earlier epoch", "origin", msg.GetOrigin(), "epoch", msg.GetEpoch())
+		return ack
+	}
+	defer w.mu.Unlock()
+
+	if w.low < msg.GetBase() {
+		s.log.Warn("origin gave up commands, skipping them", "origin", msg.GetOrigin(), "from", w.low+1, "to", msg.GetBase())
+		w.low = msg.GetBase()
+	}
+	for _, cmd := range msg.GetCommands() {
+		if cmd.GetSeq() <= w.low {
+			continue
+		}
+		if cmd.GetSeq() != w.low+1 {
+			ack.Gap = true
+			break
+		}
+		if err := s.replicate(ctx, msg.GetOrigin(), cmd); err != nil {
+			if retryable(err) {
+				// reported as a gap, so the sender sends it again
+				ack.Gap = true
+				break
+			}
+			ack.Errors = append(ack.Errors, &clusterpb.CommandError{Seq: cmd.GetSeq(), Err: err.Error()})
+		}
+		w.low = cmd.GetSeq()
+	}
+	ack.Seq = w.low
+
+	return ack
+}
+
+// retryable reports whether a command failed to apply for a reason that
+// passes, e.g. the storage being overloaded or paused for a restore.
+func retryable(err error) bool {
+	return errors.Is(err, storage.ErrOverloaded) ||
+		errors.Is(err, storage.ErrStorageClosed) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
+
+func (s *Server) replicate(ctx context.Context, origin string, msg *clusterpb.Command) error {
+	if s.bootstrap.buffer(origin, msg) {
+		return nil
+	}
+	cmd := storage.Cmd(msg.GetCmd())
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("cmd", cmd.String()),
+			attribute.String("namespace", msg.Namespace),
+		),
+	}
+	if link, ok := tracing.Link(msg.Trace); ok {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	ctx, span := tracer.Start(ctx, "replicate", opts...)
+	defer span.End()
+
+	err := applyCommand(ctx, s.store, msg)
+	if err != nil {
+		span.RecordError(err)
+		s.log.Error("replicate", "origin", origin, "seq", msg.Seq, "cmd", cmd, "namespace", msg.Namespace, "err", err)
+	}
+
+	return err
 }
 
-func (s *Server) replicate(ctx context.Context, msg ReplicateCommand) {
-	fmt.Println("Replicate Command Receive", msg)
-	var err error
-	cmd := storage.Cmd(msg.Cmd)
+// applyCommand applies the replicated command msg to store.
+func applyCommand(ctx context.Context, store storage.IStorage, msg *clusterpb.Command) error {
+	payload, err := storage.Decode(storage.Codec(msg.GetCodec()), msg.GetPayload())
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
 	command := storage.Command{
-		Cmd:     cmd,
-		Payload: msg.Payload,
+		Cmd:       storage.Cmd(msg.GetCmd()),
+		Namespace: msg.GetNamespace(),
+		Payload:   payload,
+		Modified:  msg.GetModified(),
 	}
-	switch cmd {
+	switch command.Cmd {
 	case storage.Set:
-		err = s.store.Set(ctx, command)
+		return store.Set(ctx, command)
 	case storage.Del:
-		err = s.store.Del(ctx, command)
+		return store.Del(ctx, command)
 	case storage.Rename:
-		err = s.store.Rename(ctx, command)
+		return store.Rename(ctx, command)
+	case storage.Flush:
+		return store.Flush(ctx, command)
 	}
-	_ = err
-}
 
-type Connect struct {
+	return fmt.Errorf("cannot replicate %s", command.Cmd)
 }
+
 type Replicate struct{}
-type Disconnect struct{}
+
+// Leave makes a Server tell its peers it is leaving the cluster, it is only
+// sent by the node itself.
+type Leave struct{}
+
+// Status is the state of a Server, sent to peers as a clusterpb.Status.
+type Status struct {
+	// Version is the protocol version of the node.
+	Version             uint32       `json:"version"`
+	ID                  string       `json:"id"`
+	Address             string       `json:"address"`
+	URL                 string       `json:"url,omitempty"`
+	Started             time.Time    `json:"started"`
+	Members             []string     `json:"members"`
+	ReplicationQueue    int          `json:"replicationQueue"`
+	ReplicationQueueCap int          `json:"replicationQueueCap"`
+	Peers               []PeerStatus `json:"peers"`
+}
+
+type PeerStatus struct {
+	ID      string `json:"id,omitempty"`
+	Address string `json:"address"`
+	// Joined is zero for peers we only heard from.
+	Joined   time.Time `json:"joined,omitempty"`
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+	LastSent time.Time `json:"lastSent,omitempty"`
+	// Sent and Received count replicated commands, Acked, Failed and
+	// Retried the acknowledgements and resends of the sent ones.
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+	Acked    uint64 `json:"acked"`
+	Failed   uint64 `json:"failed"`
+	Retried  uint64 `json:"retried"`
+	// Lost counts commands given up because too many were unacknowledged
+	// or the hints of the peer were full.
+	Lost      uint64 `json:"lost"`
+	Unacked   int    `json:"unacked"`
+	LastError string `json:"lastError,omitempty"`
+	// Version is the protocol version of the last message of the peer.
+	Version uint32 `json:"version,omitempty"`
+}
+
+func (s *Server) status() Status {
+	st := Status{
+		Version:             clusterpb.Version,
+		ID:                  s.cluster.ID(),
+		Address:             s.cluster.PID().GetAddress(),
+		URL:                 s.url,
+		Started:             s.peers.started,
+		ReplicationQueue:    len(s.repl.commands),
+		ReplicationQueueCap: cap(s.repl.commands),
+		Peers:               s.peers.list(),
+	}
+	for i := range st.Peers {
+		st.Peers[i].Unacked = s.repl.unacked(st.Peers[i].Address)
+	}
+	for _, m := range s.cluster.Members() {
+		st.Members = append(st.Members, m.ID)
+	}
+	sort.Strings(st.Members)
+
+	return st
+}
+
+func (st Status) proto() *clusterpb.Status {
+	msg := &clusterpb.Status{
+		Version:             st.Version,
+		Id:                  st.ID,
+		Address:             st.Address,
+		Url:                 st.URL,
+		Started:             timestamp(st.Started),
+		Members:             st.Members,
+		ReplicationQueue:    int64(st.ReplicationQueue),
+		ReplicationQueueCap: int64(st.ReplicationQueueCap),
+		Peers:               make([]*clusterpb.PeerStatus, len(st.Peers)),
+	}
+	for i, p := range st.Peers {
+		msg.Peers[i] = &clusterpb.PeerStatus{
+			Id:        p.ID,
+			Address:   p.Address,
+			Joined:    timestamp(p.Joined),
+			LastSeen:  timestamp(p.LastSeen),
+			LastSent:  timestamp(p.LastSent),
+			Sent:      p.Sent,
+			Received:  p.Received,
+			Acked:     p.Acked,
+			Failed:    p.Failed,
+			Retried:   p.Retried,
+			Lost:      p.Lost,
+			Unacked:   int64(p.Unacked),
+			LastError: p.LastError,
+			Version:   p.Version,
+		}
+	}
+
+	return msg
+}
+
+func statusFromProto(msg *clusterpb.Status) Status {
+	st := Status{
+		Version:             msg.GetVersion(),
+		ID:                  msg.GetId(),
+		Address:             msg.GetAddress(),
+		URL:                 msg.GetUrl(),
+		Started:             fromTimestamp(msg.GetStarted()),
+		Members:             msg.GetMembers(),
+		ReplicationQueue:    int(msg.GetReplicationQueue()),
+		ReplicationQueueCap: int(msg.GetReplicationQueueCap()),
+		Peers:               make([]PeerStatus, len(msg.GetPeers())),
+	}
+	for i, p := range msg.GetPeers() {
+		st.Peers[i] = PeerStatus{
+			ID:        p.GetId(),
+			Address:   p.GetAddress(),
+			Joined:    fromTimestamp(p.GetJoined()),
+			LastSeen:  fromTimestamp(p.GetLastSeen()),
+			LastSent:  fromTimestamp(p.GetLastSent()),
+			Sent:      p.GetSent(),
+			Received:  p.GetReceived(),
+			Acked:     p.GetAcked(),
+			Failed:    p.GetFailed(),
+			Retried:   p.GetRetried(),
+			Lost:      p.GetLost(),
+			Unacked:   int(p.GetUnacked()),
+			LastError: p.GetLastError(),
+			Version:   p.GetVersion(),
+		}
+	}
+
+	return st
+}
+
+// timestamp leaves zero times unset.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
+
+func fromTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+
+	return ts.AsTime().Local()
+}
+
+// peerTable tracks the peers of a node. It is shared by all Server
+// instances of the node, replication messages are received by any of them.
+type peerTable struct {
+	started time.Time
+
+	mu    sync.Mutex
+	peers map[string]*PeerStatus
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{
+		started: time.Now(),
+		peers:   make(map[string]*PeerStatus),
+	}
+}
+
+// get returns the peer with addr, the table must be locked.
+func (t *peerTable) get(addr string) *PeerStatus {
+	p, ok := t.peers[addr]
+	if !ok {
+		p = &PeerStatus{Address: addr}
+		t.peers[addr] = p
+	}
+
+	return p
+}
+
+func (t *peerTable) join(id, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.get(addr)
+	p.ID = id
+	p.Joined = time.Now()
+}
+
+func (t *peerTable) seen(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(addr).LastSeen = time.Now()
+}
+
+func (t *peerTable) received(addr string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.get(addr)
+	p.LastSeen = time.Now()
+	p.Received += uint64(n)
+}
+
+func (t *peerTable) sent(addr string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.get(addr)
+	p.LastSent = time.Now()
+	p.Sent += uint64(n)
+}
+
+func (t *peerTable) acked(addr string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.get(addr)
+	p.LastSeen = time.Now()
+	p.Acked += uint64(n)
+}
+
+func (t *peerTable) failed(addr string, err string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.get(addr)
+	p.LastSeen = time.Now()
+	p.Failed++
+	p.LastError = err
+}
+
+func (t *peerTable) retried(addr string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(addr).Retried += uint64(n)
+}
+
+func (t *peerTable) lost(addr string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(addr).Lost += uint64(n)
+}
+
+func (t *peerTable) version(addr string, v uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(addr).Version = v
+}
+
+func (t *peerTable) list() []PeerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]PeerStatus, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+
+	return peers
+}
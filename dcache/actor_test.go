@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+func newTestServer(chunkSize, maxValueSize int) *Server {
+	return &Server{
+		chunkSize:    chunkSize,
+		maxValueSize: maxValueSize,
+		chunks:       make(map[chunkKey]*partial),
+		forwards:     make(map[chunkKey]*partialForward),
+		log:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func chunk(id uint64, epoch int64, payload string, offset, total int64) *clusterpb.ReplicateChunk {
+	return &clusterpb.ReplicateChunk{
+		Id:      id,
+		Epoch:   epoch,
+		Command: &clusterpb.Command{Payload: []byte(payload)},
+		Offset:  offset,
+		Total:   total,
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	s := newTestServer(4, 0)
+	if _, ok := s.reassemble("a", chunk(1, 1, "abcd", 0, 6)); ok {
+		t.Fatal("complete after the first chunk")
+	}
+	batch, ok := s.reassemble("a", chunk(1, 1, "ef", 4, 6))
+	if !ok || string(batch.Commands[0].Payload) != "abcdef" {
+		t.Fatalf("reassembled %v, %v", batch, ok)
+	}
+
+	// a missing chunk drops the command
+	s.reassemble("a", chunk(2, 1, "abcd", 0, 12))
+	if _, ok = s.reassemble("a", chunk(2, 1, "ijkl", 8, 12)); ok || len(s.chunks) != 0 {
+		t.Fatalf("chunk out of order kept: %v, %d partial", ok, len(s.chunks))
+	}
+
+	// a new epoch of the sender drops its partial commands, a chunk id
+	// starts over when it restarts
+	s.reassemble("a", chunk(1, 1, "abcd", 0, 8))
+	s.reassemble("b", chunk(1, 1, "abcd", 0, 8))
+	s.reassemble("a", chunk(1, 2, "wxyz", 0, 8))
+	if batch, ok = s.reassemble("a", chunk(1, 2, "1234", 4, 8)); !ok || string(batch.Commands[0].Payload) != "wxyz1234" {
+		t.Fatalf("after a new epoch %v, %v", batch, ok)
+	}
+	if _, ok = s.chunks[chunkKey{addr: "b", id: 1}]; !ok {
+		t.Fatal("partial of another sender dropped")
+	}
+
+	// a stalled command times out
+	s.chunks[chunkKey{addr: "b", id: 1}].updated = time.Now().Add(-2 * chunkTimeout)
+	s.reassemble("a", chunk(3, 2, "abcd", 0, 8))
+	if _, ok = s.chunks[chunkKey{addr: "b", id: 1}]; ok {
+		t.Fatal("stalled partial kept")
+	}
+}
+
+func TestReassembleLimit(t *testing.T) {
+	s := newTestServer(4, 0)
+	if _, ok := s.reassemble("a", chunk(1, 1, "abcd", 0, 4*maxChunks+1)); ok || len(s.chunks) != 0 {
+		t.Fatal("command above the chunk limit accepted")
+	}
+	s = newTestServer(4, 8)
+	if _, ok := s.reassemble("a", chunk(1, 1, "abcd", 0, 13)); ok || len(s.chunks) != 0 {
+		t.Fatal("command above the value limit accepted")
+	}
+}
+
+func TestReceiveRetryable(t *testing.T) {
+	s := newTestServer(4, 0)
+	s.repl = NewReplication(nil, ReplicationCfg{Logger: s.log})
+	// the storage is not running, the commands time out
+	s.store = storage.New()
+	batch := &clusterpb.ReplicateBatch{
+		Origin: "a",
+		Epoch:  1,
+		Commands: []*clusterpb.Command{
+			{Seq: 1, Cmd: int32(storage.Set), Payload: storage.AppendKey(nil, "k")},
+			{Seq: 2, Cmd: int32(storage.Del), Payload: storage.AppendKey(nil, "k")},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ack := s.receive(ctx, batch)
+	if ack.GetSeq() != 0 || !ack.GetGap() || len(ack.GetErrors()) != 0 {
+		t.Fatalf("ack %v, want a gap before the first command", ack)
+	}
+
+	// once the storage runs the commands are applied
+	go s.store.(*storage.Storage).Run(context.Background())
+	t.Cleanup(func() { _ = s.store.CloseAndWait() })
+	ack = s.receive(context.Background(), batch)
+	if ack.GetSeq() != 2 || ack.GetGap() || len(ack.GetErrors()) != 0 {
+		t.Fatalf("ack %v, want both commands applied", ack)
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthdm/hollywood/actor"
+	"github.com/anthdm/hollywood/cluster"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+// repairBatchBytes bounds the values sent in one anti-entropy message.
+const repairBatchBytes = 256 << 10
+
+var errAntiEntropyDisabled = errors.New("anti-entropy is disabled on this node")
+
+type AntiEntropyCfg struct {
+	// Interval is the period of the rounds, 0 only serves peers.
+	Interval time.Duration
+	// MaxKeys bounds the keys repaired per round.
+	MaxKeys int
+	// Bandwidth limits the bytes of values exchanged per second, 0 is
+	// unlimited.
+	Bandwidth int
+	// TombstoneTTL is how long deleted keys are remembered, deletes older
+	// than that can be undone by a peer that missed them.
+	TombstoneTTL time.Duration
+	// Ready, if set, holds the rounds and refuses peers until it returns
+	// nil, e.g. while the node bootstraps.
+	Ready func() error
+	// Shared, if set, reports whether the node and the member peer both
+	// keep key, only those keys are repaired. Partitioned nodes only share
+	// some ranges with each peer.
+	Shared  func(peer, ns, key string) bool
+	Timeout time.Duration
+	Logger  *slog.Logger
+}
+
+// AntiEntropy repairs the replicas that drifted apart because replication
+// is best-effort. Every round it compares the Merkle trees of the namespaces
+// with the ones of a random peer, descending only into the subtrees that
+// differ, and exchanges the keys of the leaves that differ. The last write
+// wins, keys newer on the peer are pulled and keys newer here are pushed.
+type AntiEntropy struct {
+	store   *storage.Storage
+	cluster *cluster.Cluster
+	cfg     AntiEntropyCfg
+	limiter *rate.Limiter
+
+	rounds   atomic.Uint64
+	repaired atomic.Uint64
+	bytes    atomic.Uint64
+	errors   atomic.Uint64
+}
+
+func NewAntiEntropy(store *storage.Storage, cluster *cluster.Cluster, cfg AntiEntropyCfg) *AntiEntropy {
+	if cfg.MaxKeys <= 0 {
+		cfg.MaxKeys = 10000
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	a := &AntiEntropy{
+		store:   store,
+		cluster: cluster,
+		cfg:     cfg,
+		limiter: rate.NewLimiter(rate.Inf, 0),
+	}
+	a.SetBandwidth(cfg.Bandwidth)
+
+	return a
+}
+
+// SetBandwidth changes the bytes per second exchanged, 0 is unlimited.
+func (a *AntiEntropy) SetBandwidth(n int) {
+	if n <= 0 {
+		a.limiter.SetLimit(rate.Inf)
+		return
+	}
+	a.limiter.SetLimit(rate.Limit(n))
+	a.limiter.SetBurst(n)
+}
+
+// wait blocks until n bytes may be sent.
+func (a *AntiEntropy) wait(ctx context.Context, n int) error {
+	if a.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		k := min(n, a.limiter.Burst())
+		if err := a.limiter.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+
+	return nil
+}
+
+// Run runs a round with a random peer every interval until ctx is done.
+func (a *AntiEntropy) Run(ctx context.Context) {
+	if a.cfg.Interval <= 0 {
+		return
+	}
+	t := time.NewTicker(a.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		pid := randomPeer(a.cluster)
+		if pid == nil || a.unavailable() != nil {
+			continue
+		}
+		a.rounds.Add(1)
+		start := time.Now()
+		repaired, err := a.round(ctx, pid)
+		if err != nil && ctx.Err() == nil {
+			a.errors.Add(1)
+			a.cfg.Logger.Warn("anti-entropy", "peer", pid.GetAddress(), "repaired", repaired, "err", err)
+			continue
+		}
+		if repaired > 0 {
+			a.cfg.Logger.Info("anti-entropy repaired keys", "peer", pid.GetAddress(), "repaired", repaired, "took", time.Since(start))
+		}
+	}
+}
+
+// randomPeer returns the Server of a random other member of c, nil if there
+// is none.
+func randomPeer(c *cluster.Cluster) *actor.PID {
+	var peers []*actor.PID
+	for _, m := range c.Members() {
+		if m.ID != c.ID() {
+			peers = append(peers, serverPID(m.Host, m.ID))
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	return peers[rand.IntN(len(peers))]
+}
+
+// round repairs the keys that differ from pid, here or on pid, and returns
+// how many.
+func (a *AntiEntropy) round(ctx context.Context, pid *actor.PID) (int, error) {
+	ctx, span := tracer.Start(ctx, "antientropy.round")
+	defer span.End()
+
+	if err := a.store.PruneTombstones(ctx, time.Now().Add(-a.cfg.TombstoneTTL)); err != nil {
+		return 0, err
+	}
+	local, err := a.store.Trees(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var roots clusterpb.RootsResponse
+	if err = a.request(pid, &clusterpb.RootsRequest{Version: clusterpb.Version}, &roots); err != nil {
+		return 0, err
+	}
+	if roots.GetDepth() != storage.MerkleDepth {
+		return 0, fmt.Errorf("peer trees have depth %d, not %d", roots.GetDepth(), storage.MerkleDepth)
+	}
+
+	remote := make(map[string]uint64, len(roots.GetRoots()))
+	for _, r := range roots.GetRoots() {
+		remote[r.GetNamespace()] = r.GetHash()
+	}
+	for ns := range local {
+		if _, ok := remote[ns]; !ok {
+			remote[ns] = 0
+		}
+	}
+
+	repaired := 0
+	for ns, root := range remote {
+		tree, ok := local[ns]
+		if !ok {
+			tree = make(storage.MerkleTree, storage.FirstLeaf+1<<storage.MerkleDepth)
+		}
+		if tree.Root() == root {
+			continue
+		}
+		n, err := a.repair(ctx, pid, ns, tree, a.cfg.MaxKeys-repaired)
+		repaired += n
+		a.repaired.Add(uint64(n))
+		if err != nil {
+			return repaired, fmt.Errorf("namespace %q: %w", ns, err)
+		}
+		if repaired >= a.cfg.MaxKeys {
+			break
+		}
+	}
+
+	return repaired, nil
+}
+
+// repair repairs up to limit keys of the namespace ns whose root differs.
+func (a *AntiEntropy) repair(ctx context.Context, pid *actor.PID, ns string, tree storage.MerkleTree, limit int) (int, error) {
+	leaves, err := a.diff(pid, ns, tree)
+	if err != nil || len(leaves) == 0 {
+		return 0, err
+	}
+	var digests clusterpb.DigestsResponse
+	if err = a.request(pid, &clusterpb.DigestsRequest{
+		Version:   clusterpb.Version,
+		Namespace: ns,
+		Leaves:    leaves,
+	}, &digests); err != nil {
+		return 0, err
+	}
+	ours := make([]int, len(leaves))
+	for i, l := range leaves {
+		ours[i] = int(l)
+	}
+	mine, err := a.store.Digests(ctx, ns, ours)
+	if err != nil {
+		return 0, err
+	}
+
+	pull, push := compareDigests(mine, digestsFromProto(digests.GetDigests()))
+	if a.cfg.Shared != nil {
+		peer := strings.TrimPrefix(pid.GetID(), serverKind+"/")
+		unshared := func(d storage.KeyDigest) bool {
+			return !a.cfg.Shared(peer, ns, d.Key)
+		}
+		pull = slices.DeleteFunc(pull, unshared)
+		push = slices.DeleteFunc(push, unshared)
+	}
+	pull = pull[:min(len(pull), limit)]
+	push = push[:min(len(push), limit-len(pull))]
+
+	repaired, err := a.pull(ctx, pid, ns, pull)
+	if err != nil {
+		return repaired, err
+	}
+	pushed, err := a.push(ctx, pid, ns, push)
+
+	return repaired + pushed, err
+}
+
+// diff descends the subtrees that differ from the ones of pid and returns
+// the leaves that differ.
+func (a *AntiEntropy) diff(pid *actor.PID, ns string, tree storage.MerkleTree) ([]uint32, error) {
+	nodes := []uint32{0}
+	for nodes[0] < storage.FirstLeaf {
+		children := make([]uint32, 0, 2*len(nodes))
+		for _, n := range nodes {
+			children = append(children, 2*n+1, 2*n+2)
+		}
+		var res clusterpb.TreeResponse
+		if err := a.request(pid, &clusterpb.TreeRequest{
+			Version:   clusterpb.Version,
+			Namespace: ns,
+			Nodes:     children,
+		}, &res); err != nil {
+			return nil, err
+		}
+		if len(res.GetHashes()) != len(children) {
+			return nil, fmt.Errorf("peer sent %d hashes for %d nodes", len(res.GetHashes()), len(children))
+		}
+
+		nodes = nodes[:0]
+		for i, c := range children {
+			if tree[c] != res.GetHashes()[i] {
+				nodes = append(nodes, c)
+			}
+		}
+		if len(nodes) == 0 {
+			// changed since the roots were compared
+			return nil, nil
+		}
+	}
+	for i := range nodes {
+		nodes[i] -= storage.FirstLeaf
+	}
+
+	return nodes, nil
+}
+
+// compareDigests returns the keys newer on the peer and the ones newer here.
+// A key evicted on either side is only sent if it was written again since.
+func compareDigests(mine, theirs []storage.KeyDigest) (pull, push []storage.KeyDigest) {
+	local := make(map[string]storage.KeyDigest, len(mine))
+	for _, d := range mine {
+		local[d.Key] = d
+	}
+	for _, d := range theirs {
+		l, ok := local[d.Key]
+		delete(local, d.Key)
+		switch {
+		case !ok:
+			if !d.Evicted {
+				pull = append(pull, d)
+			}
+		case d.Evicted || l.Evicted:
+			if !d.Evicted && d.Modified > l.Modified {
+				pull = append(pull, d)
+			}
+			if !l.Evicted && l.Modified > d.Modified {
+				push = append(push, l)
+			}
+		case d.Same(l):
+		case d.Newer(l):
+			pull = append(pull, d)
+		case l.Newer(d):
+			push = append(push, l)
+		}
+	}
+	for _, d := range mine {
+		if _, ok := local[d.Key]; ok && !d.Evicted {
+			push = append(push, d)
+		}
+	}
+
+	return pull, push
+}
+
+// batches splits digests into batches of about repairBatchBytes of values.
+func batches(digests []storage.KeyDigest) [][]storage.KeyDigest {
+	var (
+		out   [][]storage.KeyDigest
+		start int
+		size  int
+	)
+	for i, d := range digests {
+		if i > start && size+d.Size > repairBatchBytes {
+			out = append(out, digests[start:i])
+			start, size = i, 0
+		}
+		size += d.Size
+	}
+	if start < len(digests) {
+		out = append(out, digests[start:])
+	}
+
+	return out
+}
+
+func batchSize(digests []storage.KeyDigest) int {
+	n := 0
+	for _, d := range digests {
+		n += d.Size
+	}
+
+	return n
+}
+
+func (a *AntiEntropy) pull(ctx context.Context, pid *actor.PID, ns string, digests []storage.KeyDigest) (int, error) {
+	repaired := 0
+	for _, batch := range batches(digests) {
+		if err := a.wait(ctx, batchSize(batch)); err != nil {
+			return repaired, err
+		}
+		req := &clusterpb.EntriesRequest{Version: clusterpb.Version, Namespace: ns}
+		for _, d := range batch {
+			req.Keys = append(req.Keys, d.Key)
+		}
+		var res clusterpb.EntriesResponse
+		if err := a.request(pid, req, &res); err != nil {
+			return repaired, err
+		}
+		entries := entriesFromProto(res.GetEntries())
+		a.bytes.Add(uint64(entriesSize(entries)))
+		n, err := a.store.Repair(ctx, ns, entries)
+		repaired += n
+		if err != nil {
+			return repaired, err
+		}
+	}
+
+	return repaired, nil
+}
+
+func (a *AntiEntropy) push(ctx context.Context, pid *actor.PID, ns string, digests []storage.KeyDigest) (int, error) {
+	repaired := 0
+	for _, batch := range batches(digests) {
+		keys := make([]string, len(batch))
+		for i, d := range batch {
+			keys[i] = d.Key
+		}
+		entries, err := a.store.Entries(ctx, ns, keys)
+		if err != nil {
+			return repaired, err
+		}
+		if err = a.wait(ctx, entriesSize(entries)); err != nil {
+			return repaired, err
+		}
+		var res clusterpb.RepairResponse
+		if err = a.request(pid, &clusterpb.RepairRequest{
+			Version:   clusterpb.Version,
+			Namespace: ns,
+			Entries:   entriesToProto(entries),
+		}, &res); err != nil {
+			return repaired, err
+		}
+		a.bytes.Add(uint64(entriesSize(entries)))
+		repaired += int(res.GetRepaired())
+	}
+
+	return repaired, nil
+}
+
+// antiEntropyResponse is implemented by the responses to anti-entropy
+// requests.
+type antiEntropyResponse interface {
+	proto.Message
+	GetErr() string
+}
+
+// request sends msg to pid and stores the response in res.
+func (a *AntiEntropy) request(pid *actor.PID, msg proto.Message, res antiEntropyResponse) error {
+	out, err := a.cluster.Engine().Request(pid, msg, a.cfg.Timeout).Result()
+	if err != nil {
+		return err
+	}
+	m, ok := out.(proto.Message)
+	if !ok || m.ProtoReflect().Descriptor() != res.ProtoReflect().Descriptor() {
+		return fmt.Errorf("unexpected response %T", out)
+	}
+	proto.Merge(res, m)
+	if res.GetErr() != "" {
+		return errors.New(res.GetErr())
+	}
+
+	return nil
+}
+
+// unavailable returns why peers are refused, a may be nil.
+func (a *AntiEntropy) unavailable() error {
+	switch {
+	case a == nil:
+		return errAntiEntropyDisabled
+	case a.cfg.Ready != nil:
+		return a.cfg.Ready()
+	}
+
+	return nil
+}
+
+// serve answers the anti-entropy request msg of a peer, a may be nil.
+func (a *AntiEntropy) serve(ctx context.Context, msg proto.Message) proto.Message {
+	errString := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	unavailable := a.unavailable()
+
+	switch msg := msg.(type) {
+	case *clusterpb.RootsRequest:
+		res := &clusterpb.RootsResponse{Version: clusterpb.Version, Depth: storage.MerkleDepth}
+		if unavailable != nil {
+			res.Err = unavailable.Error()
+			return res
+		}
+		trees, err := a.store.Trees(ctx)
+		for ns, t := range trees {
+			res.Roots = append(res.Roots, &clusterpb.NamespaceRoot{Namespace: ns, Hash: t.Root()})
+		}
+		res.Err = errString(err)
+		return res
+	case *clusterpb.TreeRequest:
+		res := &clusterpb.TreeResponse{Version: clusterpb.Version}
+		if unavailable != nil {
+			res.Err = unavailable.Error()
+			return res
+		}
+		trees, err := a.store.Trees(ctx)
+		if err != nil {
+			res.Err = err.Error()
+			return res
+		}
+		tree, ok := trees[msg.GetNamespace()]
+		for _, n := range msg.GetNodes() {
+			switch {
+			case int(n) >= storage.FirstLeaf+1<<storage.MerkleDepth:
+				res.Err = fmt.Sprintf("no node %d", n)
+				return res
+			case ok:
+				res.Hashes = append(res.Hashes, tree[n])
+			default:
+				res.Hashes = append(res.Hashes, 0)
+			}
+		}
+		return res
+	case *clusterpb.DigestsRequest:
+		res := &clusterpb.DigestsResponse{Version: clusterpb.Version}
+		if unavailable != nil {
+			res.Err = unavailable.Error()
+			return res
+		}
+		leaves := make([]int, len(msg.GetLeaves()))
+		for i, l := range msg.GetLeaves() {
+			leaves[i] = int(l)
+		}
+		digests, err := a.store.Digests(ctx, msg.GetNamespace(), leaves)
+		res.Digests = digestsToProto(digests)
+		res.Err = errString(err)
+		return res
+	case *clusterpb.EntriesRequest:
+		res := &clusterpb.EntriesResponse{Version: clusterpb.Version}
+		if unavailable != nil {
+			res.Err = unavailable.Error()
+			return res
+		}
+		entries, err := a.store.Entries(ctx, msg.GetNamespace(), msg.GetKeys())
+		res.Entries = entriesToProto(entries)
+		res.Err = errString(err)
+		return res
+	case *clusterpb.RepairRequest:
+		res := &clusterpb.RepairResponse{Version: clusterpb.Version}
+		if unavailable != nil {
+			res.Err = unavailable.Error()
+			return res
+		}
+		n, err := a.store.Repair(ctx, msg.GetNamespace(), entriesFromProto(msg.GetEntries()))
+		res.Repaired = int64(n)
+		res.Err = errString(err)
+		return res
+	}
+
+	return nil
+}
+
+func entriesSize(entries []storage.KeyEntry) int {
+	n := 0
+	for _, e := range entries {
+		n += len(e.Entry.Value)
+	}
+
+	return n
+}
+
+func digestsToProto(digests []storage.KeyDigest) []*clusterpb.KeyDigest {
+	out := make([]*clusterpb.KeyDigest, len(digests))
+	for i, d := range digests {
+		out[i] = &clusterpb.KeyDigest{
+			Key:      d.Key,
+			Sum:      d.Sum,
+			Size:     int64(d.Size),
+			Modified: d.Modified,
+			Deleted:  d.Deleted,
+			Evicted:  d.Evicted,
+		}
+	}
+
+	return out
+}
+
+func digestsFromProto(digests []*clusterpb.KeyDigest) []storage.KeyDigest {
+	out := make([]storage.KeyDigest, len(digests))
+	for i, d := range digests {
+		out[i] = storage.KeyDigest{
+			Key:      d.GetKey(),
+			Sum:      d.GetSum(),
+			Size:     int(d.GetSize()),
+			Modified: d.GetModified(),
+			Deleted:  d.GetDeleted(),
+			Evicted:  d.GetEvicted(),
+		}
+	}
+
+	return out
+}
+
+func entriesToProto(entries []storage.KeyEntry) []*clusterpb.KeyEntry {
+	out := make([]*clusterpb.KeyEntry, len(entries))
+	for i, e := range entries {
+		out[i] = &clusterpb.KeyEntry{
+			Key:      e.Key,
+			Value:    e.Entry.Value,
+			Codec:    int32(e.Entry.Codec),
+			Size:     int64(e.Entry.Size),
+			Sum:      e.Entry.Sum,
+			Modified: e.Entry.Modified,
+			Deleted:  e.Deleted,
+		}
+	}
+
+	return out
+}
+
+func entriesFromProto(entries []*clusterpb.KeyEntry) []storage.KeyEntry {
+	out := make([]storage.KeyEntry, len(entries))
+	for i, e := range entries {
+		out[i] = storage.KeyEntry{
+			Key: e.GetKey(),
+			Entry: storage.Entry{
+				Value:    e.GetValue(),
+				Codec:    storage.Codec(e.GetCodec()),
+				Size:     int(e.GetSize()),
+				Sum:      e.GetSum(),
+				Modified: e.GetModified(),
+			},
+			Deleted: e.GetDeleted(),
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+func digestKeys(digests []storage.KeyDigest) []string {
+	out := make([]string, len(digests))
+	for i, d := range digests {
+		out[i] = d.Key
+	}
+
+	return out
+}
+
+func TestCompareDigestsEvicted(t *testing.T) {
+	mine := []storage.KeyDigest{
+		{Key: "evicted", Modified: 100, Evicted: true},
+		{Key: "rewritten", Modified: 100, Evicted: true},
+		{Key: "kept", Sum: 1, Modified: 300},
+		{Key: "gone", Modified: 100, Evicted: true},
+	}
+	theirs := []storage.KeyDigest{
+		{Key: "evicted", Sum: 1, Modified: 100},
+		{Key: "rewritten", Sum: 2, Modified: 200},
+		{Key: "kept", Modified: 200, Evicted: true},
+		{Key: "theirs", Modified: 100, Evicted: true},
+	}
+	pull, push := compareDigests(mine, theirs)
+	if got := digestKeys(pull); len(got) != 1 || got[0] != "rewritten" {
+		t.Fatalf("pull %v, want [rewritten]", got)
+	}
+	if got := digestKeys(push); len(got) != 1 || got[0] != "kept" {
+		t.Fatalf("push %v, want [kept]", got)
+	}
+}
+
+func TestCompareDigests(t *testing.T) {
+	mine := []storage.KeyDigest{
+		{Key: "same", Sum: 1, Modified: 100},
+		{Key: "rewritten", Sum: 1, Modified: 100},
+		{Key: "stale", Sum: 1, Modified: 100},
+		{Key: "deleted", Modified: 300, Deleted: true},
+		{Key: "undeleted", Modified: 100, Deleted: true},
+		{Key: "mine", Sum: 1, Modified: 100},
+		{Key: "tie", Sum: 1, Modified: 100},
+	}
+	theirs := []storage.KeyDigest{
+		{Key: "same", Sum: 1, Modified: 200},
+		{Key: "rewritten", Sum: 2, Modified: 200},
+		{Key: "stale", Sum: 2, Modified: 50},
+		{Key: "deleted", Sum: 1, Modified: 200},
+		{Key: "undeleted", Sum: 1, Modified: 200},
+		{Key: "theirs", Modified: 100, Deleted: true},
+		{Key: "tie", Modified: 100, Deleted: true},
+	}
+	pull, push := compareDigests(mine, theirs)
+	got, want := digestKeys(pull), []string{"rewritten", "theirs", "tie", "undeleted"}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Fatalf("pull %v, want %v", got, want)
+	}
+	got, want = digestKeys(push), []string{"deleted", "mine", "stale"}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Fatalf("push %v, want %v", got, want)
+	}
+	// the digests pushed are the local ones
+	for _, d := range push {
+		if d.Key == "stale" && d.Sum != 1 {
+			t.Fatalf("pushed %+v", d)
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	if got := batches(nil); len(got) != 0 {
+		t.Fatalf("batches of nothing: %v", got)
+	}
+	digests := []storage.KeyDigest{
+		{Key: "a", Size: repairBatchBytes / 2},
+		{Key: "b", Size: repairBatchBytes / 2},
+		{Key: "c", Size: 1},
+		{Key: "huge", Size: 2 * repairBatchBytes},
+		{Key: "d", Size: 1},
+		{Key: "e", Size: 0},
+	}
+	var got [][]string
+	for _, b := range batches(digests) {
+		got = append(got, digestKeys(b))
+	}
+	// a value larger than a batch goes alone
+	want := [][]string{{"a", "b"}, {"c"}, {"huge"}, {"d", "e"}}
+	if !slices.EqualFunc(got, want, slices.Equal[[]string]) {
+		t.Fatalf("batches %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Perm uint8
+
+const (
+	Read Perm = 1 << iota
+	Write
+	Admin
+
+	All = Read | Write | Admin
+)
+
+func ParsePerm(s string) (Perm, error) {
+	var p Perm
+	for _, c := range s {
+		switch c {
+		case 'r':
+			p |= Read
+		case 'w':
+			p |= Write
+		case 'a':
+			p |= Admin
+		default:
+			return 0, fmt.Errorf("unknown permission %q", c)
+		}
+	}
+
+	return p, nil
+}
+
+// Rule grants Perm on keys starting with Prefix in Namespace to User.
+// "*" matches any user or namespace.
+type Rule struct {
+	User      string
+	Namespace string
+	Prefix    string
+	Perm      Perm
+}
+
+type ACL struct {
+	rules []Rule
+}
+
+func NewACL(rules ...Rule) *ACL {
+	return &ACL{
+		rules: rules,
+	}
+}
+
+// Allowed reports whether u may access key in ns with perm. Admin implies
+// read and write.
+func (a *ACL) Allowed(u User, ns, key string, perm Perm) bool {
+	for _, r := range a.rules {
+		if r.User != "*" && r.User != u.Name {
+			continue
+		}
+		if r.Namespace != "*" && r.Namespace != ns {
+			continue
+		}
+		if !strings.HasPrefix(key, r.Prefix) {
+			continue
+		}
+		granted := r.Perm
+		if granted&Admin != 0 {
+			granted = All
+		}
+		if granted&perm == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Require rejects requests whose user has not been granted perm on every
+// key of every namespace; it guards endpoints that do not address keys.
+func (a *ACL) Require(perm Perm, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		u, ok := UserFrom(r.Context())
+		if ok && !a.Allowed(u, "*", "", perm) {
+			http.Error(rw, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ParseRules parses rules in the form "user:perm:namespace:prefix;...",
+// e.g. "alice:rw:*:users/;ops:a:*:". Namespace and prefix may be omitted.
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	for _, r := range strings.Split(spec, ";") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		parts := strings.SplitN(r, ":", 4)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid acl rule %q, expected user:perm[:namespace[:prefix]]", r)
+		}
+		perm, err := ParsePerm(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %q: %w", r, err)
+		}
+		rule := Rule{
+			User:      parts[0],
+			Namespace: "*",
+			Perm:      perm,
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			rule.Namespace = parts[2]
+		}
+		if len(parts) > 3 {
+			rule.Prefix = parts[3]
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,42 @@
+package auth
+
+import "testing"
+
+func TestAllowed(t *testing.T) {
+	acl := NewACL(
+		Rule{User: "alice", Namespace: "*", Prefix: "users/", Perm: Read | Write},
+		Rule{User: "bob", Namespace: "orders", Prefix: "", Perm: Read},
+		Rule{User: "ops", Namespace: "*", Prefix: "", Perm: Admin},
+		Rule{User: "*", Namespace: "public", Prefix: "docs/", Perm: Read},
+	)
+	for _, tc := range []struct {
+		name    string
+		user    string
+		ns, key string
+		perm    Perm
+		allowed bool
+	}{
+		{name: "prefix read", user: "alice", ns: "default", key: "users/1", perm: Read, allowed: true},
+		{name: "prefix write", user: "alice", ns: "orders", key: "users/1", perm: Write, allowed: true},
+		{name: "prefix read and write", user: "alice", ns: "default", key: "users/1", perm: Read | Write, allowed: true},
+		{name: "outside prefix", user: "alice", ns: "default", key: "orders/1", perm: Read},
+		{name: "prefix is not a suffix", user: "alice", ns: "default", key: "x/users/1", perm: Read},
+		{name: "no admin", user: "alice", ns: "default", key: "users/1", perm: Admin},
+		{name: "namespace", user: "bob", ns: "orders", key: "any", perm: Read, allowed: true},
+		{name: "other namespace", user: "bob", ns: "default", key: "any", perm: Read},
+		{name: "namespace read only", user: "bob", ns: "orders", key: "any", perm: Write},
+		{name: "admin", user: "ops", ns: "default", key: "", perm: Admin, allowed: true},
+		{name: "admin implies read", user: "ops", ns: "orders", key: "k", perm: Read, allowed: true},
+		{name: "admin implies write", user: "ops", ns: "orders", key: "k", perm: Write, allowed: true},
+		{name: "any user", user: "carol", ns: "public", key: "docs/a", perm: Read, allowed: true},
+		{name: "any user other prefix", user: "carol", ns: "public", key: "private/a", perm: Read},
+		{name: "any user write", user: "carol", ns: "public", key: "docs/a", perm: Write},
+		{name: "unknown user", user: "carol", ns: "orders", key: "k", perm: Read},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := acl.Allowed(User{Name: tc.user}, tc.ns, tc.key, tc.perm); got != tc.allowed {
+				t.Fatalf("allowed %v, want %v", got, tc.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+type User struct {
+	Name string
+}
+
+type ctxKey struct{}
+
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, ctxKey{}, u)
+}
+
+func UserFrom(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(ctxKey{}).(User)
+
+	return u, ok
+}
+
+// Authenticator resolves bearer tokens to users. Tokens are either static,
+// configured per user, or HMAC signed in the form
+//
+//	<user>.<expiry unix seconds>.<base64url(HMAC-SHA256(secret, user.expiry))>
+type Authenticator struct {
+	tokens map[string]User
+	secret []byte
+	now    func() time.Time
+}
+
+func NewAuthenticator(tokens map[string]string, secret []byte) *Authenticator {
+	a := &Authenticator{
+		tokens: make(map[string]User, len(tokens)),
+		secret: secret,
+		now:    time.Now,
+	}
+	for token, user := range tokens {
+		a.tokens[token] = User{Name: user}
+	}
+
+	return a
+}
+
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.secret) > 0
+}
+
+func (a *Authenticator) Authenticate(token string) (User, error) {
+	for t, u := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return u, nil
+		}
+	}
+	if len(a.secret) == 0 {
+		return User{}, ErrUnauthorized
+	}
+
+	payload, sig, ok := cutLast(token, ".")
+	if !ok {
+		return User{}, ErrUnauthorized
+	}
+	user, exp, ok := cutLast(payload, ".")
+	if !ok || user == "" {
+		return User{}, ErrUnauthorized
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, a.sign(payload)) {
+		return User{}, ErrUnauthorized
+	}
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || a.now().Unix() > expiry {
+		return User{}, fmt.Errorf("%w: token expired", ErrUnauthorized)
+	}
+
+	return User{Name: user}, nil
+}
+
+// Sign issues an HMAC token for user valid until expiry.
+func (a *Authenticator) Sign(user string, expiry time.Time) string {
+	payload := user + "." + strconv.FormatInt(expiry.Unix(), 10)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.sign(payload))
+}
+
+func (a *Authenticator) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+
+	return mac.Sum(nil)
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+
+	return s[:i], s[i+len(sep):], true
+}
+
+// Middleware authenticates requests by their bearer token and stores the
+// user in the request context. It is a no-op when no tokens are configured.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	if !a.Enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, ErrUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+		user, err := a.Authenticate(strings.TrimSpace(token))
+		if err != nil {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(rw, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// ParseTokens parses static tokens in the form "token:user,token:user".
+func ParseTokens(spec string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, t := range strings.Split(spec, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		token, user, ok := strings.Cut(t, ":")
+		if !ok || token == "" || user == "" {
+			return nil, fmt.Errorf("invalid token %q, expected token:user", t)
+		}
+		tokens[token] = user
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := NewAuthenticator(map[string]string{"static-token": "alice"}, []byte("secret"))
+	a.now = func() time.Time { return now }
+	other := NewAuthenticator(nil, []byte("other secret"))
+
+	valid := a.Sign("bob", now.Add(time.Hour))
+	tampered := []byte(valid)
+	tampered[len(tampered)-1] ^= 1
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		user  string
+	}{
+		{name: "static", token: "static-token", user: "alice"},
+		{name: "static unknown", token: "static-tokem"},
+		{name: "hmac", token: valid, user: "bob"},
+		{name: "hmac user with dots", token: a.Sign("bob.smith.ops", now.Add(time.Hour)), user: "bob.smith.ops"},
+		{name: "hmac expired", token: a.Sign("bob", now.Add(-time.Second))},
+		{name: "hmac tampered signature", token: string(tampered)},
+		{name: "hmac tampered user", token: "eve" + valid[len("bob"):]},
+		{name: "hmac tampered expiry", token: "bob.9999999999" + valid[len("bob.1700003600"):]},
+		{name: "hmac other secret", token: other.Sign("bob", now.Add(time.Hour))},
+		{name: "hmac without user", token: a.Sign("", now.Add(time.Hour))},
+		{name: "malformed", token: "bob"},
+		{name: "empty", token: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := a.Authenticate(tc.token)
+			if tc.user == "" {
+				if !errors.Is(err, ErrUnauthorized) {
+					t.Fatalf("authenticated as %q, %v", u.Name, err)
+				}
+				return
+			}
+			if err != nil || u.Name != tc.user {
+				t.Fatalf("got %q, %v, want %q", u.Name, err, tc.user)
+			}
+		})
+	}
+}
+
+func TestAuthenticateStaticOnly(t *testing.T) {
+	a := NewAuthenticator(map[string]string{"token": "alice"}, nil)
+	signed := NewAuthenticator(nil, []byte("secret")).Sign("alice", time.Now().Add(time.Hour))
+	if _, err := a.Authenticate(signed); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("hmac token accepted without a secret: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+// Storage enforces the ACL for the user found in the context before passing
+// commands on. Commands without a user, e.g. replicated ones or with
+// authentication disabled, are not checked.
+type Storage struct {
+	storage.IStorage
+
+	acl *ACL
+}
+
+func NewStorage(s storage.IStorage, acl *ACL) *Storage {
+	return &Storage{
+		IStorage: s,
+		acl:      acl,
+	}
+}
+
+func (s *Storage) check(ctx context.Context, cmd storage.Command, perm Perm) error {
+	u, ok := UserFrom(ctx)
+	if !ok {
+		return nil
+	}
+	ns := cmd.Namespace
+	if ns == "" {
+		ns = storage.DefaultNamespace
+	}
+	if cmd.Cmd == storage.Flush {
+		if !s.acl.Allowed(u, ns, "", perm) {
+			return fmt.Errorf("%w: %s on namespace %q", ErrForbidden, u.Name, ns)
+		}
+		return nil
+	}
+
+	keys, err := storage.Keys(cmd)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !s.acl.Allowed(u, ns, k, perm) {
+			return fmt.Errorf("%w: %s on %q", ErrForbidden, u.Name, k)
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Get(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Get
+	if err := s.check(ctx, cmd, Read); err != nil {
+		return err
+	}
+
+	return s.IStorage.Get(ctx, cmd)
+}
+
+func (s *Storage) Set(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Set
+	if err := s.check(ctx, cmd, Write); err != nil {
+		return err
+	}
+
+	return s.IStorage.Set(ctx, cmd)
+}
+
+func (s *Storage) Del(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Del
+	if err := s.check(ctx, cmd, Write); err != nil {
+		return err
+	}
+
+	return s.IStorage.Del(ctx, cmd)
+}
+
+func (s *Storage) Rename(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Rename
+	if err := s.check(ctx, cmd, Write); err != nil {
+		return err
+	}
+
+	return s.IStorage.Rename(ctx, cmd)
+}
+
+func (s *Storage) Scan(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Scan
+	if err := s.check(ctx, cmd, Read); err != nil {
+		return err
+	}
+
+	return s.IStorage.Scan(ctx, cmd)
+}
+
+func (s *Storage) Flush(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Flush
+	if err := s.check(ctx, cmd, Admin); err != nil {
+		return err
+	}
+
+	return s.IStorage.Flush(ctx, cmd)
+}
+
+func (s *Storage) Do(ctx context.Context, cmd storage.Command) error {
+	perm := Write
+	switch cmd.Cmd {
+	case storage.Get, storage.Scan:
+		perm = Read
+	case storage.Flush:
+		perm = Admin
+	}
+	if err := s.check(ctx, cmd, perm); err != nil {
+		return err
+	}
+
+	return s.IStorage.Do(ctx, cmd)
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+// recorder records the commands passed on.
+type recorder struct {
+	storage.IStorage
+
+	cmds []storage.Cmd
+}
+
+func (r *recorder) record(cmd storage.Command) error {
+	r.cmds = append(r.cmds, cmd.Cmd)
+	return nil
+}
+
+func (r *recorder) Do(_ context.Context, cmd storage.Command) error     { return r.record(cmd) }
+func (r *recorder) Get(_ context.Context, cmd storage.Command) error    { return r.record(cmd) }
+func (r *recorder) Set(_ context.Context, cmd storage.Command) error    { return r.record(cmd) }
+func (r *recorder) Del(_ context.Context, cmd storage.Command) error    { return r.record(cmd) }
+func (r *recorder) Rename(_ context.Context, cmd storage.Command) error { return r.record(cmd) }
+func (r *recorder) Scan(_ context.Context, cmd storage.Command) error   { return r.record(cmd) }
+func (r *recorder) Flush(_ context.Context, cmd storage.Command) error  { return r.record(cmd) }
+
+func TestStorage(t *testing.T) {
+	acl := NewACL(
+		Rule{User: "alice", Namespace: "*", Prefix: "users/", Perm: Read | Write},
+		Rule{User: "ops", Namespace: "*", Perm: Admin},
+	)
+	key := func(k string) []byte { return storage.AppendKey(nil, k) }
+	rename := func(from, to string) []byte { return storage.AppendKey(key(from), to) }
+
+	for _, tc := range []struct {
+		name    string
+		user    string
+		call    func(s *Storage, ctx context.Context, cmd storage.Command) error
+		payload []byte
+		allowed bool
+	}{
+		{name: "get", user: "alice", call: (*Storage).Get, payload: key("users/1"), allowed: true},
+		{name: "get outside prefix", user: "alice", call: (*Storage).Get, payload: key("orders/1")},
+		{name: "set", user: "alice", call: (*Storage).Set, payload: append(key("users/1"), "v"...), allowed: true},
+		{name: "del outside prefix", user: "alice", call: (*Storage).Del, payload: key("orders/1")},
+		{name: "rename", user: "alice", call: (*Storage).Rename, payload: rename("users/1", "users/2"), allowed: true},
+		{name: "rename from outside prefix", user: "alice", call: (*Storage).Rename, payload: rename("orders/1", "users/1")},
+		{name: "rename to outside prefix", user: "alice", call: (*Storage).Rename, payload: rename("users/1", "orders/1")},
+		{name: "scan prefix", user: "alice", call: (*Storage).Scan, payload: key("users/"), allowed: true},
+		{name: "scan within prefix", user: "alice", call: (*Storage).Scan, payload: key("users/a"), allowed: true},
+		{name: "scan wider prefix", user: "alice", call: (*Storage).Scan, payload: key("user")},
+		{name: "scan all", user: "alice", call: (*Storage).Scan, payload: key("")},
+		{name: "flush", user: "alice", call: (*Storage).Flush},
+		{name: "flush admin", user: "ops", call: (*Storage).Flush, allowed: true},
+		{name: "without user", call: (*Storage).Flush, allowed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			next := new(recorder)
+			s := NewStorage(next, acl)
+			ctx := context.Background()
+			if tc.user != "" {
+				ctx = WithUser(ctx, User{Name: tc.user})
+			}
+			err := tc.call(s, ctx, storage.Command{Payload: tc.payload})
+			switch {
+			case tc.allowed && (err != nil || len(next.cmds) != 1):
+				t.Fatalf("rejected: %v", err)
+			case !tc.allowed && (!errors.Is(err, ErrForbidden) || len(next.cmds) != 0):
+				t.Fatalf("passed on %v: %v", next.cmds, err)
+			}
+		})
+	}
+}
+
+func TestStorageDo(t *testing.T) {
+	acl := NewACL(Rule{User: "reader", Namespace: "*", Perm: Read})
+	ctx := WithUser(context.Background(), User{Name: "reader"})
+	for cmd, allowed := range map[storage.Cmd]bool{
+		storage.Get:   true,
+		storage.Scan:  true,
+		storage.Set:   false,
+		storage.Del:   false,
+		storage.Flush: false,
+	} {
+		next := new(recorder)
+		err := NewStorage(next, acl).Do(ctx, storage.Command{Cmd: cmd, Payload: storage.AppendKey(nil, "k")})
+		if allowed != (err == nil) || allowed != (len(next.cmds) == 1) {
+			t.Fatalf("%v: allowed %v, got %v", cmd, allowed, err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthdm/hollywood/actor"
+	"github.com/anthdm/hollywood/cluster"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+const (
+	// snapshotIdle is how long a donor keeps a snapshot nobody asks chunks of.
+	snapshotIdle = 30 * time.Second
+	// chunkAttempts bounds the requests of one chunk before the transfer
+	// starts over.
+	chunkAttempts = 3
+)
+
+var (
+	errBootstrapping     = errors.New("syncing state from a peer")
+	errBootstrapDisabled = errors.New("bootstrap is disabled on this node")
+	errBufferOverflow    = errors.New("writes received during the transfer overflowed the buffer")
+)
+
+type BootstrapCfg struct {
+	// Enabled makes the node sync from a member before it is ready, when
+	// its storage is empty.
+	Enabled bool
+	// Wait is how long to wait for another member, without one the node
+	// is the first of the cluster and starts empty.
+	Wait time.Duration
+	// MaxBuffer bounds the bytes of writes buffered during the transfer.
+	MaxBuffer int
+	// ChunkSize is the bytes of snapshot sent per message.
+	ChunkSize int
+	Timeout   time.Duration
+	Logger    *slog.Logger
+}
+
+// Bootstrap brings a node joining with empty storage up to date. It loads a
+// snapshot of a member, streamed in chunks, while the writes replicated to
+// the node are buffered, then applies the buffered writes in order before
+// the node reports ready. Members serve the snapshots, they are taken with
+// storage.Save so nodes must share their encryption keys.
+type Bootstrap struct {
+	store   *storage.Storage
+	cluster *cluster.Cluster
+	cfg     BootstrapCfg
+
+	mu       sync.Mutex
+	syncing  bool
+	buffered []bufferedCommand
+	size     int
+	overflow bool
+	ready    atomic.Bool
+
+	snapshotsMu sync.Mutex
+	snapshots   map[uint64]*donorSnapshot
+	snapshotID  atomic.Uint64
+
+	served atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+type bufferedCommand struct {
+	origin string
+	cmd    *clusterpb.Command
+}
+
+type donorSnapshot struct {
+	data []byte
+	used time.Time
+}
+
+func NewBootstrap(store *storage.Storage, cluster *cluster.Cluster, cfg BootstrapCfg) *Bootstrap {
+	if cfg.MaxBuffer <= 0 {
+		cfg.MaxBuffer = 64 << 20
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = storage.DefaultChunkSize
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	b := &Bootstrap{
+		store:     store,
+		cluster:   cluster,
+		cfg:       cfg,
+		syncing:   cfg.Enabled,
+		snapshots: make(map[uint64]*donorSnapshot),
+	}
+	b.ready.Store(!cfg.Enabled)
+	// ids of a restarted donor must not match the ones it gave before
+	b.snapshotID.Store(uint64(time.Now().UnixNano()))
+
+	return b
+}
+
+// Ready returns errBootstrapping until the node synced, b may be nil.
+func (b *Bootstrap) Ready() error {
+	if b == nil || b.ready.Load() {
+		return nil
+	}
+
+	return errBootstrapping
+}
+
+// Run syncs from a member, retrying after errors until it succeeds, there
+// is no member left or ctx is done. A node that has data, e.g. restored from
+// its snapshot, only catches up through anti-entropy. The node is ready once
+// Run returns, unless ctx is done first.
+func (b *Bootstrap) Run(ctx context.Context) {
+	if b.Ready() == nil {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		st, err := b.store.Stats(ctx)
+		if err == nil {
+			if st.Keys > 0 {
+				b.cfg.Logger.Info("storage not empty, skipping bootstrap", "keys", st.Keys)
+				b.finish(ctx)
+				return
+			}
+			break
+		}
+		b.cfg.Logger.Error("bootstrap stats", "retry", backoff, "err", err)
+		if !b.backoff(ctx, &backoff) {
+			return
+		}
+	}
+
+	for {
+		pid := b.donor(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if pid == nil {
+			b.cfg.Logger.Info("no member to sync from, starting empty")
+			b.finish(ctx)
+			return
+		}
+		err := b.sync(ctx, pid)
+		if err == nil {
+			b.finish(ctx)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		b.cfg.Logger.Warn("bootstrap", "peer", pid.GetAddress(), "retry", backoff, "err", err)
+		if !b.backoff(ctx, &backoff) {
+			return
+		}
+	}
+}
+
+// backoff waits for d and doubles it, it returns false if ctx is done.
+func (b *Bootstrap) backoff(ctx context.Context, d *time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(*d):
+	}
+	*d = min(2*(*d), 30*time.Second)
+
+	return true
+}
+
+// donor waits up to Wait for another member and returns its Server.
+func (b *Bootstrap) donor(ctx context.Context) *actor.PID {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	deadline := time.Now().Add(b.cfg.Wait)
+	for {
+		if pid := randomPeer(b.cluster); pid != nil || time.Now().After(deadline) {
+			return pid
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// sync replaces the storage with a snapshot of pid.
+func (b *Bootstrap) sync(ctx context.Context, pid *actor.PID) error {
+	ctx, span := tracer.Start(ctx, "bootstrap.sync")
+	defer span.End()
+
+	b.restart()
+	b.cfg.Logger.Info("syncing from peer", "peer", pid.GetAddress())
+	var (
+		start = time.Now()
+		data  bytes.Buffer
+		id    uint64
+	)
+	for index := uint64(0); ; index++ {
+		chunk, err := b.chunk(pid, &clusterpb.SnapshotRequest{Version: clusterpb.Version, Id: id, Index: index})
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", index, err)
+		}
+		id = chunk.GetId()
+		data.Write(chunk.GetData())
+		b.bytes.Add(uint64(len(chunk.GetData())))
+		if chunk.GetLast() {
+			break
+		}
+	}
+	size := data.Len()
+	if err := b.load(ctx, &data); err != nil {
+		return err
+	}
+	b.cfg.Logger.Info("snapshot loaded", "peer", pid.GetAddress(), "bytes", size, "took", time.Since(start))
+
+	return nil
+}
+
+// restart starts a transfer over, the new snapshot holds the writes
+// dropped from the buffer before.
+func (b *Bootstrap) restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.overflow = false
+}
+
+// load replaces the storage with the snapshot r, it returns
+// errBufferOverflow if writes were dropped since the transfer started.
+func (b *Bootstrap) load(ctx context.Context, r io.Reader) error {
+	if err := b.store.Load(ctx, r); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.overflow {
+		return errBufferOverflow
+	}
+
+	return nil
+}
+
+func (b *Bootstrap) chunk(pid *actor.PID, req *clusterpb.SnapshotRequest) (*clusterpb.SnapshotChunk, error) {
+	var err error
+	for i := 0; i < chunkAttempts; i++ {
+		var out any
+		if out, err = b.cluster.Engine().Request(pid, req, b.cfg.Timeout).Result(); err != nil {
+			continue
+		}
+		chunk, ok := out.(*clusterpb.SnapshotChunk)
+		if !ok {
+			return nil, fmt.Errorf("unexpected response %T", out)
+		}
+		if chunk.GetErr() != "" {
+			return nil, errors.New(chunk.GetErr())
+		}
+		return chunk, nil
+	}
+
+	return nil, err
+}
+
+// finish applies the buffered writes and marks the node ready. Writes
+// received meanwhile are buffered after the ones being applied, so the
+// order is kept.
+func (b *Bootstrap) finish(ctx context.Context) {
+	applied := 0
+	for {
+		b.mu.Lock()
+		cmds := b.buffered
+		b.buffered, b.size = nil, 0
+		if len(cmds) == 0 {
+			b.syncing = false
+			b.mu.Unlock()
+			break
+		}
+		b.mu.Unlock()
+
+		for _, c := range cmds {
+			if err := applyCommand(ctx, b.store, c.cmd); err != nil && !errors.Is(err, storage.ErrNIL) {
+				b.cfg.Logger.Warn("replay buffered write", "origin", c.origin, "seq", c.cmd.GetSeq(), "err", err)
+			}
+		}
+		applied += len(cmds)
+	}
+	b.ready.Store(true)
+	b.cfg.Logger.Info("bootstrap done", "replayed", applied)
+}
+
+// buffer keeps cmd to apply it after the transfer and reports whether the
+// node is syncing, b may be nil.
+func (b *Bootstrap) buffer(origin string, cmd *clusterpb.Command) bool {
+	if b.Ready() == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.syncing {
+		return false
+	}
+
+	if b.size+len(cmd.GetPayload()) > b.cfg.MaxBuffer {
+		if !b.overflow {
+			b.cfg.Logger.Warn("bootstrap buffer full, the transfer will start over", "commands", len(b.buffered), "bytes", b.size)
+		}
+		b.overflow = true
+		b.buffered, b.size = nil, 0
+		return true
+	}
+	b.buffered = append(b.buffered, bufferedCommand{origin: origin, cmd: cmd})
+	b.size += len(cmd.GetPayload())
+
+	return true
+}
+
+// serve answers the snapshot request of a joining peer, b may be nil.
+func (b *Bootstrap) serve(ctx context.Context, msg *clusterpb.SnapshotRequest) *clusterpb.SnapshotChunk {
+	res := &clusterpb.SnapshotChunk{Version: clusterpb.Version, Id: msg.GetId(), Index: msg.GetIndex()}
+	if b == nil {
+		res.Err = errBootstrapDisabled.Error()
+		return res
+	}
+	if err := b.Ready(); err != nil {
+		res.Err = err.Error()
+		return res
+	}
+
+	id, data, err := b.snapshot(ctx, msg.GetId())
+	if err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	start := msg.GetIndex() * uint64(b.cfg.ChunkSize)
+	if start > uint64(len(data)) {
+		res.Err = fmt.Sprintf("no chunk %d", msg.GetIndex())
+		return res
+	}
+	end := min(start+uint64(b.cfg.ChunkSize), uint64(len(data)))
+	res.Id = id
+	res.Data = data[start:end]
+	res.Last = end == uint64(len(data))
+
+	return res
+}
+
+// snapshot returns the snapshot id, taking a new one if id is 0.
+func (b *Bootstrap) snapshot(ctx context.Context, id uint64) (uint64, []byte, error) {
+	b.snapshotsMu.Lock()
+	defer b.snapshotsMu.Unlock()
+
+	now := time.Now()
+	for id, s := range b.snapshots {
+		if now.Sub(s.used) > snapshotIdle {
+			delete(b.snapshots, id)
+		}
+	}
+	if id != 0 {
+		s, ok := b.snapshots[id]
+		if !ok {
+			return 0, nil, fmt.Errorf("snapshot %d expired", id)
+		}
+		s.used = now
+		return id, s.data, nil
+	}
+
+	var buf bytes.Buffer
+	if err := b.store.Save(ctx, &buf); err != nil {
+		return 0, nil, err
+	}
+	id = b.snapshotID.Add(1)
+	b.snapshots[id] = &donorSnapshot{data: buf.Bytes(), used: now}
+	b.served.Add(1)
+
+	return id, buf.Bytes(), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+func TestBootstrapNotReadyOnError(t *testing.T) {
+	// the storage is not running, its stats time out
+	b := NewBootstrap(storage.New(), nil, BootstrapCfg{
+		Enabled: true,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	b.Run(ctx)
+	if b.Ready() == nil {
+		t.Fatal("ready after the storage failed")
+	}
+}
+
+func newRunningStorage(t *testing.T) *storage.Storage {
+	t.Helper()
+	s := storage.New()
+	go s.Run(context.Background())
+	t.Cleanup(func() { _ = s.CloseAndWait() })
+
+	return s
+}
+
+// storedValue returns the value of key, ok unset if it is missing.
+func storedValue(t *testing.T, s *storage.Storage, key string) (string, bool) {
+	t.Helper()
+	var out bytes.Buffer
+	err := s.Get(context.Background(), storage.Command{Payload: storage.AppendKey(nil, key), W: &out})
+	if errors.Is(err, storage.ErrNIL) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String(), true
+}
+
+func snapshotOf(t *testing.T, values map[string]string) *bytes.Buffer {
+	t.Helper()
+	donor := newRunningStorage(t)
+	for k, v := range values {
+		if err := donor.Set(context.Background(), storage.Command{Payload: append(storage.AppendKey(nil, k), v...)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := donor.Save(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestBootstrapReplaysInOrder(t *testing.T) {
+	store := newRunningStorage(t)
+	b := NewBootstrap(store, nil, BootstrapCfg{
+		Enabled: true,
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	// taken before the writes buffered during the transfer
+	snapshot := snapshotOf(t, map[string]string{"a": "snapshot", "b": "snapshot", "c": "snapshot"})
+
+	// every write has the same time, the last one applied wins
+	at := time.Now().UnixNano()
+	write := func(c storage.Cmd, key, value string) {
+		t.Helper()
+		cmd := &clusterpb.Command{Cmd: int32(c), Payload: append(storage.AppendKey(nil, key), value...), Modified: at}
+		if !b.buffer("origin", cmd) {
+			t.Fatalf("%s %s not buffered", c, key)
+		}
+	}
+	write(storage.Set, "a", "first")
+	write(storage.Del, "a", "")
+	write(storage.Set, "a", "last")
+	write(storage.Set, "b", "first")
+	write(storage.Del, "b", "")
+	write(storage.Set, "d", "buffered")
+
+	if b.Ready() == nil {
+		t.Fatal("ready during the transfer")
+	}
+	if err := b.load(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	b.finish(context.Background())
+	if err := b.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "last", "b": "", "c": "snapshot", "d": "buffered"} {
+		v, ok := storedValue(t, store, key)
+		if ok != (want != "") || v != want {
+			t.Errorf("%s: got %q, %v, want %q", key, v, ok, want)
+		}
+	}
+
+	// once ready writes are applied as they come
+	if b.buffer("origin", &clusterpb.Command{Cmd: int32(storage.Set), Payload: storage.AppendKey(nil, "e")}) {
+		t.Fatal("write buffered once ready")
+	}
+}
+
+func TestBootstrapOverflowRestarts(t *testing.T) {
+	store := newRunningStorage(t)
+	b := NewBootstrap(store, nil, BootstrapCfg{
+		Enabled:   true,
+		MaxBuffer: 16,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	write := func(key, value string) {
+		t.Helper()
+		if !b.buffer("origin", &clusterpb.Command{Cmd: int32(storage.Set), Payload: append(storage.AppendKey(nil, key), value...)}) {
+			t.Fatalf("%s not buffered", key)
+		}
+	}
+
+	write("a", "1")
+	write("b", strings.Repeat("x", 16))
+	if err := b.load(context.Background(), snapshotOf(t, map[string]string{"c": "old"})); !errors.Is(err, errBufferOverflow) {
+		t.Fatalf("loaded after an overflow: %v", err)
+	}
+	if b.Ready() == nil {
+		t.Fatal("ready after an overflow")
+	}
+
+	// the next transfer has the writes dropped before
+	b.restart()
+	write("d", "2")
+	if err := b.load(context.Background(), snapshotOf(t, map[string]string{"a": "1", "b": strings.Repeat("x", 16), "c": "new"})); err != nil {
+		t.Fatal(err)
+	}
+	b.finish(context.Background())
+	for key, want := range map[string]string{"a": "1", "b": strings.Repeat("x", 16), "c": "new", "d": "2"} {
+		if v, ok := storedValue(t, store, key); !ok || v != want {
+			t.Errorf("%s: got %q, %v, want %q", key, v, ok, want)
+		}
+	}
+}
@@ -1,17 +1,694 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+
+	"github.com/dmitrorezn/dcache/logging"
+	"github.com/dmitrorezn/dcache/storage"
 )
 
-var nodeID = flag.String("nodeID", "leader", "Node ID env file suffix")
+// Cfg is read from, in increasing precedence, the config file, the
+// environment and command line flags. The config file holds KEY=VALUE lines
+// named like the environment variables; every variable can also be set by
+// a flag, e.g. MAX_VALUE_SIZE by -max-value-size. Fields tagged reload can be
+// changed by reloading the config while running.
+type Cfg struct {
+	NodeID string `env:"NODE_ID" envDefault:"leader" flag:"nodeID"`
+	// ConfigFile defaults to .env_<NodeID> if that exists.
+	ConfigFile string `env:"CONFIG_FILE" flag:"config"`
+	Region     string `env:"REGION" envDefault:"eu-west"`
+
+	Port        string        `env:"PORT" envDefault:"8080"`
+	LeaderAddr  string        `env:"LEADER_ADDR"`
+	ClusterAddr string        `env:"CLUSTER_ADDR"`
+	IsLeader    bool          `env:"IS_LEADER"`
+	Timeout     time.Duration `env:"TIMEOUT" envDefault:"15s"`
+
+	// ReplicationMode is "actor" to send writes to peers after applying them
+	// locally, "raft" to acknowledge writes once committed by a quorum, or
+	// "partitioned" to keep each key only on ReplicationFactor members of a
+	// consistent hash ring with VNodes tokens per member. Partitioned nodes
+	// send requests for keys they do not own to an owner and hand keys over
+	// when members join or leave, they do not bootstrap and anti-entropy
+	// only repairs the keys both nodes own.
+	ReplicationMode   string `env:"REPLICATION_MODE" envDefault:"actor"`
+	ReplicationFactor int    `env:"REPLICATION_FACTOR" envDefault:"3"`
+	VNodes            int    `env:"VNODES" envDefault:"128"`
+	RaftAddr          string `env:"RAFT_ADDR"`
+	// RaftDir holds the raft log and snapshots, DATA_DIR/raft if empty.
+	RaftDir string `env:"RAFT_DIR"`
+	// PeersFile lists the nodes bootstrapping a new raft cluster.
+	PeersFile          string        `env:"PEERS_FILE" envDefault:"peers.json"`
+	RaftSnapshotRetain int           `env:"RAFT_SNAPSHOT_RETAIN" envDefault:"2"`
+	RaftApplyTimeout   time.Duration `env:"RAFT_APPLY_TIMEOUT" envDefault:"5s"`
+	// ReadMaxLag is the lag bounded reads accept unless they set one.
+	ReadMaxLag time.Duration `env:"READ_MAX_LAG" envDefault:"1s"`
+	// LeaderForward decides what a follower does with a write in raft mode:
+	// "proxy" applies it through the leader, "redirect" answers with a 307
+	// to the leader, "off" rejects it with 421.
+	LeaderForward  string        `env:"LEADER_FORWARD" envDefault:"proxy"`
+	ForwardTimeout time.Duration `env:"FORWARD_TIMEOUT" envDefault:"10s"`
+	// AdvertiseURL is where other nodes redirect clients to, defaults to the
+	// listen address.
+	AdvertiseURL string `env:"ADVERTISE_URL"`
+
+	MaxBodySize  int64 `env:"MAX_BODY_SIZE" envDefault:"16777216" reload:"true"`
+	MaxValueSize int   `env:"MAX_VALUE_SIZE" envDefault:"16777216"`
+	ChunkSize    int   `env:"CHUNK_SIZE" envDefault:"262144"`
+
+	Compression          string `env:"COMPRESSION" envDefault:"none"`
+	CompressionThreshold int    `env:"COMPRESSION_THRESHOLD" envDefault:"1024"`
+
+	// Quotas and eviction are applied by each node outside the raft log,
+	// so raft mode does not take them.
+	EvictionPolicy string `env:"EVICTION_POLICY" envDefault:"noeviction" reload:"true"`
+	MaxKeys        int    `env:"MAX_KEYS" reload:"true"`
+	MaxBytes       int64  `env:"MAX_BYTES" reload:"true"`
+	// Namespaces overrides quotas per namespace, see parseNamespaces.
+	Namespaces string `env:"NAMESPACES" reload:"true"`
+
+	// AuthTokens are static bearer tokens, "token:user,token:user".
+	AuthTokens     string `env:"AUTH_TOKENS"`
+	AuthHMACSecret string `env:"AUTH_HMAC_SECRET"`
+	// ACL grants permissions on key prefixes, see auth.ParseRules.
+	ACL string `env:"ACL"`
+
+	// TLS is used for the HTTP API and, mutually authenticated, for
+	// cluster connections when TLS_CERT_FILE and TLS_KEY_FILE are set.
+	// Peers are verified against TLS_CA_FILE, which TLS requires.
+	TLSCertFile   string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile    string        `env:"TLS_KEY_FILE"`
+	TLSCAFile     string        `env:"TLS_CA_FILE"`
+	TLSClientAuth bool          `env:"TLS_CLIENT_AUTH"`
+	TLSReload     time.Duration `env:"TLS_RELOAD_INTERVAL" envDefault:"30s"`
+
+	// RateLimit is the number of requests per second allowed per client,
+	// zero disables rate limiting.
+	RateLimit      float64 `env:"RATE_LIMIT" reload:"true"`
+	RateLimitBurst int     `env:"RATE_LIMIT_BURST" envDefault:"100" reload:"true"`
+	// ShedQueueDepth is the storage queue depth from which requests are
+	// rejected with 503.
+	ShedQueueDepth int           `env:"SHED_QUEUE_DEPTH" envDefault:"8000" reload:"true"`
+	EnqueueTimeout time.Duration `env:"ENQUEUE_TIMEOUT" envDefault:"1s" reload:"true"`
+	// ReplicationRetryMin and ReplicationRetryMax bound the backoff of
+	// resending commands a peer did not acknowledge, of which at most
+	// ReplicationMaxUnacked are kept in memory per peer.
+	ReplicationRetryMin   time.Duration `env:"REPLICATION_RETRY_MIN" envDefault:"200ms"`
+	ReplicationRetryMax   time.Duration `env:"REPLICATION_RETRY_MAX" envDefault:"30s"`
+	ReplicationMaxUnacked int           `env:"REPLICATION_MAX_UNACKED" envDefault:"10000"`
+	// Commands are sent to each peer in order, in batches of at most
+	// ReplicationBatchSize commands and ReplicationBatchBytes bytes that wait
+	// up to ReplicationLinger to fill up.
+	ReplicationBatchSize  int           `env:"REPLICATION_BATCH_SIZE" envDefault:"128"`
+	ReplicationBatchBytes int           `env:"REPLICATION_BATCH_BYTES" envDefault:"262144"`
+	ReplicationLinger     time.Duration `env:"REPLICATION_LINGER" envDefault:"2ms"`
+	// ReadyReplicationQueue is the fill ratio of the replication queue from
+	// which the node reports itself as not ready.
+	ReadyReplicationQueue float64 `env:"READY_REPLICATION_QUEUE" envDefault:"0.9" reload:"true"`
+	// AntiEntropyInterval is the period of comparing the storage with a
+	// random peer and repairing the keys that differ, 0 disables it. A
+	// round repairs at most AntiEntropyMaxKeys keys and exchanges values at
+	// up to AntiEntropyBandwidth bytes per second, 0 is unlimited. Deleted
+	// keys are remembered for TombstoneTTL so rounds do not bring them back.
+	AntiEntropyInterval  time.Duration `env:"ANTI_ENTROPY_INTERVAL" envDefault:"1m"`
+	AntiEntropyMaxKeys   int           `env:"ANTI_ENTROPY_MAX_KEYS" envDefault:"10000"`
+	AntiEntropyBandwidth int           `env:"ANTI_ENTROPY_BANDWIDTH" envDefault:"1048576" reload:"true"`
+	TombstoneTTL         time.Duration `env:"TOMBSTONE_TTL" envDefault:"1h"`
+	// HintsMaxBytes bounds the commands kept in DATA_DIR/hints for a peer
+	// that is disconnected or ReplicationMaxUnacked commands behind, which
+	// are sent once it catches up. A peer disconnected for longer than
+	// HintsMaxAge gets no hints and the older ones are dropped, longer
+	// outages are repaired by anti-entropy. 0 disables hints. Hints keep the
+	// time of their writes, HintsMaxAge must not exceed TombstoneTTL so a
+	// replayed write still finds the tombstones of later deletes.
+	HintsMaxBytes int64         `env:"HINTS_MAX_BYTES" envDefault:"67108864"`
+	HintsMaxAge   time.Duration `env:"HINTS_MAX_AGE" envDefault:"1h"`
+	// Bootstrap makes a node starting with empty storage load a snapshot of
+	// a member before it reports ready, in actor replication mode. It waits
+	// up to BootstrapWait for a member, the first node of a cluster starts
+	// empty. Writes replicated during the transfer are buffered up to
+	// BootstrapBuffer bytes, the transfer starts over if they exceed it.
+	Bootstrap       bool          `env:"BOOTSTRAP" envDefault:"true"`
+	BootstrapWait   time.Duration `env:"BOOTSTRAP_WAIT" envDefault:"5s"`
+	BootstrapBuffer int           `env:"BOOTSTRAP_BUFFER" envDefault:"67108864"`
+
+	// TraceExporter is "otlp", "stdout" or empty to disable tracing.
+	TraceExporter    string  `env:"TRACE_EXPORTER"`
+	OTLPEndpoint     string  `env:"OTLP_ENDPOINT" envDefault:"localhost:4318"`
+	OTLPInsecure     bool    `env:"OTLP_INSECURE" envDefault:"true"`
+	TraceSampleRatio float64 `env:"TRACE_SAMPLE_RATIO" envDefault:"1"`
+
+	DataDir string `env:"DATA_DIR" envDefault:"data"`
+	// EncryptionKeyFile encrypts the data at rest with the keys of the
+	// file, one "<id> <hex key>" per line. A key is rotated by appending it
+	// and reloading the config.
+	EncryptionKeyFile string `env:"ENCRYPTION_KEY_FILE"`
+	// SnapshotOnShutdown saves the storage to DATA_DIR on shutdown and
+	// loads it on start.
+	SnapshotOnShutdown bool `env:"SNAPSHOT_ON_SHUTDOWN" envDefault:"true"`
+
+	// ShutdownDrainDelay is how long the node reports itself unready before
+	// it stops accepting requests, so load balancers can take it out.
+	ShutdownDrainDelay time.Duration `env:"SHUTDOWN_DRAIN_DELAY"`
+	// ShutdownTimeout bounds waiting for in-flight requests and saving the
+	// snapshot.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"15s"`
+	// ReplicationDrainTimeout bounds sending the queued commands to peers
+	// and waiting for their acknowledgements.
+	ReplicationDrainTimeout time.Duration `env:"REPLICATION_DRAIN_TIMEOUT" envDefault:"10s"`
+
+	LogLevel  string `env:"LOG_LEVEL" envDefault:"info" reload:"true"`
+	LogFormat string `env:"LOG_FORMAT" envDefault:"text"`
+	// LogValues logs stored values instead of their size.
+	LogValues bool `env:"LOG_VALUES"`
+}
+
+type cfgField struct {
+	index  int
+	env    string
+	flag   string
+	def    string
+	reload bool
+}
+
+var cfgFields = func() []cfgField {
+	t := reflect.TypeOf(Cfg{})
+	fields := make([]cfgField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		f := cfgField{
+			index:  i,
+			env:    tag.Get("env"),
+			flag:   tag.Get("flag"),
+			def:    tag.Get("envDefault"),
+			reload: tag.Get("reload") == "true",
+		}
+		if f.flag == "" {
+			f.flag = strings.ReplaceAll(strings.ToLower(f.env), "_", "-")
+		}
+		fields = append(fields, f)
+	}
+
+	return fields
+}()
+
+func (f cfgField) String() string {
+	return fmt.Sprintf("%s (-%s)", f.env, f.flag)
+}
+
+// set parses v into the field of cfg, an empty v leaves it zero.
+func (f cfgField) set(cfg reflect.Value, v string) error {
+	field := cfg.Field(f.index)
+	if v == "" {
+		field.SetZero()
+		return nil
+	}
+	var err error
+	switch k := field.Type(); {
+	case k == reflect.TypeOf(time.Duration(0)):
+		var d time.Duration
+		d, err = time.ParseDuration(v)
+		field.SetInt(int64(d))
+	case k.Kind() == reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(v)
+		field.SetBool(b)
+	case k.Kind() == reflect.Int, k.Kind() == reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(v, 10, k.Bits())
+		field.SetInt(i)
+	case k.Kind() == reflect.Float64:
+		var x float64
+		x, err = strconv.ParseFloat(v, 64)
+		field.SetFloat(x)
+	default:
+		field.SetString(v)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid %s %q", f, field.Type(), v)
+	}
+
+	return nil
+}
+
+// cfgLoader loads Cfg from the same command line and environment every
+// time, so a reload only picks up changes of the config file.
+type cfgLoader struct {
+	args    []string
+	environ map[string]string
+	output  io.Writer
+}
 
-func init() {
-	flag.Parse()
+func newCfgLoader(args []string) *cfgLoader {
+	l := &cfgLoader{
+		args:    args,
+		environ: make(map[string]string),
+		output:  os.Stderr,
+	}
+	for _, f := range cfgFields {
+		if v, ok := os.LookupEnv(f.env); ok {
+			l.environ[f.env] = v
+		}
+	}
 
-	if err := godotenv.Load(".env_" + *nodeID); err != nil {
-		panic(err)
+	return l
+}
+
+func (l *cfgLoader) flags() (map[string]string, error) {
+	fs := flag.NewFlagSet("dcache", flag.ContinueOnError)
+	fs.SetOutput(l.output)
+	values := make(map[string]*string, len(cfgFields))
+	for _, f := range cfgFields {
+		usage := "sets " + f.env
+		if f.reload {
+			usage += ", reloadable"
+		}
+		values[f.flag] = fs.String(f.flag, f.def, usage)
+	}
+	if err := fs.Parse(l.args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	set := make(map[string]string)
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range cfgFields {
+			if f.flag == fl.Name {
+				set[f.env] = *values[fl.Name]
+			}
+		}
+	})
+
+	return set, nil
+}
+
+func (l *cfgLoader) file(path string, required bool) (map[string]string, error) {
+	values, err := godotenv.Read(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+
+	var errs []error
+	for k := range values {
+		if !knownEnv(k) {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %s", path, k))
+		}
+	}
+
+	return values, errors.Join(errs...)
+}
+
+func knownEnv(name string) bool {
+	for _, f := range cfgFields {
+		if f.env == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func (l *cfgLoader) Load() (Cfg, error) {
+	set, err := l.flags()
+	if err != nil {
+		return Cfg{}, err
+	}
+
+	path := first(set["CONFIG_FILE"], l.environ["CONFIG_FILE"])
+	required := path != ""
+	if !required {
+		path = ".env_" + first(set["NODE_ID"], l.environ["NODE_ID"], "leader")
+	}
+	file, err := l.file(path, required)
+	if err != nil {
+		return Cfg{}, err
+	}
+
+	values := make(map[string]string)
+	for _, layer := range []map[string]string{file, l.environ, set} {
+		for k, v := range layer {
+			values[k] = v
+		}
+	}
+	var (
+		cfg  Cfg
+		errs []error
+	)
+	for _, f := range cfgFields {
+		v, ok := values[f.env]
+		if !ok {
+			v = f.def
+		}
+		errs = append(errs, f.set(reflect.ValueOf(&cfg).Elem(), v))
+	}
+	if err = errors.Join(errs...); err != nil {
+		return Cfg{}, err
+	}
+	if file != nil {
+		cfg.ConfigFile = path
 	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the config as a whole and reports every invalid setting.
+func (c Cfg) Validate() error {
+	var errs []error
+	invalid := func(env string, format string, args ...any) {
+		for _, f := range cfgFields {
+			if f.env == env {
+				errs = append(errs, fmt.Errorf("%s: %s", f, fmt.Sprintf(format, args...)))
+			}
+		}
+	}
+
+	if c.NodeID == "" {
+		invalid("NODE_ID", "must not be empty")
+	}
+	if p, err := strconv.Atoi(c.Port); err != nil || p < 0 || p > 65535 {
+		invalid("PORT", "must be a port number, got %q", c.Port)
+	}
+	if c.ClusterAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ClusterAddr); err != nil {
+			invalid("CLUSTER_ADDR", "must be host:port, got %q", c.ClusterAddr)
+		}
+	}
+	switch c.ReplicationMode {
+	case "actor":
+	case "partitioned":
+		if c.ReplicationFactor <= 0 {
+			invalid("REPLICATION_FACTOR", "must be positive, got %d", c.ReplicationFactor)
+		}
+		if c.VNodes <= 0 || c.VNodes > 4096 {
+			invalid("VNODES", "must be in [1, 4096], got %d", c.VNodes)
+		}
+		if c.ForwardTimeout <= 0 {
+			invalid("FORWARD_TIMEOUT", "must be positive, got %s", c.ForwardTimeout)
+		}
+	case "raft":
+		if _, _, err := net.SplitHostPort(c.RaftAddr); err != nil {
+			invalid("RAFT_ADDR", "must be host:port in raft mode, got %q", c.RaftAddr)
+		}
+		if c.PeersFile == "" {
+			invalid("PEERS_FILE", "must not be empty in raft mode")
+		}
+		if c.RaftSnapshotRetain <= 0 {
+			invalid("RAFT_SNAPSHOT_RETAIN", "must be positive, got %d", c.RaftSnapshotRetain)
+		}
+		if c.RaftApplyTimeout <= 0 {
+			invalid("RAFT_APPLY_TIMEOUT", "must be positive, got %s", c.RaftApplyTimeout)
+		}
+		switch c.LeaderForward {
+		case forwardProxy, forwardRedirect, forwardOff:
+		default:
+			invalid("LEADER_FORWARD", "must be proxy, redirect or off, got %q", c.LeaderForward)
+		}
+		if c.ReadMaxLag <= 0 {
+			invalid("READ_MAX_LAG", "must be positive, got %s", c.ReadMaxLag)
+		}
+		// replicas would evict different keys and reject different writes
+		if p, err := storage.ParseEvictionPolicy(c.EvictionPolicy); err == nil && p != storage.NoEviction {
+			invalid("EVICTION_POLICY", "must be noeviction in raft mode, got %q", c.EvictionPolicy)
+		}
+		if c.MaxKeys != 0 {
+			invalid("MAX_KEYS", "is not supported in raft mode")
+		}
+		if c.MaxBytes != 0 {
+			invalid("MAX_BYTES", "is not supported in raft mode")
+		}
+		if namespaces, err := parseNamespaces(c.Namespaces, c.CompressionThreshold); err == nil {
+			for name, ns := range namespaces {
+				if ns.MaxKeys != 0 || ns.MaxBytes != 0 || ns.Policy != storage.NoEviction {
+					invalid("NAMESPACES", "namespace %q: quotas and eviction are not supported in raft mode", name)
+				}
+			}
+		}
+		if c.ForwardTimeout <= 0 {
+			invalid("FORWARD_TIMEOUT", "must be positive, got %s", c.ForwardTimeout)
+		}
+		if c.AdvertiseURL != "" {
+			if u, err := url.Parse(c.AdvertiseURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				invalid("ADVERTISE_URL", "must be an http or https URL, got %q", c.AdvertiseURL)
+			}
+		}
+	default:
+		invalid("REPLICATION_MODE", "must be actor, raft or partitioned, got %q", c.ReplicationMode)
+	}
+	if c.MaxBodySize <= 0 {
+		invalid("MAX_BODY_SIZE", "must be positive, got %d", c.MaxBodySize)
+	}
+	if c.MaxValueSize <= 0 {
+		invalid("MAX_VALUE_SIZE", "must be positive, got %d", c.MaxValueSize)
+	}
+	if c.ChunkSize <= 0 {
+		invalid("CHUNK_SIZE", "must be positive, got %d", c.ChunkSize)
+	}
+	if _, err := storage.ParseCodec(c.Compression); err != nil {
+		invalid("COMPRESSION", "%v, use none, snappy or zstd", err)
+	}
+	if c.CompressionThreshold < 0 {
+		invalid("COMPRESSION_THRESHOLD", "must not be negative, got %d", c.CompressionThreshold)
+	}
+	if _, err := storage.ParseEvictionPolicy(c.EvictionPolicy); err != nil {
+		invalid("EVICTION_POLICY", "%v, use noeviction, lru or random", err)
+	}
+	if c.MaxKeys < 0 {
+		invalid("MAX_KEYS", "must not be negative, got %d", c.MaxKeys)
+	}
+	if c.MaxBytes < 0 {
+		invalid("MAX_BYTES", "must not be negative, got %d", c.MaxBytes)
+	}
+	if _, err := parseNamespaces(c.Namespaces, c.CompressionThreshold); err != nil {
+		invalid("NAMESPACES", "%v", err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		invalid("TLS_CERT_FILE", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSCertFile != "" && c.TLSCAFile == "" {
+		// cluster connections verify peers against it
+		invalid("TLS_CA_FILE", "must be set with TLS_CERT_FILE")
+	}
+	if c.TLSClientAuth && c.TLSCAFile == "" {
+		invalid("TLS_CLIENT_AUTH", "requires TLS_CA_FILE")
+	}
+	if c.TLSReload <= 0 {
+		invalid("TLS_RELOAD_INTERVAL", "must be positive, got %s", c.TLSReload)
+	}
+	if c.RateLimit < 0 {
+		invalid("RATE_LIMIT", "must not be negative, got %v", c.RateLimit)
+	}
+	if c.RateLimit > 0 && c.RateLimitBurst <= 0 {
+		invalid("RATE_LIMIT_BURST", "must be positive when RATE_LIMIT is set, got %d", c.RateLimitBurst)
+	}
+	if c.ShedQueueDepth < 0 {
+		invalid("SHED_QUEUE_DEPTH", "must not be negative, got %d", c.ShedQueueDepth)
+	}
+	if c.EnqueueTimeout < 0 {
+		invalid("ENQUEUE_TIMEOUT", "must not be negative, got %s", c.EnqueueTimeout)
+	}
+	if c.ReplicationRetryMin <= 0 {
+		invalid("REPLICATION_RETRY_MIN", "must be positive, got %s", c.ReplicationRetryMin)
+	}
+	if c.ReplicationRetryMax < c.ReplicationRetryMin {
+		invalid("REPLICATION_RETRY_MAX", "must not be less than REPLICATION_RETRY_MIN, got %s", c.ReplicationRetryMax)
+	}
+	if c.ReplicationMaxUnacked <= 0 {
+		invalid("REPLICATION_MAX_UNACKED", "must be positive, got %d", c.ReplicationMaxUnacked)
+	}
+	if c.ReplicationBatchSize <= 0 {
+		invalid("REPLICATION_BATCH_SIZE", "must be positive, got %d", c.ReplicationBatchSize)
+	}
+	if c.ReplicationBatchBytes <= 0 {
+		invalid("REPLICATION_BATCH_BYTES", "must be positive, got %d", c.ReplicationBatchBytes)
+	}
+	if c.ReplicationLinger < 0 {
+		invalid("REPLICATION_LINGER", "must not be negative, got %s", c.ReplicationLinger)
+	}
+	if c.ReadyReplicationQueue <= 0 || c.ReadyReplicationQueue > 1 {
+		invalid("READY_REPLICATION_QUEUE", "must be in (0, 1], got %v", c.ReadyReplicationQueue)
+	}
+	if c.AntiEntropyInterval < 0 {
+		invalid("ANTI_ENTROPY_INTERVAL", "must not be negative, got %s", c.AntiEntropyInterval)
+	}
+	if c.AntiEntropyMaxKeys <= 0 {
+		invalid("ANTI_ENTROPY_MAX_KEYS", "must be positive, got %d", c.AntiEntropyMaxKeys)
+	}
+	if c.AntiEntropyBandwidth < 0 {
+		invalid("ANTI_ENTROPY_BANDWIDTH", "must not be negative, got %d", c.AntiEntropyBandwidth)
+	}
+	if c.TombstoneTTL < 2*c.AntiEntropyInterval || c.TombstoneTTL <= 0 {
+		invalid("TOMBSTONE_TTL", "must be positive and at least twice ANTI_ENTROPY_INTERVAL, got %s", c.TombstoneTTL)
+	}
+	if c.HintsMaxBytes < 0 {
+		invalid("HINTS_MAX_BYTES", "must not be negative, got %d", c.HintsMaxBytes)
+	}
+	if c.HintsMaxAge <= 0 || c.HintsMaxAge > c.TombstoneTTL {
+		invalid("HINTS_MAX_AGE", "must be positive and at most TOMBSTONE_TTL, got %s", c.HintsMaxAge)
+	}
+	if c.BootstrapWait < 0 {
+		invalid("BOOTSTRAP_WAIT", "must not be negative, got %s", c.BootstrapWait)
+	}
+	if c.BootstrapBuffer <= 0 {
+		invalid("BOOTSTRAP_BUFFER", "must be positive, got %d", c.BootstrapBuffer)
+	}
+	if c.ShutdownDrainDelay < 0 {
+		invalid("SHUTDOWN_DRAIN_DELAY", "must not be negative, got %s", c.ShutdownDrainDelay)
+	}
+	if c.ShutdownTimeout <= 0 {
+		invalid("SHUTDOWN_TIMEOUT", "must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.ReplicationDrainTimeout <= 0 {
+		invalid("REPLICATION_DRAIN_TIMEOUT", "must be positive, got %s", c.ReplicationDrainTimeout)
+	}
+	switch c.TraceExporter {
+	case "", "otlp", "stdout":
+	default:
+		invalid("TRACE_EXPORTER", "must be otlp, stdout or empty, got %q", c.TraceExporter)
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		invalid("TRACE_SAMPLE_RATIO", "must be in [0, 1], got %v", c.TraceSampleRatio)
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		invalid("LOG_LEVEL", "%v, use debug, info, warn or error", err)
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", "text", "json":
+	default:
+		invalid("LOG_FORMAT", "must be text or json, got %q", c.LogFormat)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reload returns c with the reloadable settings taken from next, along with
+// the names of the settings that changed and of those that changed but
+// need a restart to take effect.
+func (c Cfg) Reload(next Cfg) (cfg Cfg, changed, restart []string) {
+	var (
+		cur = reflect.ValueOf(&c).Elem()
+		nxt = reflect.ValueOf(next)
+	)
+	for _, f := range cfgFields {
+		if reflect.DeepEqual(cur.Field(f.index).Interface(), nxt.Field(f.index).Interface()) {
+			continue
+		}
+		if !f.reload {
+			restart = append(restart, f.env)
+			continue
+		}
+		cur.Field(f.index).Set(nxt.Field(f.index))
+		changed = append(changed, f.env)
+	}
+
+	return c, changed, restart
+}
+
+// namespaceCfgs returns the storage settings of namespaces without and
+// with NAMESPACES overrides.
+func (c Cfg) namespaceCfgs() (storage.NamespaceCfg, map[string]storage.NamespaceCfg, error) {
+	policy, err := storage.ParseEvictionPolicy(c.EvictionPolicy)
+	if err != nil {
+		return storage.NamespaceCfg{}, nil, err
+	}
+	namespaces, err := parseNamespaces(c.Namespaces, c.CompressionThreshold)
+	if err != nil {
+		return storage.NamespaceCfg{}, nil, err
+	}
+
+	return storage.NamespaceCfg{
+		MaxKeys:  c.MaxKeys,
+		MaxBytes: c.MaxBytes,
+		Policy:   policy,
+	}, namespaces, nil
+}
+
+// parseNamespaces parses per namespace settings in the form
+//
+//	name:maxKeys=1000,maxBytes=1048576,policy=lru,compression=zstd,threshold=512;other:...
+//
+// A namespace compressing its values without a threshold of its own uses
+// threshold.
+func parseNamespaces(spec string, threshold int) (map[string]storage.NamespaceCfg, error) {
+	namespaces := make(map[string]storage.NamespaceCfg)
+	for _, ns := range strings.Split(spec, ";") {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		name, opts, _ := strings.Cut(ns, ":")
+		var (
+			cfg          storage.NamespaceCfg
+			codec        *storage.Codec
+			nsThreshold  = threshold
+			hasThreshold bool
+		)
+		for _, opt := range strings.Split(opts, ",") {
+			if opt = strings.TrimSpace(opt); opt == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(opt, "=")
+			if !ok {
+				return nil, fmt.Errorf("namespace %q: expected key=value, got %q", name, opt)
+			}
+			var err error
+			switch k {
+			case "maxKeys":
+				cfg.MaxKeys, err = strconv.Atoi(v)
+			case "maxBytes":
+				cfg.MaxBytes, err = strconv.ParseInt(v, 10, 64)
+			case "policy":
+				cfg.Policy, err = storage.ParseEvictionPolicy(v)
+			case "compression":
+				var c storage.Codec
+				if c, err = storage.ParseCodec(v); err == nil {
+					codec = &c
+				}
+			case "threshold":
+				if nsThreshold, err = strconv.Atoi(v); err == nil && nsThreshold < 0 {
+					err = errors.New("must not be negative")
+				}
+				hasThreshold = true
+			default:
+				err = errors.New("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("namespace %q option %q: %w", name, k, err)
+			}
+		}
+		if codec == nil && hasThreshold {
+			return nil, fmt.Errorf("namespace %q option \"threshold\": requires compression", name)
+		}
+		if codec != nil {
+			cfg.Compression = &storage.Compression{Codec: *codec, Threshold: nsThreshold}
+		}
+		namespaces[name] = cfg
+	}
+
+	return namespaces, nil
 }
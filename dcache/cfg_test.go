@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+func TestCfgLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(path, []byte("TIMEOUT=20s\nPORT=7000\nREGION=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l := &cfgLoader{
+		args:    []string{"-config", path, "-nodeID", "n1"},
+		environ: map[string]string{"PORT": "9000"},
+		output:  io.Discard,
+	}
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.NodeID != "n1" || cfg.Port != "9000" || cfg.Timeout != 20*time.Second || cfg.VNodes != 128 || cfg.Region != "" {
+		t.Fatalf("loaded %+v", cfg)
+	}
+	for _, name := range []string{"NODE_ID", "PORT", "TIMEOUT"} {
+		if v, ok := os.LookupEnv(name); ok {
+			t.Fatalf("%s=%q set in the environment", name, v)
+		}
+	}
+
+	l.environ["VNODES"] = "many"
+	if _, err = l.Load(); err == nil {
+		t.Fatal("loaded an invalid VNODES")
+	}
+}
+
+func TestParseNamespaces(t *testing.T) {
+	namespaces, err := parseNamespaces("a:compression=zstd;b:threshold=64,compression=snappy;c:maxKeys=10", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]*storage.Compression{
+		"a": {Codec: storage.Zstd, Threshold: 1024},
+		"b": {Codec: storage.Snappy, Threshold: 64},
+		"c": nil,
+	} {
+		got := namespaces[name].Compression
+		if (got == nil) != (want == nil) || got != nil && *got != *want {
+			t.Fatalf("namespace %s compression %+v, want %+v", name, got, want)
+		}
+	}
+
+	for _, spec := range []string{"a:threshold=64", "a:compression=zstd,threshold=-1"} {
+		if _, err = parseNamespaces(spec, 1024); err == nil {
+			t.Fatalf("parsed %q", spec)
+		}
+	}
+}
+
+func TestCfgRaftQuotas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l := &cfgLoader{
+		args:    []string{"-config", path},
+		environ: map[string]string{"REPLICATION_MODE": "raft", "RAFT_ADDR": "127.0.0.1:7000"},
+		output:  io.Discard,
+	}
+	if _, err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	l.environ["EVICTION_POLICY"] = "lru"
+	l.environ["MAX_KEYS"] = "10"
+	l.environ["NAMESPACES"] = "a:maxBytes=100;b:compression=zstd"
+	_, err := l.Load()
+	for _, env := range []string{"EVICTION_POLICY", "MAX_KEYS", "NAMESPACES"} {
+		if err == nil || !strings.Contains(err.Error(), env) {
+			t.Fatalf("%s accepted in raft mode: %v", env, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"b"`) {
+		t.Fatalf("compression rejected in raft mode: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+// Package clusterpb defines the messages exchanged by the nodes of a cluster.
+package clusterpb
+
+//go:generate protoc -I .. --go_out=.. --go_opt=paths=source_relative clusterpb/cluster.proto
+
+// Version is the protocol version sent in every message.
+const Version = 1
+
+// MinVersion is the oldest protocol version still understood, messages of
+// older peers are dropped. Version 0 is a message without a version.
+const MinVersion = 1
+
+// Supported reports whether a message of version v is understood.
+func Supported(v uint32) bool {
+	return v >= MinVersion
+}
@@ -0,0 +1,372 @@
+// Command dcachectl administers dcache nodes over their HTTP API.
+//
+//	dcachectl [flags] info
+//	dcachectl [flags] members
+//	dcachectl [flags] add-voter <id> <raft address>
+//	dcachectl [flags] add-learner <id> <raft address>
+//	dcachectl [flags] remove <id>
+//	dcachectl [flags] demote <id>
+//	dcachectl [flags] transfer-leader [id]
+//	dcachectl [flags] ring [key [namespace]]
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	addr     = flag.String("addr", env("DCACHE_ADDR", "http://127.0.0.1:8080"), "node URL")
+	token    = flag.String("token", os.Getenv("DCACHE_TOKEN"), "bearer token")
+	caFile   = flag.String("ca", "", "CA certificate verifying the node")
+	certFile = flag.String("cert", "", "client certificate for mutual TLS")
+	keyFile  = flag.String("key", "", "client key for mutual TLS")
+	asJSON   = flag.Bool("json", false, "print raw JSON")
+	timeout  = flag.Duration("timeout", 10*time.Second, "request timeout")
+)
+
+func env(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return def
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: dcachectl [flags] <command>\n\ncommands:\n")
+	w := tabwriter.NewWriter(flag.CommandLine.Output(), 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "  info\tshow node, storage and cluster status\n")
+	fmt.Fprintf(w, "  members\tlist raft members\n")
+	fmt.Fprintf(w, "  add-voter <id> <raft address>\tadd a voting member or promote a learner\n")
+	fmt.Fprintf(w, "  add-learner <id> <raft address>\tadd a non-voting member\n")
+	fmt.Fprintf(w, "  remove <id>\tremove a member\n")
+	fmt.Fprintf(w, "  demote <id>\tturn a voter into a learner\n")
+	fmt.Fprintf(w, "  transfer-leader [id]\ttransfer leadership, to id if given\n")
+	fmt.Fprintf(w, "  ring [key [namespace]]\tshow the hash ring, and the owners of key if given\n")
+	w.Flush()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		fatal(err)
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "info":
+		err = info(c)
+	case "members":
+		err = members(c)
+	case "add-voter", "add-learner":
+		if flag.NArg() != 3 {
+			err = fmt.Errorf("usage: %s <id> <raft address>", cmd)
+			break
+		}
+		err = c.do(http.MethodPost, "/admin/members", map[string]any{
+			"id":      flag.Arg(1),
+			"address": flag.Arg(2),
+			"learner": cmd == "add-learner",
+		}, nil)
+	case "remove":
+		if flag.NArg() != 2 {
+			err = errors.New("usage: remove <id>")
+			break
+		}
+		err = c.do(http.MethodDelete, "/admin/members/"+url.PathEscape(flag.Arg(1)), nil, nil)
+	case "demote":
+		if flag.NArg() != 2 {
+			err = errors.New("usage: demote <id>")
+			break
+		}
+		err = c.do(http.MethodPost, "/admin/members/"+url.PathEscape(flag.Arg(1))+"/demote", nil, nil)
+	case "transfer-leader":
+		err = c.do(http.MethodPost, "/admin/leader/transfer", map[string]string{"id": flag.Arg(1)}, nil)
+	case "ring":
+		if flag.NArg() > 3 {
+			err = errors.New("usage: ring [key [namespace]]")
+			break
+		}
+		err = ring(c, flag.Arg(1), flag.Arg(2))
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "dcachectl:", err)
+	os.Exit(1)
+}
+
+type client struct {
+	http *http.Client
+	base string
+}
+
+func newClient() (*client, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *caFile)
+		}
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return &client{
+		http: &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{TLSClientConfig: cfg},
+		},
+		base: strings.TrimSuffix(*addr, "/"),
+	}, nil
+}
+
+// do sends a request with a JSON body, unless body is nil, and decodes the
+// JSON response into out, unless out is nil.
+func (c *client) do(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type infoResponse struct {
+	Node               string `json:"node"`
+	Role               string `json:"role"`
+	Uptime             string `json:"uptime"`
+	StorageQueue       int    `json:"storageQueue"`
+	StorageQueueCap    int    `json:"storageQueueCap"`
+	ReplicationDropped uint64 `json:"replicationDropped"`
+	Storage            struct {
+		Keys        int   `json:"keys"`
+		Bytes       int64 `json:"bytes"`
+		StoredBytes int64 `json:"storedBytes"`
+	} `json:"storage"`
+	Memory struct {
+		Alloc      uint64 `json:"alloc"`
+		Sys        uint64 `json:"sys"`
+		Goroutines int    `json:"goroutines"`
+	} `json:"memory"`
+	Cluster struct {
+		Address             string   `json:"address"`
+		Members             []string `json:"members"`
+		ReplicationQueue    int      `json:"replicationQueue"`
+		ReplicationQueueCap int      `json:"replicationQueueCap"`
+		Peers               []struct {
+			ID       string    `json:"id"`
+			Address  string    `json:"address"`
+			LastSeen time.Time `json:"lastSeen"`
+			LastSent time.Time `json:"lastSent"`
+			Sent     uint64    `json:"sent"`
+			Received uint64    `json:"received"`
+			Acked    uint64    `json:"acked"`
+			Failed   uint64    `json:"failed"`
+			Retried  uint64    `json:"retried"`
+			Lost     uint64    `json:"lost"`
+			Unacked  int       `json:"unacked"`
+			Version  uint32    `json:"version"`
+		} `json:"peers"`
+	} `json:"cluster"`
+}
+
+func info(c *client) error {
+	var raw json.RawMessage
+	if err := c.do(http.MethodGet, "/admin/info", nil, &raw); err != nil {
+		return err
+	}
+	if *asJSON {
+		var out bytes.Buffer
+		if err := json.Indent(&out, raw, "", "  "); err != nil {
+			return err
+		}
+		_, err := fmt.Println(out.String())
+		return err
+	}
+
+	var i infoResponse
+	if err := json.Unmarshal(raw, &i); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "node\t%s (%s)\n", i.Node, i.Role)
+	fmt.Fprintf(w, "address\t%s\n", i.Cluster.Address)
+	fmt.Fprintf(w, "uptime\t%s\n", i.Uptime)
+	fmt.Fprintf(w, "keys\t%d\n", i.Storage.Keys)
+	fmt.Fprintf(w, "bytes\t%d (stored %d)\n", i.Storage.Bytes, i.Storage.StoredBytes)
+	fmt.Fprintf(w, "memory\t%d alloc, %d sys, %d goroutines\n", i.Memory.Alloc, i.Memory.Sys, i.Memory.Goroutines)
+	fmt.Fprintf(w, "storage queue\t%d/%d\n", i.StorageQueue, i.StorageQueueCap)
+	fmt.Fprintf(w, "replication queue\t%d/%d (%d dropped)\n", i.Cluster.ReplicationQueue, i.Cluster.ReplicationQueueCap, i.ReplicationDropped)
+	fmt.Fprintf(w, "members\t%s\n", strings.Join(i.Cluster.Members, ", "))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(i.Cluster.Peers) == 0 {
+		return nil
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tADDRESS\tPROTOCOL\tLAST SEEN\tLAST SENT\tSENT\tRECEIVED\tACKED\tUNACKED\tRETRIED\tFAILED\tLOST")
+	for _, p := range i.Cluster.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", p.ID, p.Address, p.Version, ago(p.LastSeen), ago(p.LastSent),
+			p.Sent, p.Received, p.Acked, p.Unacked, p.Retried, p.Failed, p.Lost)
+	}
+
+	return w.Flush()
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+type member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+	Self     bool   `json:"self"`
+}
+
+func members(c *client) error {
+	var ms []member
+	if err := c.do(http.MethodGet, "/admin/members", nil, &ms); err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(ms)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tSUFFRAGE\tROLE")
+	for _, m := range ms {
+		role := "follower"
+		if m.Leader {
+			role = "leader"
+		}
+		if m.Self {
+			role += " (this node)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.ID, m.Address, m.Suffrage, role)
+	}
+
+	return w.Flush()
+}
+
+type ringMember struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+}
+
+type ringInfo struct {
+	VNodes            int `json:"vnodes"`
+	ReplicationFactor int `json:"replicationFactor"`
+	Members           []struct {
+		ringMember
+		Tokens  int     `json:"tokens"`
+		Primary float64 `json:"primary"`
+		Replica float64 `json:"replica"`
+	} `json:"members"`
+	Key    string       `json:"key"`
+	Owners []ringMember `json:"owners"`
+}
+
+func ring(c *client, key, namespace string) error {
+	path := "/admin/ring"
+	if key != "" {
+		path += "?" + url.Values{"key": {key}, "namespace": {namespace}}.Encode()
+	}
+	var r ringInfo
+	if err := c.do(http.MethodGet, path, nil, &r); err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "vnodes\t%d\n", r.VNodes)
+	fmt.Fprintf(w, "replication factor\t%d\n\n", r.ReplicationFactor)
+	fmt.Fprintln(w, "ID\tHOST\tTOKENS\tPRIMARY\tREPLICA")
+	for _, m := range r.Members {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\t%.1f%%\n", m.ID, m.Host, m.Tokens, 100*m.Primary, 100*m.Replica)
+	}
+	if r.Key != "" {
+		owners := make([]string, len(r.Owners))
+		for i, m := range r.Owners {
+			owners[i] = m.ID
+		}
+		fmt.Fprintf(w, "\nowners of %s\t%s\n", r.Key, strings.Join(owners, ", "))
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,330 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Data is encrypted with a random data key (DEK) which is itself encrypted
+// ("wrapped") with the current key of the KeyProvider. The header stores the
+// key ID and the wrapped DEK, followed by a sequence of sealed frames:
+//
+//	magic | idLen | keyID | wrapNonce | wrappedDEK | frame...
+//	frame: len(uint32) | AES-GCM(DEK, nonce(counter), chunk, aad(last))
+//
+// Frame nonces are derived from a counter and the last frame is bound through
+// the additional data, so reordered or truncated streams fail to decrypt.
+
+var magic = []byte("DCE1")
+
+const frameSize = 64 << 10
+
+var ErrCorrupted = errors.New("encrypted data corrupted")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewWriter returns a writer encrypting everything written to it into w.
+// Close must be called to write the final frame; it does not close w.
+func NewWriter(w io.Writer, kp KeyProvider) (*Writer, error) {
+	key, err := kp.Current()
+	if err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(key.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	dek := make([]byte, KeySize)
+	if _, err = rand.Read(dek); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, kek.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hdr := append([]byte{}, magic...)
+	hdr = append(hdr, byte(len(key.ID)))
+	hdr = append(hdr, key.ID...)
+	hdr = append(hdr, nonce...)
+	hdr = kek.Seal(hdr, nonce, dek, []byte(key.ID))
+	if _, err = w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, frameSize),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(w.buf) == frameSize {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(w.buf[len(w.buf):frameSize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+
+	return n, nil
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.flush(true)
+}
+
+func (w *Writer) flush(last bool) error {
+	sealed := w.aead.Seal(make([]byte, 4, 4+len(w.buf)+w.aead.Overhead()), frameNonce(w.aead, w.counter), w.buf, frameAAD(last))
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	w.counter++
+	w.buf = w.buf[:0]
+
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+func frameNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+
+	return nonce
+}
+
+func frameAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+// NewReader returns a reader decrypting data written by Writer. The key used
+// for writing is looked up by ID, so data written before a key rotation
+// stays readable as long as the old key is kept in the provider.
+func NewReader(r io.Reader, kp KeyProvider) (*Reader, error) {
+	hdr := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:len(magic)], magic) {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorrupted)
+	}
+	id := make([]byte, hdr[len(magic)])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, err
+	}
+	key, err := kp.Key(string(id))
+	if err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(key.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, kek.NonceSize()+KeySize+kek.Overhead())
+	if _, err = io.ReadFull(r, wrapped); err != nil {
+		return nil, err
+	}
+	dek, err := kek.Open(nil, wrapped[:kek.NonceSize()], wrapped[kek.NonceSize():], id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q", ErrKeyMismatch, id)
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:    r,
+		aead: aead,
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *Reader) next() error {
+	var l [4]byte
+	if _, err := io.ReadFull(r.r, l[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: truncated", ErrCorrupted)
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(l[:])
+	if size > uint32(frameSize+r.aead.Overhead()) {
+		return fmt.Errorf("%w: frame of %d bytes", ErrCorrupted, size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated", ErrCorrupted)
+		}
+		return err
+	}
+
+	nonce := frameNonce(r.aead, r.counter)
+	r.counter++
+	plain, err := r.aead.Open(nil, nonce, sealed, frameAAD(false))
+	if err != nil {
+		if plain, err = r.aead.Open(nil, nonce, sealed, frameAAD(true)); err != nil {
+			return ErrCorrupted
+		}
+		r.done = true
+	}
+	r.buf = plain
+
+	return nil
+}
+
+// Seal encrypts a small value in one piece.
+func Seal(kp KeyProvider, plain []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, kp)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Open decrypts a value produced by Seal.
+func Open(kp KeyProvider, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), kp)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+const keyCheckFile = "keycheck"
+
+var keyCheck = []byte("dcache")
+
+// Verify checks that kp can decrypt the data already stored in dir. On the
+// first start it records a sealed marker; afterwards a provider that cannot
+// open the marker, e.g. because the key file was replaced instead of
+// rotated, is rejected with ErrKeyMismatch. A marker sealed with a key other
+// than the current one is sealed again, so the old key can be dropped once
+// no data uses it.
+func Verify(dir string, kp KeyProvider) error {
+	path := filepath.Join(dir, keyCheckFile)
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		return writeKeyCheck(path, kp)
+	}
+	if err != nil {
+		return err
+	}
+
+	plain, err := Open(kp, sealed)
+	if err != nil || !bytes.Equal(plain, keyCheck) {
+		return errors.Join(ErrKeyMismatch, err)
+	}
+	cur, err := kp.Current()
+	if err != nil {
+		return err
+	}
+	if sealedWith(sealed) != cur.ID {
+		return writeKeyCheck(path, kp)
+	}
+
+	return nil
+}
+
+// sealedWith returns the id of the key sealed was written with, the header
+// is checked by Open.
+func sealedWith(sealed []byte) string {
+	n := int(sealed[len(magic)])
+
+	return string(sealed[len(magic)+1 : len(magic)+1+n])
+}
+
+// writeKeyCheck replaces the marker at path with one sealed with the current
+// key of kp, through a temporary file so a crash leaves either marker.
+func writeKeyCheck(path string, kp KeyProvider) error {
+	sealed, err := Seal(kp, keyCheck)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(sealed)
+	if err = errors.Join(err, f.Sync(), f.Close()); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,251 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyFile writes a key file with a key per id and returns its provider.
+func keyFile(t *testing.T, ids ...string) (*FileKeyProvider, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	writeKeys(t, path, ids...)
+	p, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p, path
+}
+
+func writeKeys(t *testing.T, path string, ids ...string) {
+	t.Helper()
+	var b strings.Builder
+	for _, id := range ids {
+		key := make([]byte, KeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString(id + " " + hex.EncodeToString(key) + "\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	kp, _ := keyFile(t, "1")
+	for _, plain := range [][]byte{nil, []byte("value")} {
+		sealed, err := Seal(kp, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plain) > 0 && bytes.Contains(sealed, plain) {
+			t.Fatal("sealed data contains the value")
+		}
+		got, err := Open(kp, sealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("opened %q, %v, want %q", got, err, plain)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	kp, _ := keyFile(t, "1")
+	plain := make([]byte, 3*frameSize+17)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed bytes.Buffer
+	w, err := NewWriter(&sealed, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plain; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := sealed.Bytes()
+
+	got, err := Open(kp, data)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("read %d bytes, %v, want %d", len(got), err, len(plain))
+	}
+
+	// the last frame has 17 bytes, cut at its start, in it and before it
+	last := len(data) - 4 - 17 - 16
+	for _, cut := range []int{last, len(data) - 1, last - 100} {
+		if _, err = Open(kp, data[:cut]); !errors.Is(err, ErrCorrupted) {
+			t.Fatalf("cut at %d of %d: %v, want ErrCorrupted", cut, len(data), err)
+		}
+	}
+
+	// frames swapped
+	swapped := bytes.Clone(data)
+	frame := 4 + frameSize + 16
+	first := last - 3*frame
+	copy(swapped[first:], data[first+frame:first+2*frame])
+	copy(swapped[first+frame:], data[first:first+frame])
+	if _, err = Open(kp, swapped); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("swapped frames: %v, want ErrCorrupted", err)
+	}
+}
+
+type failReader struct{}
+
+func (failReader) Read([]byte) (int, error) {
+	return 0, errors.New("read past the frame length")
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	kp, _ := keyFile(t, "1")
+	sealed, err := Seal(kp, []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header ends where the only frame starts
+	hdr := len(sealed) - 4 - len("value") - 16
+	data := binary.BigEndian.AppendUint32(bytes.Clone(sealed[:hdr]), frameSize+16+1)
+	// the frame must be rejected before it is read
+	r, err := NewReader(io.MultiReader(bytes.NewReader(data), failReader{}), kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("oversized frame: %v, want ErrCorrupted", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	kp, _ := keyFile(t, "1")
+	other, _ := keyFile(t, "1")
+	unknown, _ := keyFile(t, "2")
+	sealed, err := Seal(kp, []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(other, sealed); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("other key: %v, want ErrKeyMismatch", err)
+	}
+	if _, err = Open(unknown, sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unknown key: %v, want ErrUnknownKey", err)
+	}
+
+	dir := t.TempDir()
+	if err = Verify(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+	if err = Verify(dir, other); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("verify replaced key: %v, want ErrKeyMismatch", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	kp, path := keyFile(t, "1")
+	old, err := Seal(kp, []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = Verify(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate by appending a key
+	keys, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(t, path+".new", "2")
+	added, err := os.ReadFile(path + ".new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, append(keys, added...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = kp.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := kp.Current(); cur.ID != "2" {
+		t.Fatalf("current key %q after rotation", cur.ID)
+	}
+	sealed, err := Seal(kp, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want, data := range map[string][]byte{"old": old, "new": sealed} {
+		if got, err := Open(kp, data); err != nil || string(got) != want {
+			t.Fatalf("opened %q, %v, want %q", got, err, want)
+		}
+	}
+	if err = Verify(dir, kp); err != nil {
+		t.Fatalf("verify after rotation: %v", err)
+	}
+	// the marker is sealed with the current key again
+	marker, err := os.ReadFile(filepath.Join(dir, keyCheckFile))
+	if err != nil || sealedWith(marker) != "2" {
+		t.Fatalf("marker sealed with %q, %v", sealedWith(marker), err)
+	}
+
+	// dropping the old key makes its data unreadable, not the marker
+	if err = os.WriteFile(path, added, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = kp.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(kp, old); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("old data: %v, want ErrUnknownKey", err)
+	}
+	if err = Verify(dir, kp); err != nil {
+		t.Fatalf("verify without the old key: %v", err)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	kp, _ := keyFile(t, "1")
+	dir := t.TempDir()
+	if err := Verify(dir, kp); err != nil {
+		t.Fatal(err)
+	}
+
+	// a replaced key file is rejected and the keys in use are kept
+	next, _ := keyFile(t, "1")
+	if err := Verify(dir, next); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("verify replaced keys: %v, want ErrKeyMismatch", err)
+	}
+	sealed, err := Seal(kp, []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kp.Swap(next)
+	if _, err = Open(kp, sealed); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("opened with swapped keys: %v, want ErrKeyMismatch", err)
+	}
+	if sealed, err = Seal(kp, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Open(next, sealed); err != nil || string(got) != "new" {
+		t.Fatalf("opened %q, %v", got, err)
+	}
+}
@@ -0,0 +1,130 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const KeySize = 32
+
+var (
+	ErrUnknownKey  = errors.New("unknown encryption key")
+	ErrKeyMismatch = errors.New("encryption key mismatch")
+)
+
+type Key struct {
+	ID    string
+	Bytes []byte
+}
+
+type KeyProvider interface {
+	// Current returns the key new data is encrypted with.
+	Current() (Key, error)
+	// Key returns the key with the given id, used to decrypt data written
+	// before a rotation.
+	Key(id string) (Key, error)
+}
+
+// FileKeyProvider reads keys from a file with one "<id> <hex key>" pair per
+// line. The last key in the file is the current one, so a key is rotated by
+// appending a new line and calling Reload; older keys stay readable.
+type FileKeyProvider struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    map[string]Key
+	current Key
+}
+
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{
+		path: path,
+	}
+
+	return p, p.Reload()
+}
+
+func (p *FileKeyProvider) Reload() error {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		keys    = make(map[string]Key)
+		current Key
+		sc      = bufio.NewScanner(bytes.NewReader(data))
+		line    int
+	)
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, " ")
+		if !ok || len(id) > 255 {
+			return fmt.Errorf("%s:%d: expected \"<id> <hex key>\"", p.path, line)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", p.path, line, err)
+		}
+		if len(key) != KeySize {
+			return fmt.Errorf("%s:%d: key must be %d bytes, got %d", p.path, line, KeySize, len(key))
+		}
+		current = Key{ID: id, Bytes: key}
+		keys[id] = current
+	}
+	if err = sc.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys", p.path)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.current = current
+
+	return nil
+}
+
+// Swap replaces the keys of p with those of next, e.g. once next is
+// verified against the stored data.
+func (p *FileKeyProvider) Swap(next *FileKeyProvider) {
+	next.mu.RLock()
+	keys, current := next.keys, next.current
+	next.mu.RUnlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.current = current
+}
+
+func (p *FileKeyProvider) Current() (Key, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.current, nil
+}
+
+func (p *FileKeyProvider) Key(id string) (Key, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	k, ok := p.keys[id]
+	if !ok {
+		return Key{}, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+
+	return k, nil
+}
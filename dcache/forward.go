@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthdm/hollywood/actor"
+	"github.com/anthdm/hollywood/cluster"
+	"github.com/hashicorp/raft"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/raftnode"
+	"github.com/dmitrorezn/dcache/storage"
+	"github.com/dmitrorezn/dcache/tracing"
+)
+
+// Leader forwarding modes, see Cfg.LeaderForward.
+const (
+	forwardProxy    = "proxy"
+	forwardRedirect = "redirect"
+	forwardOff      = "off"
+)
+
+const serverKind = "server"
+
+// serverPID addresses the Server spawned by the node id on host.
+func serverPID(host, id string) *actor.PID {
+	return actor.NewPID(host, serverKind+"/"+id)
+}
+
+// forwardErrors are the errors recognised by the caller of a forwarded
+// command, their position is the code of clusterpb.ForwardResult. Errors
+// are only appended, a code unknown to an older node is reported as a plain
+// error.
+var forwardErrors = []error{
+	storage.ErrNIL,
+	storage.ErrNotLeader,
+	storage.ErrValueTooLarge,
+	storage.ErrQuotaExceeded,
+	storage.ErrOverloaded,
+	storage.ErrStorageClosed,
+	storage.ErrStaleRead,
+	storage.ErrUnknownConsistency,
+}
+
+func newForwardResult(value []byte, err error) *clusterpb.ForwardResult {
+	res := &clusterpb.ForwardResult{Version: clusterpb.Version}
+	if err == nil {
+		res.Value = value
+		return res
+	}
+	res.Err = err.Error()
+	for i, target := range forwardErrors {
+		if errors.Is(err, target) {
+			res.Code = int32(i + 1)
+			break
+		}
+	}
+
+	return res
+}
+
+func forwardResultErr(res *clusterpb.ForwardResult) error {
+	code := int(res.GetCode())
+	switch {
+	case res.GetErr() == "":
+		return nil
+	case code > 0 && code <= len(forwardErrors):
+		return forwardedError{msg: res.GetErr(), err: forwardErrors[code-1]}
+	default:
+		return errors.New(res.GetErr())
+	}
+}
+
+// forwardedError keeps the message of the leader's error while matching the
+// sentinel it wraps.
+type forwardedError struct {
+	msg string
+	err error
+}
+
+func (e forwardedError) Error() string {
+	return e.msg
+}
+
+func (e forwardedError) Unwrap() error {
+	return e.err
+}
+
+var _ storage.IStorage = new(leaderForwarder)
+
+// leaderForwarder sends writes, and reads whose consistency requires the
+// leader, rejected because this node is not the raft leader to the leader's
+// Server and returns its result.
+type leaderForwarder struct {
+	storage.IStorage
+
+	node      *raftnode.Node
+	cluster   *cluster.Cluster
+	timeout   time.Duration
+	chunkSize int
+}
+
+func (f *leaderForwarder) forward(ctx context.Context, cmd storage.Command, err error) error {
+	if !errors.Is(err, storage.ErrNotLeader) {
+		return err
+	}
+	_, id := f.node.LeaderWithID()
+	if id == "" || string(id) == f.cluster.ID() {
+		return err
+	}
+	var host string
+	for _, m := range f.cluster.Members() {
+		if m.ID == string(id) {
+			host = m.Host
+		}
+	}
+	if host == "" {
+		return fmt.Errorf("%w: leader %s is not a cluster member", err, id)
+	}
+
+	return forwardTo(ctx, f.cluster, host, string(id), cmd, f.timeout, f.chunkSize)
+}
+
+func (f *leaderForwarder) Get(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Get
+	return f.forward(ctx, cmd, f.IStorage.Get(ctx, cmd))
+}
+
+func (f *leaderForwarder) Scan(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Scan
+	return f.forward(ctx, cmd, f.IStorage.Scan(ctx, cmd))
+}
+
+func (f *leaderForwarder) Set(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Set
+	return f.forward(ctx, cmd, f.IStorage.Set(ctx, cmd))
+}
+
+func (f *leaderForwarder) Del(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Del
+	return f.forward(ctx, cmd, f.IStorage.Del(ctx, cmd))
+}
+
+func (f *leaderForwarder) Rename(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Rename
+	return f.forward(ctx, cmd, f.IStorage.Rename(ctx, cmd))
+}
+
+func (f *leaderForwarder) Flush(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Flush
+	return f.forward(ctx, cmd, f.IStorage.Flush(ctx, cmd))
+}
+
+// errUnreachable is returned by forwardTo when the member did not answer.
+var errUnreachable = errors.New("member unreachable")
+
+// forwardChunkID numbers the commands forwarded in parts.
+var forwardChunkID atomic.Uint64
+
+// forwardTo sends cmd to the Server of the member id on host, which must not
+// forward it again, and writes the output of reads to cmd.W. A payload or an
+// output larger than chunkSize travels in parts of chunkSize bytes.
+func forwardTo(ctx context.Context, c *cluster.Cluster, host, id string, cmd storage.Command, timeout time.Duration, chunkSize int) error {
+	ctx, span := tracer.Start(ctx, "forward", trace.WithAttributes(
+		attribute.String("cmd", cmd.Cmd.String()),
+		attribute.String("member", id),
+	))
+	defer span.End()
+
+	if chunkSize <= 0 {
+		chunkSize = storage.DefaultChunkSize
+	}
+	pid := serverPID(host, id)
+	command := func(payload []byte) *clusterpb.ForwardCommand {
+		return &clusterpb.ForwardCommand{
+			Version:     clusterpb.Version,
+			Cmd:         int32(cmd.Cmd),
+			Namespace:   cmd.Namespace,
+			Payload:     payload,
+			Trace:       tracing.Inject(ctx),
+			Consistency: int32(cmd.Consistency),
+			MaxLag:      durationpb.New(cmd.MaxLag),
+			Modified:    cmd.Modified,
+			ChunkSize:   int64(chunkSize),
+		}
+	}
+	var (
+		result *clusterpb.ForwardResult
+		err    error
+	)
+	if len(cmd.Payload) <= chunkSize {
+		result, err = forwardRequest(c, pid, command(cmd.Payload), timeout)
+	} else {
+		chunkID := forwardChunkID.Add(1)
+		for off := 0; off < len(cmd.Payload) && err == nil && result.GetErr() == ""; off += chunkSize {
+			result, err = forwardRequest(c, pid, &clusterpb.ForwardChunk{
+				Version: clusterpb.Version,
+				Id:      chunkID,
+				Command: command(cmd.Payload[off:min(off+chunkSize, len(cmd.Payload))]),
+				Total:   int64(len(cmd.Payload)),
+				Offset:  int64(off),
+			}, timeout)
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("forward to %s: %w", id, err)
+	}
+	if err = forwardResultErr(result); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if cmd.Cmd != storage.Get && cmd.Cmd != storage.Scan {
+		return nil
+	}
+
+	value, total := result.GetValue(), int64(len(result.GetValue()))
+	if result.GetTotal() > 0 {
+		total = result.GetTotal()
+	}
+	if sw, ok := cmd.W.(storage.Sizer); ok {
+		sw.SetSize(int(total))
+	}
+	for written := int64(0); ; {
+		if _, err = cmd.W.Write(value); err != nil {
+			return err
+		}
+		if written += int64(len(value)); written >= total {
+			return nil
+		}
+		part, err := forwardRequest(c, pid, &clusterpb.ForwardRead{
+			Version: clusterpb.Version,
+			Id:      result.GetId(),
+			Offset:  written,
+		}, timeout)
+		if err == nil {
+			err = forwardResultErr(part)
+		}
+		if err == nil && len(part.GetValue()) == 0 {
+			err = errors.New("empty part")
+		}
+		if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("forward to %s: read at %d of %d: %w", id, written, total, err)
+		}
+		value = part.GetValue()
+	}
+}
+
+// forwardRequest sends msg to pid and returns the ForwardResult it is
+// answered with.
+func forwardRequest(c *cluster.Cluster, pid *actor.PID, msg any, timeout time.Duration) (*clusterpb.ForwardResult, error) {
+	res, err := c.Engine().Request(pid, msg, timeout).Result()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnreachable, err)
+	}
+	result, ok := res.(*clusterpb.ForwardResult)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T", res)
+	}
+
+	return result, nil
+}
+
+// partialForward is a forwarded command being reassembled from its parts.
+type partialForward struct {
+	cmd     *clusterpb.ForwardCommand
+	total   int64
+	updated time.Time
+}
+
+// reassembleForward adds the part msg to the forwarded command it belongs
+// to and returns the command once complete. Parts out of order or of a
+// command that is too large drop the command.
+func (s *Server) reassembleForward(addr string, msg *clusterpb.ForwardChunk) (*clusterpb.ForwardCommand, bool, error) {
+	now := time.Now()
+	for key, p := range s.forwards {
+		if now.Sub(p.updated) > chunkTimeout {
+			delete(s.forwards, key)
+		}
+	}
+
+	key := chunkKey{addr: addr, id: msg.GetId()}
+	part := msg.GetCommand().GetPayload()
+	p, ok := s.forwards[key]
+	if !ok {
+		if msg.GetTotal() <= 0 || msg.GetTotal() > s.chunkLimit() {
+			return nil, false, fmt.Errorf("%w: forwarded command of %d bytes", storage.ErrValueTooLarge, msg.GetTotal())
+		}
+		p = &partialForward{
+			cmd:   msg.GetCommand(),
+			total: msg.GetTotal(),
+		}
+		p.cmd.Payload = make([]byte, 0, msg.GetTotal())
+	}
+	if msg.GetOffset() != int64(len(p.cmd.Payload)) || msg.GetTotal() != p.total ||
+		int64(len(p.cmd.Payload)+len(part)) > p.total {
+		delete(s.forwards, key)
+		return nil, false, fmt.Errorf("forwarded part at %d out of order, %d of %d bytes received",
+			msg.GetOffset(), len(p.cmd.Payload), p.total)
+	}
+	p.cmd.Payload = append(p.cmd.Payload, part...)
+	p.updated = now
+	if int64(len(p.cmd.Payload)) < p.total {
+		s.forwards[key] = p
+		return nil, false, nil
+	}
+	delete(s.forwards, key)
+
+	return p.cmd, true, nil
+}
+
+// forwardOutputs keeps the outputs of forwarded reads too large for one
+// message until the sender read them.
+type forwardOutputs struct {
+	mu      sync.Mutex
+	next    uint64
+	outputs map[uint64]*forwardOutput
+}
+
+type forwardOutput struct {
+	value   []byte
+	chunk   int
+	updated time.Time
+}
+
+func newForwardOutputs() *forwardOutputs {
+	return &forwardOutputs{outputs: make(map[uint64]*forwardOutput)}
+}
+
+// result returns the result of a forwarded command for a sender reading
+// outputs in parts of chunk bytes, 0 for whole.
+func (o *forwardOutputs) result(value []byte, chunk int, err error) *clusterpb.ForwardResult {
+	if err != nil || chunk <= 0 || len(value) <= chunk {
+		return newForwardResult(value, err)
+	}
+
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id, out := range o.outputs {
+		if now.Sub(out.updated) > chunkTimeout {
+			delete(o.outputs, id)
+		}
+	}
+	o.next++
+	o.outputs[o.next] = &forwardOutput{value: value, chunk: chunk, updated: now}
+	res := newForwardResult(value[:chunk], nil)
+	res.Id, res.Total = o.next, int64(len(value))
+
+	return res
+}
+
+// read answers msg with the part of the output it asks for, the output is
+// dropped once its last part is read.
+func (o *forwardOutputs) read(msg *clusterpb.ForwardRead) *clusterpb.ForwardResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out, ok := o.outputs[msg.GetId()]
+	if !ok || msg.GetOffset() < 0 || msg.GetOffset() >= int64(len(out.value)) {
+		return newForwardResult(nil, fmt.Errorf("no forwarded output %d at %d", msg.GetId(), msg.GetOffset()))
+	}
+	end := min(int(msg.GetOffset())+out.chunk, len(out.value))
+	if end == len(out.value) {
+		delete(o.outputs, msg.GetId())
+	}
+	out.updated = time.Now()
+
+	return newForwardResult(out.value[msg.GetOffset():end], nil)
+}
+
+// applyForward applies a command forwarded by a follower to writes, which
+// must not forward it again, and returns the output of reads.
+func applyForward(ctx context.Context, writes storage.IStorage, msg *clusterpb.ForwardCommand) ([]byte, error) {
+	if writes == nil {
+		return nil, errors.New("forwarding is disabled on this node")
+	}
+	ctx, span := tracer.Start(tracing.Extract(ctx, msg.GetTrace()), "forwarded",
+		trace.WithSpanKind(trace.SpanKindServer),
+	)
+	defer span.End()
+
+	var out bytes.Buffer
+	cmd := storage.Command{
+		Cmd:         storage.Cmd(msg.GetCmd()),
+		Namespace:   msg.GetNamespace(),
+		Payload:     msg.GetPayload(),
+		W:           &out,
+		Consistency: storage.Consistency(msg.GetConsistency()),
+		MaxLag:      msg.GetMaxLag().AsDuration(),
+		Modified:    msg.GetModified(),
+	}
+	var err error
+	switch cmd.Cmd {
+	case storage.Get:
+		err = writes.Get(ctx, cmd)
+	case storage.Scan:
+		err = writes.Scan(ctx, cmd)
+	case storage.Set:
+		err = writes.Set(ctx, cmd)
+	case storage.Del:
+		err = writes.Del(ctx, cmd)
+	case storage.Rename:
+		err = writes.Rename(ctx, cmd)
+	case storage.Flush:
+		err = writes.Flush(ctx, cmd)
+	default:
+		err = fmt.Errorf("cannot forward %s", cmd.Cmd)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// redirectToLeader answers writes on a follower with a redirect to the same
+// path on the leader, whose URL is asked from the leader's Server.
+func redirectToLeader(node *raftnode.Node, clusterActor *cluster.Cluster, timeout time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if node.State() == raft.Leader {
+				h.ServeHTTP(rw, r)
+				return
+			}
+			url, err := leaderURL(node, clusterActor, timeout)
+			if err != nil {
+				rw.Header().Set("Retry-After", "1")
+				http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			http.Redirect(rw, r, strings.TrimSuffix(url, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		})
+	}
+}
+
+func leaderURL(node *raftnode.Node, clusterActor *cluster.Cluster, timeout time.Duration) (string, error) {
+	_, id := node.LeaderWithID()
+	if id == "" {
+		return "", fmt.Errorf("%w: no leader elected", storage.ErrNotLeader)
+	}
+	for _, m := range clusterActor.Members() {
+		if m.ID != string(id) {
+			continue
+		}
+		res, err := clusterActor.Engine().Request(serverPID(m.Host, m.ID), &clusterpb.StatusRequest{Version: clusterpb.Version}, timeout).Result()
+		if err != nil {
+			return "", fmt.Errorf("leader %s status: %w", id, err)
+		}
+		status, ok := res.(*clusterpb.Status)
+		if !ok || status.GetUrl() == "" {
+			return "", fmt.Errorf("leader %s has no URL", id)
+		}
+		return status.GetUrl(), nil
+	}
+
+	return "", fmt.Errorf("leader %s is not a cluster member", id)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+)
+
+func forwardChunk(id uint64, payload string, offset, total int64) *clusterpb.ForwardChunk {
+	return &clusterpb.ForwardChunk{
+		Id:      id,
+		Command: &clusterpb.ForwardCommand{Cmd: 2, Namespace: "ns", Payload: []byte(payload)},
+		Offset:  offset,
+		Total:   total,
+	}
+}
+
+func TestReassembleForward(t *testing.T) {
+	s := newTestServer(4, 0)
+	if _, done, err := s.reassembleForward("a", forwardChunk(1, "abcd", 0, 6)); done || err != nil {
+		t.Fatalf("first part: done %v, %v", done, err)
+	}
+	cmd, done, err := s.reassembleForward("a", forwardChunk(1, "ef", 4, 6))
+	if !done || err != nil || string(cmd.GetPayload()) != "abcdef" || cmd.GetNamespace() != "ns" {
+		t.Fatalf("reassembled %v, done %v, %v", cmd, done, err)
+	}
+
+	// a missing part drops the command
+	s.reassembleForward("a", forwardChunk(2, "abcd", 0, 12))
+	if _, _, err = s.reassembleForward("a", forwardChunk(2, "ijkl", 8, 12)); err == nil || len(s.forwards) != 0 {
+		t.Fatalf("part out of order kept: %v, %d partial", err, len(s.forwards))
+	}
+	if _, _, err = s.reassembleForward("a", forwardChunk(3, "abcd", 0, 4*maxChunks+1)); err == nil {
+		t.Fatal("command above the chunk limit accepted")
+	}
+}
+
+func TestForwardOutputs(t *testing.T) {
+	o := newForwardOutputs()
+	if res := o.result([]byte("small"), 8, nil); string(res.GetValue()) != "small" || res.GetTotal() != 0 {
+		t.Fatalf("small output %v", res)
+	}
+	if res := o.result([]byte("whole value"), 0, nil); string(res.GetValue()) != "whole value" {
+		t.Fatalf("output for a sender reading it whole %v", res)
+	}
+
+	res := o.result([]byte("0123456789"), 4, nil)
+	got := string(res.GetValue())
+	for int64(len(got)) < res.GetTotal() {
+		part := o.read(&clusterpb.ForwardRead{Id: res.GetId(), Offset: int64(len(got))})
+		if err := forwardResultErr(part); err != nil {
+			t.Fatal(err)
+		}
+		got += string(part.GetValue())
+	}
+	if got != "0123456789" {
+		t.Fatalf("read %q", got)
+	}
+	if len(o.outputs) != 0 {
+		t.Fatal("output kept after its last part was read")
+	}
+	if err := forwardResultErr(o.read(&clusterpb.ForwardRead{Id: res.GetId()})); err == nil {
+		t.Fatal("read a dropped output")
+	}
+}
+
+func TestHTTPErrorUnreachable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	httpError(rec, fmt.Errorf("forward to b: %w: %w", errUnreachable, errors.New("timeout")))
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "unreachable") {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -5,14 +5,58 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dmitrorezn/dcache/auth"
+	"github.com/dmitrorezn/dcache/logging"
 	"github.com/dmitrorezn/dcache/storage"
 )
 
 type Cmd struct {
-	Cmd     int    `json:"cmd"`
-	Payload string `json:"payload"`
+	Cmd       int    `json:"cmd"`
+	Namespace string `json:"namespace"`
+	Payload   string `json:"payload"`
+	// Consistency and MaxLag of reads, see storage.ParseConsistency. The
+	// X-Consistency and X-Max-Lag headers are used if they are empty.
+	Consistency string `json:"consistency,omitempty"`
+	MaxLag      string `json:"maxLag,omitempty"`
+}
+
+const (
+	namespaceHeader   = "X-Namespace"
+	consistencyHeader = "X-Consistency"
+	maxLagHeader      = "X-Max-Lag"
+)
+
+func namespace(r *http.Request) string {
+	return r.Header.Get(namespaceHeader)
+}
+
+// consistency parses the consistency of a read, level and maxLag default to
+// the request headers.
+func consistency(r *http.Request, level, maxLag string) (storage.Consistency, time.Duration, error) {
+	if level == "" {
+		level = r.Header.Get(consistencyHeader)
+	}
+	if maxLag == "" {
+		maxLag = r.Header.Get(maxLagHeader)
+	}
+	c, err := storage.ParseConsistency(level)
+	if err != nil || maxLag == "" {
+		return c, 0, err
+	}
+	lag, err := time.ParseDuration(maxLag)
+	if err != nil || lag <= 0 {
+		return c, 0, fmt.Errorf("invalid max lag %q", maxLag)
+	}
+
+	return c, lag, nil
 }
 
 func ParseCmd(rc io.ReadCloser) (cmd Cmd, err error) {
@@ -22,22 +66,181 @@ func ParseCmd(rc io.ReadCloser) (cmd Cmd, err error) {
 	)
 }
 
+// decodeCmd parses the request body in its own span, so slow decoding of
+// large bodies shows up in traces.
+func decodeCmd(r *http.Request) (Cmd, error) {
+	_, span := tracer.Start(r.Context(), "ParseCmd", trace.WithAttributes(
+		attribute.Int64("http.request.body.size", r.ContentLength),
+	))
+	defer span.End()
+
+	cmd, err := ParseCmd(r.Body)
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	return cmd, err
+}
+
+func httpError(rw http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr), errors.Is(err, storage.ErrValueTooLarge):
+		http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, auth.ErrUnauthorized):
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, auth.ErrForbidden):
+		http.Error(rw, err.Error(), http.StatusForbidden)
+	case errors.Is(err, storage.ErrOverloaded):
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		http.Error(rw, err.Error(), http.StatusInsufficientStorage)
+	case errors.Is(err, errUnreachable):
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, storage.ErrNotLeader):
+		http.Error(rw, err.Error(), http.StatusMisdirectedRequest)
+	case errors.Is(err, storage.ErrStaleRead), errors.Is(err, storage.ErrReplicationQueueFull), errors.Is(err, storage.ErrReplicationClosed):
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// clientKey identifies the client for rate limiting: the authenticated
+// user, or the remote IP for anonymous requests.
+func clientKey(r *http.Request) string {
+	if u, ok := auth.UserFrom(r.Context()); ok {
+		return "user:" + u.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+func limitBody(limit func() int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := limit()
+		if r.ContentLength > n {
+			http.Error(rw, (&http.MaxBytesError{Limit: n}).Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(rw, r.Body, n)
+
+		h.ServeHTTP(rw, r)
+	})
+}
+
+type valueWriter struct {
+	http.ResponseWriter
+}
+
+func (w valueWriter) SetSize(n int) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+}
+
+func (w valueWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func handleGetValue(s storage.IStorage) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		level, maxLag, err := consistency(r, "", "")
+		if err != nil {
+			httpError(rw, err)
+			return
+		}
+		if err = s.Get(r.Context(), storage.Command{
+			Cmd:         storage.Get,
+			Namespace:   namespace(r),
+			Payload:     storage.AppendKey(nil, r.PathValue("key")),
+			W:           valueWriter{rw},
+			Consistency: level,
+			MaxLag:      maxLag,
+		}); err != nil {
+			if errors.Is(err, storage.ErrNIL) {
+				http.Error(rw, err.Error(), http.StatusNotFound)
+				return
+			}
+			httpError(rw, err)
+		}
+	}
+}
+
+func handleSetValue(s storage.IStorage) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.ContentLength < 0 {
+			http.Error(rw, "Content-Length required", http.StatusLengthRequired)
+			return
+		}
+		payload, value := storage.NewPayload(r.PathValue("key"), int(r.ContentLength))
+		if _, err := io.ReadFull(r.Body, value); err != nil {
+			httpError(rw, err)
+			return
+		}
+
+		if err := s.Set(r.Context(), storage.Command{
+			Cmd:       storage.Set,
+			Namespace: namespace(r),
+			Payload:   payload,
+			W:         rw,
+		}); err != nil {
+			httpError(rw, err)
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleDelValue(s storage.IStorage) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if err := s.Del(r.Context(), storage.Command{
+			Cmd:       storage.Del,
+			Namespace: namespace(r),
+			Payload:   storage.AppendKey(nil, r.PathValue("key")),
+			W:         rw,
+		}); err != nil {
+			httpError(rw, err)
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
 func handleGet(s storage.IStorage) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		cmd, err := ParseCmd(r.Body)
+		cmd, err := decodeCmd(r)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 
 			return
 		}
 
-		fmt.Println("cmd", cmd)
+		level, maxLag, err := consistency(r, cmd.Consistency, cmd.MaxLag)
+		if err != nil {
+			httpError(rw, err)
+			return
+		}
 		if err = s.Get(r.Context(), storage.Command{
-			Cmd:     storage.Get,
-			Payload: []byte(cmd.Payload),
-			W:       rw,
+			Cmd:         storage.Get,
+			Namespace:   cmd.Namespace,
+			Payload:     []byte(cmd.Payload),
+			W:           rw,
+			Consistency: level,
+			MaxLag:      maxLag,
 		}); err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 
 			return
 		}
@@ -47,18 +250,19 @@ func handleGet(s storage.IStorage) http.HandlerFunc {
 }
 func handleSet(s storage.IStorage) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		cmd, err := ParseCmd(r.Body)
+		cmd, err := decodeCmd(r)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 			return
 		}
 
 		if err = s.Set(r.Context(), storage.Command{
-			Cmd:     storage.Set,
-			Payload: []byte(cmd.Payload),
-			W:       rw,
+			Cmd:       storage.Set,
+			Namespace: cmd.Namespace,
+			Payload:   []byte(cmd.Payload),
+			W:         rw,
 		}); err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 			return
 		}
 
@@ -67,17 +271,18 @@ func handleSet(s storage.IStorage) http.HandlerFunc {
 }
 func handleDel(s storage.IStorage) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		cmd, err := ParseCmd(r.Body)
+		cmd, err := decodeCmd(r)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 			return
 		}
 		if err = s.Del(r.Context(), storage.Command{
-			Cmd:     storage.Del,
-			Payload: []byte(cmd.Payload),
-			W:       rw,
+			Cmd:       storage.Del,
+			Namespace: cmd.Namespace,
+			Payload:   []byte(cmd.Payload),
+			W:         rw,
 		}); err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 			return
 		}
 
@@ -87,20 +292,86 @@ func handleDel(s storage.IStorage) http.HandlerFunc {
 
 func handleRename(s storage.IStorage) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
-		cmd, err := ParseCmd(r.Body)
+		cmd, err := decodeCmd(r)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 			return
 		}
 		if err = s.Rename(r.Context(), storage.Command{
-			Cmd:     storage.Rename,
-			Payload: []byte(cmd.Payload),
-			W:       rw,
+			Cmd:       storage.Rename,
+			Namespace: cmd.Namespace,
+			Payload:   []byte(cmd.Payload),
+			W:         rw,
 		}); err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
+			httpError(rw, err)
 			return
 		}
 
 		rw.WriteHeader(http.StatusOK)
 	}
 }
+
+func handleScan(s storage.IStorage) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		cmd, err := decodeCmd(r)
+		if err != nil {
+			httpError(rw, err)
+			return
+		}
+		level, maxLag, err := consistency(r, cmd.Consistency, cmd.MaxLag)
+		if err != nil {
+			httpError(rw, err)
+			return
+		}
+		if err = s.Scan(r.Context(), storage.Command{
+			Cmd:         storage.Scan,
+			Namespace:   cmd.Namespace,
+			Payload:     []byte(cmd.Payload),
+			W:           rw,
+			Consistency: level,
+			MaxLag:      maxLag,
+		}); err != nil {
+			if errors.Is(err, storage.ErrNIL) {
+				http.Error(rw, err.Error(), http.StatusNotFound)
+				return
+			}
+			httpError(rw, err)
+			return
+		}
+	}
+}
+
+func handleFlush(s storage.IStorage) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		cmd, err := decodeCmd(r)
+		if err != nil {
+			httpError(rw, err)
+			return
+		}
+		if err = s.Flush(r.Context(), storage.Command{
+			Cmd:       storage.Flush,
+			Namespace: cmd.Namespace,
+			W:         rw,
+		}); err != nil {
+			httpError(rw, err)
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleStats(s *storage.Storage) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		stats, err := s.Stats(r.Context())
+		if err != nil {
+			httpError(rw, err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(rw).Encode(stats); err != nil {
+			logging.FromContext(r.Context()).Warn("encode stats", "err", err)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/crypt"
+)
+
+// hintsExt is the extension of the hint files, named after the peer id.
+const hintsExt = ".hints"
+
+var errHintsClosed = errors.New("hints closed")
+
+type HintsCfg struct {
+	Dir string
+	// MaxBytes bounds the hints kept per peer, newer ones are dropped
+	// beyond it.
+	MaxBytes int64
+	// MaxAge is how long hints are kept, a peer disconnected for longer
+	// gets no more.
+	MaxAge time.Duration
+	// Keys, if set, encrypts the hints.
+	Keys   crypt.KeyProvider
+	Logger *slog.Logger
+}
+
+// Hints keeps the commands that could not be sent to a peer, because it
+// was disconnected or too far behind, in a file per peer and hands them back
+// in order once the peer takes them. Files are written without syncing,
+// hints survive a crash of the node but not necessarily of the machine,
+// except the files replaced by prepend, which are synced.
+//
+// Hints is safe for concurrent use, Replication reads and writes it without
+// holding its own lock.
+type Hints struct {
+	cfg HintsCfg
+
+	mu     sync.Mutex
+	logs   map[string]*hintLog
+	closed bool
+
+	bytes     atomic.Int64
+	stored    atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// hintLog is the file of a peer, the hints before read were handed back.
+type hintLog struct {
+	f    *os.File
+	size int64
+	read int64
+	// full is set once a hint was dropped, until the file is emptied.
+	full bool
+}
+
+// NewHints opens the hints in cfg.Dir, dropping the files older than
+// cfg.MaxAge.
+func NewHints(cfg HintsCfg) (*Hints, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hints{
+		cfg:  cfg,
+		logs: make(map[string]*hintLog),
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(cfg.Dir, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case filepath.Ext(e.Name()) != hintsExt:
+			// left by an interrupted prepend
+			err = os.Remove(path)
+		case time.Since(info.ModTime()) > cfg.MaxAge:
+			cfg.Logger.Info("dropping expired hints", "file", path, "bytes", info.Size())
+			err = os.Remove(path)
+		default:
+			h.bytes.Add(info.Size())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+func (h *Hints) path(peer string) string {
+	return filepath.Join(h.cfg.Dir, url.PathEscape(peer)+hintsExt)
+}
+
+// open returns the log of peer, creating its file if create is set,
+// otherwise nil if there is none. h.mu must be held.
+func (h *Hints) open(peer string, create bool) (*hintLog, error) {
+	if h.closed {
+		return nil, errHintsClosed
+	}
+	if l, ok := h.logs[peer]; ok {
+		return l, nil
+	}
+
+	flag := os.O_RDWR | os.O_APPEND
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(h.path(peer), flag, 0o600)
+	if errors.Is(err, fs.ErrNotExist) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Join(err, f.Close())
+	}
+	l := &hintLog{f: f, size: info.Size()}
+	h.logs[peer] = l
+
+	return l, nil
+}
+
+// pending reports whether peer has hints to deliver.
+func (h *Hints) pending(peer string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, err := h.open(peer, false)
+	if err != nil {
+		h.cfg.Logger.Error("opening hints", "peer", peer, "err", err)
+		return false
+	}
+
+	return l != nil && l.read < l.size
+}
+
+// add appends cmds to the hints of peer and returns how many were dropped.
+func (h *Hints) add(peer string, cmds ...queued) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, err := h.open(peer, true)
+	if err != nil {
+		return len(cmds), err
+	}
+	buf, n, err := h.encode(cmds, h.cfg.MaxBytes-l.size)
+	if err != nil {
+		return len(cmds), err
+	}
+	if n < len(cmds) {
+		if !l.full {
+			h.cfg.Logger.Warn("hints full, dropping commands", "peer", peer, "bytes", l.size)
+		}
+		l.full = true
+		h.dropped.Add(uint64(len(cmds) - n))
+	}
+	if err = h.write(l, buf); err != nil {
+		return len(cmds), err
+	}
+	h.stored.Add(uint64(n))
+
+	return len(cmds) - n, nil
+}
+
+// prepend puts cmds before the hints of peer, they are the commands in
+// flight when the peer disconnected. Nothing is dropped.
+func (h *Hints) prepend(peer string, cmds []queued) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, err := h.open(peer, false)
+	if err != nil {
+		return err
+	}
+	buf, _, err := h.encode(cmds, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if l == nil || l.read == l.size {
+		if l, err = h.open(peer, true); err != nil {
+			return err
+		}
+		if err = h.write(l, buf); err != nil {
+			return err
+		}
+		h.stored.Add(uint64(len(cmds)))
+		return nil
+	}
+
+	rest := make([]byte, l.size-l.read)
+	if _, err = l.f.ReadAt(rest, l.read); err != nil {
+		return err
+	}
+	// replace the file at once, a crash must not lose either part: the
+	// new file is synced before the rename and the directory after it
+	path := h.path(peer)
+	tmp, err := os.CreateTemp(h.cfg.Dir, filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(buf, rest...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err = errors.Join(err, tmp.Close()); err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return errors.Join(err, os.Remove(tmp.Name()))
+	}
+	if err = syncDir(h.cfg.Dir); err != nil {
+		return err
+	}
+
+	h.bytes.Add(int64(len(buf)) - l.read)
+	h.stored.Add(uint64(len(cmds)))
+	delete(h.logs, peer)
+	_, err = h.open(peer, false)
+
+	return errors.Join(err, l.f.Close())
+}
+
+// syncDir syncs the entries of the directory dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// write appends the records in buf to l.
+func (h *Hints) write(l *hintLog, buf []byte) error {
+	if _, err := l.f.Write(buf); err != nil {
+		// drop a partly written record
+		return errors.Join(err, l.f.Truncate(l.size))
+	}
+	l.size += int64(len(buf))
+	h.bytes.Add(int64(len(buf)))
+
+	return nil
+}
+
+// next returns up to n hints of peer in order, dropping the ones older than
+// MaxAge, and reports whether none are left.
+func (h *Hints) next(peer string, n int, now time.Time) ([]queued, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l, err := h.open(peer, false)
+	if err != nil || l == nil {
+		return nil, true, err
+	}
+
+	var (
+		r       = bufio.NewReader(io.NewSectionReader(l.f, l.read, l.size-l.read))
+		out     []queued
+		expired int
+		varint  [binary.MaxVarintLen64]byte
+	)
+	for len(out) < n && l.read < l.size {
+		size, err := binary.ReadUvarint(r)
+		if err == nil && size > uint64(l.size-l.read) {
+			err = fmt.Errorf("hint of %d bytes", size)
+		}
+		var data []byte
+		if err == nil {
+			data = make([]byte, size)
+			_, err = io.ReadFull(r, data)
+		}
+		if err != nil {
+			h.cfg.Logger.Error("hints corrupted, dropping the rest", "peer", peer, "offset", l.read, "err", err)
+			l.read = l.size
+			break
+		}
+		l.read += int64(binary.PutUvarint(varint[:], size)) + int64(size)
+
+		q, err := h.decode(data)
+		switch {
+		case err != nil:
+			h.cfg.Logger.Error("dropping unreadable hint", "peer", peer, "err", err)
+			h.dropped.Add(1)
+		case now.Sub(q.at) > h.cfg.MaxAge:
+			expired++
+		default:
+			out = append(out, q)
+		}
+	}
+	if expired > 0 {
+		h.dropped.Add(uint64(expired))
+		h.cfg.Logger.Warn("dropping expired hints", "peer", peer, "hints", expired)
+	}
+	h.delivered.Add(uint64(len(out)))
+	if l.read < l.size {
+		return out, false, nil
+	}
+
+	// every hint was handed back
+	h.bytes.Add(-l.size)
+	delete(h.logs, peer)
+
+	return out, true, errors.Join(l.f.Close(), os.Remove(h.path(peer)))
+}
+
+// encode returns the records of the first cmds that fit in limit bytes and
+// how many they are.
+func (h *Hints) encode(cmds []queued, limit int64) ([]byte, int, error) {
+	var buf []byte
+	for i, q := range cmds {
+		data, err := proto.Marshal(&clusterpb.Hint{
+			Version: clusterpb.Version,
+			At:      q.at.UnixNano(),
+			Command: q.cmd,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.cfg.Keys != nil {
+			if data, err = crypt.Seal(h.cfg.Keys, data); err != nil {
+				return nil, 0, err
+			}
+		}
+		rec := append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+		if int64(len(buf)+len(rec)) > limit {
+			return buf, i, nil
+		}
+		buf = append(buf, rec...)
+	}
+
+	return buf, len(cmds), nil
+}
+
+func (h *Hints) decode(data []byte) (queued, error) {
+	var err error
+	if h.cfg.Keys != nil {
+		if data, err = crypt.Open(h.cfg.Keys, data); err != nil {
+			return queued{}, err
+		}
+	}
+	var hint clusterpb.Hint
+	if err = proto.Unmarshal(data, &hint); err != nil {
+		return queued{}, err
+	}
+	if hint.GetCommand() == nil {
+		return queued{}, errors.New("hint without a command")
+	}
+
+	return queued{cmd: hint.GetCommand(), at: time.Unix(0, hint.GetAt())}, nil
+}
+
+// Close syncs and closes the files, the hints are used no more.
+func (h *Hints) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	var err error
+	for peer, l := range h.logs {
+		err = errors.Join(err, l.f.Sync(), l.f.Close())
+		delete(h.logs, peer)
+	}
+
+	return err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/crypt"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+const hintPeer = "peer"
+
+func newTestHints(t *testing.T, cfg HintsCfg) *Hints {
+	t.Helper()
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = 1 << 20
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = time.Hour
+	}
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	h, err := NewHints(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+
+	return h
+}
+
+func hint(i int, at time.Time) queued {
+	return queued{
+		cmd: &clusterpb.Command{Cmd: int32(storage.Set), Payload: []byte(fmt.Sprintf("%03d", i)), Modified: at.UnixNano()},
+		at:  at,
+	}
+}
+
+func addHints(t *testing.T, h *Hints, from, to int, at time.Time) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if dropped, err := h.add(hintPeer, hint(i, at)); err != nil || dropped != 0 {
+			t.Fatalf("add %d: %d dropped, %v", i, dropped, err)
+		}
+	}
+}
+
+// drain returns the payloads of the hints of the peer up to n, 0 for all.
+func drain(t *testing.T, h *Hints, n int) ([]string, bool) {
+	t.Helper()
+	if n == 0 {
+		n = math.MaxInt
+	}
+	qs, done, err := h.next(hintPeer, n, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]string, len(qs))
+	for i, q := range qs {
+		out[i] = string(q.cmd.GetPayload())
+	}
+
+	return out, done
+}
+
+func payloads(from, to int) []string {
+	var out []string
+	for i := from; i < to; i++ {
+		out = append(out, fmt.Sprintf("%03d", i))
+	}
+
+	return out
+}
+
+func TestHintsOrder(t *testing.T) {
+	h := newTestHints(t, HintsCfg{})
+	now := time.Now()
+	addHints(t, h, 0, 10, now)
+	if !h.pending(hintPeer) {
+		t.Fatal("no hints pending")
+	}
+
+	got, done := drain(t, h, 4)
+	if done || !slices.Equal(got, payloads(0, 4)) {
+		t.Fatalf("first hints %v, done %v", got, done)
+	}
+	got, done = drain(t, h, 0)
+	if !done || !slices.Equal(got, payloads(4, 10)) {
+		t.Fatalf("rest %v, done %v", got, done)
+	}
+	if h.pending(hintPeer) || h.bytes.Load() != 0 {
+		t.Fatalf("hints left: %d bytes", h.bytes.Load())
+	}
+	if _, err := os.Stat(h.path(hintPeer)); !os.IsNotExist(err) {
+		t.Fatalf("delivered hints file kept: %v", err)
+	}
+}
+
+func TestHintsMaxBytes(t *testing.T) {
+	one, _, err := (&Hints{}).encode([]queued{hint(0, time.Now())}, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHints(t, HintsCfg{MaxBytes: int64(3 * len(one))})
+
+	var cmds []queued
+	for i := 0; i < 5; i++ {
+		cmds = append(cmds, hint(i, time.Now()))
+	}
+	dropped, err := h.add(hintPeer, cmds...)
+	if err != nil || dropped != 2 {
+		t.Fatalf("%d dropped, %v, want the 2 newest", dropped, err)
+	}
+	if dropped, _ = h.add(hintPeer, hint(5, time.Now())); dropped != 1 {
+		t.Fatal("hint added beyond MaxBytes")
+	}
+	if got, _ := drain(t, h, 0); !slices.Equal(got, payloads(0, 3)) {
+		t.Fatalf("kept %v, want the oldest", got)
+	}
+	if h.dropped.Load() != 3 {
+		t.Fatalf("%d dropped", h.dropped.Load())
+	}
+
+	// the room of the delivered hints is free again
+	addHints(t, h, 6, 9, time.Now())
+}
+
+func TestHintsMaxAge(t *testing.T) {
+	h := newTestHints(t, HintsCfg{MaxAge: time.Hour})
+	addHints(t, h, 0, 2, time.Now().Add(-2*time.Hour))
+	addHints(t, h, 2, 4, time.Now())
+
+	got, done := drain(t, h, 0)
+	if !done || !slices.Equal(got, payloads(2, 4)) {
+		t.Fatalf("got %v, want the recent hints", got)
+	}
+	if h.dropped.Load() != 2 {
+		t.Fatalf("%d dropped, want 2", h.dropped.Load())
+	}
+}
+
+func TestHintsPrepend(t *testing.T) {
+	h := newTestHints(t, HintsCfg{})
+	now := time.Now()
+	addHints(t, h, 2, 6, now)
+	if got, _ := drain(t, h, 2); !slices.Equal(got, payloads(2, 4)) {
+		t.Fatalf("first hints %v", got)
+	}
+
+	// the commands in flight go before the unread ones
+	if err := h.prepend(hintPeer, []queued{hint(0, now), hint(1, now)}); err != nil {
+		t.Fatal(err)
+	}
+	got, done := drain(t, h, 0)
+	if want := append(payloads(0, 2), payloads(4, 6)...); !done || !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// without hints left they start the file
+	if err := h.prepend(hintPeer, []queued{hint(0, now)}); err != nil {
+		t.Fatal(err)
+	}
+	addHints(t, h, 1, 2, now)
+	if got, _ = drain(t, h, 0); !slices.Equal(got, payloads(0, 2)) {
+		t.Fatalf("got %v", got)
+	}
+	entries, err := os.ReadDir(h.cfg.Dir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("files left %v, %v", entries, err)
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHintsCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHints(t, HintsCfg{Dir: dir})
+	addHints(t, h, 0, 1, time.Now())
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a record that is not a hint is skipped
+	appendFile(t, h.path(hintPeer), append(binary.AppendUvarint(nil, 3), "xyz"...))
+
+	h = newTestHints(t, HintsCfg{Dir: dir})
+	addHints(t, h, 1, 2, time.Now())
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated record drops the rest of the file
+	appendFile(t, h.path(hintPeer), append(binary.AppendUvarint(nil, 100), "abc"...))
+
+	h = newTestHints(t, HintsCfg{Dir: dir})
+	got, done := drain(t, h, 0)
+	if !done || !slices.Equal(got, payloads(0, 2)) {
+		t.Fatalf("got %v, done %v", got, done)
+	}
+	if h.dropped.Load() != 1 {
+		t.Fatalf("%d dropped, want the record that is not a hint", h.dropped.Load())
+	}
+}
+
+func TestHintsRestart(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHints(t, HintsCfg{Dir: dir})
+	now := time.Now()
+	addHints(t, h, 0, 5, now)
+	if got, _ := drain(t, h, 2); !slices.Equal(got, payloads(0, 2)) {
+		t.Fatalf("first hints %v", got)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.add(hintPeer, hint(5, now)); err == nil {
+		t.Fatal("added to closed hints")
+	}
+
+	// what was handed back before is not tracked on disk, it is delivered
+	// again and skipped by the peer by its sequence number
+	h = newTestHints(t, HintsCfg{Dir: dir})
+	if !h.pending(hintPeer) || h.bytes.Load() == 0 {
+		t.Fatal("hints lost on restart")
+	}
+	addHints(t, h, 5, 6, now)
+	if got, _ := drain(t, h, 0); !slices.Equal(got, payloads(0, 6)) {
+		t.Fatalf("got %v after a restart", got)
+	}
+
+	// files older than MaxAge are dropped when opened
+	addHints(t, h, 0, 1, now)
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, hintPeer+hintsExt), old, old); err != nil {
+		t.Fatal(err)
+	}
+	h = newTestHints(t, HintsCfg{Dir: dir, MaxAge: time.Hour})
+	if h.pending(hintPeer) {
+		t.Fatal("expired hints file kept")
+	}
+}
+
+func TestHintsEncrypted(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte("1 "+strings.Repeat("ab", crypt.KeySize)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := crypt.NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHints(t, HintsCfg{Keys: keys})
+	now := time.Now()
+	addHints(t, h, 0, 3, now)
+
+	raw, err := os.ReadFile(h.path(hintPeer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("001")) {
+		t.Fatal("hints keep the commands in the clear")
+	}
+	qs, _, err := h.next(hintPeer, 10, now)
+	if err != nil || len(qs) != 3 {
+		t.Fatalf("%d hints, %v", len(qs), err)
+	}
+	for i, q := range qs {
+		if string(q.cmd.GetPayload()) != fmt.Sprintf("%03d", i) || q.cmd.GetModified() != now.UnixNano() ||
+			!q.at.Equal(time.Unix(0, now.UnixNano())) {
+			t.Fatalf("hint %d: %v at %s", i, q.cmd, q.at)
+		}
+	}
+}
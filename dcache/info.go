@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/anthdm/hollywood/actor"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/logging"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+// Info is served by GET /admin/info.
+type Info struct {
+	Node               string        `json:"node"`
+	Role               string        `json:"role"`
+	Uptime             string        `json:"uptime"`
+	Config             Cfg           `json:"config"`
+	Storage            storage.Stats `json:"storage"`
+	StorageQueue       int           `json:"storageQueue"`
+	StorageQueueCap    int           `json:"storageQueueCap"`
+	ReplicationDropped uint64        `json:"replicationDropped"`
+	Memory             MemoryInfo    `json:"memory"`
+	Cluster            Status        `json:"cluster"`
+}
+
+type MemoryInfo struct {
+	Alloc      uint64 `json:"alloc"`
+	HeapInuse  uint64 `json:"heapInuse"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint32 `json:"numGC"`
+	Goroutines int    `json:"goroutines"`
+}
+
+// Redacted returns a copy of the config safe to expose.
+func (c Cfg) Redacted() Cfg {
+	if c.AuthTokens != "" {
+		c.AuthTokens = "[redacted]"
+	}
+	if c.AuthHMACSecret != "" {
+		c.AuthHMACSecret = "[redacted]"
+	}
+
+	return c
+}
+
+type infoSource struct {
+	cfg     func() Cfg
+	role    func() string
+	store   *storage.Storage
+	actors  *storage.ActorStorage
+	engine  *actor.Engine
+	server  *actor.PID
+	timeout time.Duration
+}
+
+func (src infoSource) collect(ctx context.Context) (Info, error) {
+	res, err := src.engine.Request(src.server, &clusterpb.StatusRequest{Version: clusterpb.Version}, src.timeout).Result()
+	if err != nil {
+		return Info{}, fmt.Errorf("status request: %w", err)
+	}
+	msg, ok := res.(*clusterpb.Status)
+	if !ok {
+		return Info{}, fmt.Errorf("status request: unexpected response %T", res)
+	}
+	status := statusFromProto(msg)
+	stats, err := src.store.Stats(ctx)
+	if err != nil {
+		return Info{}, err
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return Info{
+		Node:               status.ID,
+		Role:               src.role(),
+		Uptime:             time.Since(status.Started).Round(time.Second).String(),
+		Config:             src.cfg().Redacted(),
+		Storage:            stats,
+		StorageQueue:       src.store.QueueDepth(),
+		StorageQueueCap:    src.store.QueueCap(),
+		ReplicationDropped: src.actors.Dropped(),
+		Memory: MemoryInfo{
+			Alloc:      mem.Alloc,
+			HeapInuse:  mem.HeapInuse,
+			Sys:        mem.Sys,
+			NumGC:      mem.NumGC,
+			Goroutines: runtime.NumGoroutine(),
+		},
+		Cluster: status,
+	}, nil
+}
+
+func handleInfo(src infoSource) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		info, err := src.collect(r.Context())
+		if err != nil {
+			logging.FromContext(r.Context()).Error("collect info", "err", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(rw).Encode(info); err != nil {
+			logging.FromContext(r.Context()).Warn("encode info", "err", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+type Cfg struct {
+	// Level is one of debug, info, warn or error.
+	Level string
+	// Format is "json" or "text".
+	Format string
+	// Values disables redaction of Value attributes.
+	Values bool
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("unknown log level %q", s)
+	}
+
+	return l, nil
+}
+
+// New returns a logger writing to w. The level is read from level on every
+// record, so it can be changed while running.
+func New(w io.Writer, cfg Cfg, level *slog.LevelVar) (*slog.Logger, error) {
+	l, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	level.Set(l)
+
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact(cfg.Values),
+	}
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+}
+
+// Value marks stored values in log attributes, e.g.
+//
+//	log.Debug("set", "value", logging.Value(v))
+//
+// They are replaced with their size unless Cfg.Values is set.
+type Value []byte
+
+func redact(show bool) func([]string, slog.Attr) slog.Attr {
+	return func(_ []string, a slog.Attr) slog.Attr {
+		v, ok := a.Value.Any().(Value)
+		if !ok {
+			return a
+		}
+		if show {
+			return slog.String(a.Key, string(v))
+		}
+
+		return slog.String(a.Key, fmt.Sprintf("[redacted %d bytes]", len(v)))
+	}
+}
+
+type ctxKey struct{}
+
+func WithContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the request scoped logger, or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+
+	return slog.Default()
+}
@@ -2,104 +2,687 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/anthdm/hollywood/actor"
 	"github.com/anthdm/hollywood/cluster"
-	"github.com/caarlos0/env"
+	"github.com/anthdm/hollywood/remote"
 
+	"github.com/dmitrorezn/dcache/auth"
+	"github.com/dmitrorezn/dcache/crypt"
+	"github.com/dmitrorezn/dcache/logging"
+	"github.com/dmitrorezn/dcache/metrics"
+	"github.com/dmitrorezn/dcache/raftnode"
 	"github.com/dmitrorezn/dcache/server"
 	"github.com/dmitrorezn/dcache/storage"
+	"github.com/dmitrorezn/dcache/tracing"
 )
 
-type Cfg struct {
-	Port        string `env:"PORT" envDefault:"8080"`
-	LeaderAddr  string `env:"LEADER_ADDR"`
-	ClusterAddr string `env:"CLUSTER_ADDR"`
-	//RaftAddr    string        `env:"RAFT_ADDR"`
-	IsLeader bool          `env:"IS_LEADER"`
-	Timeout  time.Duration `env:"TIMEOUT" envDefault:"15s"`
-}
-
 const (
 	localhost = "127.0.0.1"
 )
 
+var tracer = tracing.Tracer("github.com/dmitrorezn/dcache")
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Kill, os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	var cfg Cfg
-	if err := env.Parse(&cfg); err != nil {
-		log.Fatal("Parse", err)
+	loader := newCfgLoader(os.Args[1:])
+	cfg, err := loader.Load()
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	var logLevel slog.LevelVar
+	logger, err := logging.New(os.Stdout, logging.Cfg{
+		Level:  cfg.LogLevel,
+		Format: cfg.LogFormat,
+		Values: cfg.LogValues,
+	}, &logLevel)
+	if err != nil {
+		fatal("logging.New", err)
+	}
+	logger = logger.With("node", cfg.NodeID)
+	slog.SetDefault(logger)
+
+	logger.Info("starting",
+		"config", cfg.ConfigFile,
+		"port", cfg.Port,
+		"cluster_addr", cfg.ClusterAddr,
+		"data_dir", cfg.DataDir,
+		"tls", cfg.TLSCertFile != "",
+		"auth", cfg.AuthTokens != "" || cfg.AuthHMACSecret != "",
+		"encryption", cfg.EncryptionKeyFile != "",
+	)
+
+	codec, err := storage.ParseCodec(cfg.Compression)
+	if err != nil {
+		fatal("ParseCodec", err)
+	}
+	compression := storage.Compression{
+		Codec:     codec,
+		Threshold: cfg.CompressionThreshold,
+	}
+
+	defaultNamespace, namespaces, err := cfg.namespaceCfgs()
+	if err != nil {
+		fatal("namespaceCfgs", err)
+	}
+
+	storageOpts := []storage.Option{
+		storage.WithMaxValueSize(cfg.MaxValueSize),
+		storage.WithChunkSize(cfg.ChunkSize),
+		storage.WithCompression(compression),
+		storage.WithEnqueueTimeout(cfg.EnqueueTimeout),
+		storage.WithLogger(logger),
+		storage.WithDefaultNamespaceCfg(defaultNamespace),
+	}
+	for name, nsCfg := range namespaces {
+		storageOpts = append(storageOpts, storage.WithNamespace(name, nsCfg))
+	}
+	var (
+		keys     crypt.KeyProvider
+		fileKeys *crypt.FileKeyProvider
+	)
+	if cfg.EncryptionKeyFile != "" {
+		fileKeys, err = crypt.NewFileKeyProvider(cfg.EncryptionKeyFile)
+		if err != nil {
+			fatal("NewFileKeyProvider", err)
+		}
+		if err = crypt.Verify(cfg.DataDir, fileKeys); err != nil {
+			fatal("refusing to start", err)
+		}
+		keys = fileKeys
+		storageOpts = append(storageOpts, storage.WithEncryption(keys))
+	}
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Cfg{
+		Exporter:    cfg.TraceExporter,
+		Endpoint:    cfg.OTLPEndpoint,
+		Insecure:    cfg.OTLPInsecure,
+		NodeID:      cfg.NodeID,
+		SampleRatio: cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		fatal("tracing.Setup", err)
 	}
 
-	fmt.Println("CFG", cfg)
+	tokens, err := auth.ParseTokens(cfg.AuthTokens)
+	if err != nil {
+		fatal("ParseTokens", err)
+	}
+	rules, err := auth.ParseRules(cfg.ACL)
+	if err != nil {
+		fatal("ParseRules", err)
+	}
+	var (
+		authenticator = auth.NewAuthenticator(tokens, []byte(cfg.AuthHMACSecret))
+		acl           = auth.NewACL(rules...)
+	)
+
+	tlsCfg := server.TLSCfg{
+		CertFile:   cfg.TLSCertFile,
+		KeyFile:    cfg.TLSKeyFile,
+		CAFile:     cfg.TLSCAFile,
+		ClientAuth: cfg.TLSClientAuth,
+		Logger:     logger,
+	}
+	var certs *server.CertReloader
+	if tlsCfg.Enabled() {
+		if certs, err = server.NewCertReloader(tlsCfg); err != nil {
+			fatal("NewCertReloader", err)
+		}
+	}
 
 	clusterAddr := cfg.ClusterAddr
 	clusterCfg := cluster.NewConfig().
-		WithID(*nodeID).
+		WithID(cfg.NodeID).
 		WithListenAddr(clusterAddr).
-		WithRegion("eu-west")
+		WithRegion(cfg.Region)
+	if certs != nil {
+		peerTLS, err := certs.PeerConfig()
+		if err != nil {
+			fatal("PeerConfig", err)
+		}
+		engine, err := actor.NewEngine(actor.NewEngineConfig().WithRemote(
+			remote.New(clusterAddr, remote.NewConfig().WithTLS(peerTLS)),
+		))
+		if err != nil {
+			fatal("actor.NewEngine", err)
+		}
+		clusterCfg = clusterCfg.WithEngine(engine)
+	}
 
 	clusterActor, err := cluster.New(clusterCfg)
 	if err != nil {
-		log.Fatal("cluster.New", err)
+		fatal("cluster.New", err)
+	}
+	// raft replicates through its own log
+	var hints *Hints
+	if cfg.ReplicationMode != "raft" && cfg.HintsMaxBytes > 0 {
+		if hints, err = NewHints(HintsCfg{
+			Dir:      filepath.Join(cfg.DataDir, "hints"),
+			MaxBytes: cfg.HintsMaxBytes,
+			MaxAge:   cfg.HintsMaxAge,
+			Keys:     keys,
+			Logger:   logger,
+		}); err != nil {
+			fatal("NewHints", err)
+		}
+	}
+	localStore := storage.New(storageOpts...)
+	var (
+		partitions *Partitions
+		replicas   func(storage.Command) []string
+	)
+	if cfg.ReplicationMode == "partitioned" {
+		partitions = NewPartitions(localStore, clusterActor, PartitionsCfg{
+			VNodes:            cfg.VNodes,
+			ReplicationFactor: cfg.ReplicationFactor,
+			TombstoneTTL:      cfg.TombstoneTTL,
+			Timeout:           cfg.ForwardTimeout,
+			ChunkSize:         cfg.ChunkSize,
+			Logger:            logger,
+		})
+		replicas = partitions.replicas
 	}
 	var (
 		addr                = net.JoinHostPort(localhost, cfg.Port)
 		srv                 = server.NewHTTP(addr)
-		localStore          = storage.New()
 		replicationCommands = make(chan storage.Command, 1024)
-		producer            = NewServer(localStore, clusterActor, replicationCommands)
-		srvPID              = clusterActor.Spawn(producer, "server-"+*nodeID)
-		actorStorage        = storage.NewActorStorage(localStore, replicationCommands, clusterActor.Engine())
+		replication         = NewReplication(replicationCommands, ReplicationCfg{
+			Origin:      cfg.NodeID,
+			Compression: compression,
+			RetryMin:    cfg.ReplicationRetryMin,
+			RetryMax:    cfg.ReplicationRetryMax,
+			MaxUnacked:  cfg.ReplicationMaxUnacked,
+			BatchSize:   cfg.ReplicationBatchSize,
+			BatchBytes:  cfg.ReplicationBatchBytes,
+			Linger:      cfg.ReplicationLinger,
+			Hints:       hints,
+			Replicas:    replicas,
+			Logger:      logger,
+		})
+		actorStorage = storage.NewActorStorage(localStore, replicationCommands, cfg.EnqueueTimeout, logger)
+	)
+
+	wg := errgroup.Group{}
+	wg.Go(func() error {
+		// stopped by CloseAndWait once everything else has shut down
+		localStore.Run(context.WithoutCancel(ctx))
+		return nil
+	})
+
+	// in raft mode writes go through the raft log and localStore is its FSM,
+	// the actors only track cluster membership and forward writes.
+	var (
+		node      *raftnode.Node
+		replicate storage.IStorage = actorStorage
+		forwarded storage.IStorage
+		role      = func() string { return "peer" }
+	)
+	if cfg.ReplicationMode == "raft" {
+		peers, err := raftnode.ReadPeers(cfg.PeersFile)
+		if err != nil {
+			fatal("ReadPeers", err)
+		}
+		var raftTLS *tls.Config
+		if certs != nil {
+			if raftTLS, err = certs.PeerConfig(); err != nil {
+				fatal("PeerConfig", err)
+			}
+		}
+		raftDir := cfg.RaftDir
+		if raftDir == "" {
+			raftDir = filepath.Join(cfg.DataDir, "raft")
+		}
+		node, err = raftnode.New(raftnode.Cfg{
+			ID:             cfg.NodeID,
+			Addr:           cfg.RaftAddr,
+			Dir:            raftDir,
+			Peers:          peers,
+			Timeout:        cfg.Timeout,
+			SnapshotRetain: cfg.RaftSnapshotRetain,
+			Keys:           keys,
+			TLS:            raftTLS,
+			LogOutput:      os.Stdout,
+			LogLevel:       cfg.LogLevel,
+			LogJSON:        cfg.LogFormat == "json",
+		}, localStore)
+		if err != nil {
+			fatal("raftnode.New", err)
+		}
+		logger.Info("raft started", "addr", node.Addr(), "dir", raftDir)
+		replicate = storage.NewReplicator(localStore, node.Raft, cfg.RaftApplyTimeout,
+			storage.WithMaxLag(cfg.ReadMaxLag),
+		)
+		forwarded = replicate
+		role = func() string { return node.State().String() }
+		if cfg.LeaderForward == forwardProxy {
+			replicate = &leaderForwarder{
+				IStorage:  replicate,
+				node:      node,
+				cluster:   clusterActor,
+				timeout:   cfg.ForwardTimeout,
+				chunkSize: cfg.ChunkSize,
+			}
+		}
+	}
+
+	// partitioned nodes apply the requests for their keys and forward the
+	// other ones, forwarded requests are applied as they come
+	if partitions != nil {
+		forwarded = actorStorage
+		replicate = &partitionedStorage{IStorage: actorStorage, p: partitions}
+	}
+
+	advertiseURL := cfg.AdvertiseURL
+	if advertiseURL == "" {
+		advertiseURL = "http://" + addr
+		if certs != nil {
+			advertiseURL = "https://" + addr
+		}
+	}
+	// raft keeps the replicas consistent and installs snapshots on new
+	// nodes, bootstrap and anti-entropy do it for actor replication.
+	// Partitioned nodes hand keys over instead and only repair the keys
+	// they keep with the peer, there are none with a single owner.
+	antiEntropyInterval := cfg.AntiEntropyInterval
+	var shared func(peer, ns, key string) bool
+	if partitions != nil {
+		shared = partitions.shared
+		if cfg.ReplicationFactor <= 1 {
+			antiEntropyInterval = 0
+		}
+	}
+	var (
+		bootstrap   *Bootstrap
+		antiEntropy *AntiEntropy
+	)
+	if node == nil {
+		bootstrap = NewBootstrap(localStore, clusterActor, BootstrapCfg{
+			Enabled:   cfg.Bootstrap && partitions == nil,
+			Wait:      cfg.BootstrapWait,
+			MaxBuffer: cfg.BootstrapBuffer,
+			ChunkSize: cfg.ChunkSize,
+			Timeout:   cfg.Timeout,
+			Logger:    logger,
+		})
+		antiEntropy = NewAntiEntropy(localStore, clusterActor, AntiEntropyCfg{
+			Interval:     antiEntropyInterval,
+			MaxKeys:      cfg.AntiEntropyMaxKeys,
+			Bandwidth:    cfg.AntiEntropyBandwidth,
+			TombstoneTTL: cfg.TombstoneTTL,
+			Ready:        bootstrap.Ready,
+			Shared:       shared,
+			Timeout:      cfg.Timeout,
+			Logger:       logger,
+		})
+	}
+	var (
+		serverCfg = ServerCfg{
+			ChunkSize:    cfg.ChunkSize,
+			MaxValueSize: cfg.MaxValueSize,
+			Logger:       logger,
+			Writes:       forwarded,
+			URL:          advertiseURL,
+			AntiEntropy:  antiEntropy,
+			Bootstrap:    bootstrap,
+			Partitions:   partitions,
+		}
+		producer = NewServer(localStore, clusterActor, replication, serverCfg)
+		srvPID   = clusterActor.Spawn(producer, serverKind, actor.WithID(cfg.NodeID))
 	)
 	clusterActor.Engine().
 		Subscribe(srvPID)
 
-	log.Println("srvPID", srvPID)
+	logger.Debug("server spawned", "pid", srvPID)
 
 	clusterActor.RegisterKind(
 		"worker",
-		NewServer(localStore, clusterActor, replicationCommands),
+		producer,
 		cluster.NewKindConfig(),
 	)
 
-	log.Println("cluster.START", err)
 	clusterActor.Start()
-	log.Println("cluster.STARTED", err)
+	logger.Info("cluster started", "addr", clusterAddr)
+
+	if certs != nil {
+		srv.WithTLS(certs.ServerConfig())
+	}
+
+	limiter := server.NewRateLimiter(cfg.RateLimit, cfg.RateLimitBurst, clientKey)
+	conf := newReloader(loader, cfg, func(ctx context.Context, cfg Cfg) error {
+		// everything that can fail goes first, so a failed reload leaves
+		// the running settings as they are
+		level, err := logging.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return err
+		}
+		def, namespaces, err := cfg.namespaceCfgs()
+		if err != nil {
+			return err
+		}
+		// a key is rotated by appending it to the key file
+		var keys *crypt.FileKeyProvider
+		if fileKeys != nil {
+			if keys, err = crypt.NewFileKeyProvider(cfg.EncryptionKeyFile); err != nil {
+				return fmt.Errorf("encryption keys: %w", err)
+			}
+			if err = crypt.Verify(cfg.DataDir, keys); err != nil {
+				return fmt.Errorf("encryption keys: %w", err)
+			}
+		}
+		if err = localStore.SetNamespaces(ctx, def, namespaces); err != nil {
+			return err
+		}
+
+		if keys != nil {
+			fileKeys.Swap(keys)
+		}
+		logLevel.Set(level)
+		limiter.SetLimit(cfg.RateLimit, cfg.RateLimitBurst)
+		localStore.SetEnqueueTimeout(cfg.EnqueueTimeout)
+		actorStorage.SetEnqueueTimeout(cfg.EnqueueTimeout)
+		if antiEntropy != nil {
+			antiEntropy.SetBandwidth(cfg.AntiEntropyBandwidth)
+		}
+		return nil
+	}, logger)
+	maxBody := func() int64 {
+		return conf.Cfg().MaxBodySize
+	}
+
+	srv.Use(tracing.Middleware, logging.Middleware(logger))
+	srv.Use(server.Shed(localStore.QueueDepth, func() int {
+		return conf.Cfg().ShedQueueDepth
+	}))
+	store := replicate
+	if authenticator.Enabled() {
+		store = auth.NewStorage(replicate, acl)
+		srv.Use(authenticator.Middleware)
+	}
+	m := metrics.New(logger)
+	m.Stats(localStore)
+	m.Gauge("request_queue_depth", "Storage requests waiting to be processed.", func() float64 {
+		return float64(localStore.QueueDepth())
+	})
+	m.Gauge("replication_queue_depth", "Commands waiting to be replicated to peers.", func() float64 {
+		return float64(len(replicationCommands))
+	})
+	m.Counter("replication_dropped_total", "Commands not replicated because the replication queue was full or closed.", func() float64 {
+		return float64(actorStorage.Dropped())
+	})
+	m.Gauge("replication_unacked", "Commands sent to peers and not acknowledged.", func() float64 {
+		return float64(replication.unacked(""))
+	})
+	m.Counter("replication_batches_total", "Batches of commands sent to peers.", func() float64 {
+		return float64(replication.batches.Load())
+	})
+	m.Counter("replication_retries_total", "Commands resent to peers that did not acknowledge them.", func() float64 {
+		return float64(replication.retries.Load())
+	})
+	m.Counter("replication_failed_total", "Commands peers failed to apply.", func() float64 {
+		return float64(replication.failed.Load())
+	})
+	m.Counter("replication_lost_total", "Commands given up because too many were unacknowledged or the hints were full.", func() float64 {
+		return float64(replication.lost.Load())
+	})
+	if hints != nil {
+		m.Gauge("hints_bytes", "Bytes of commands hinted for peers.", func() float64 {
+			return float64(hints.bytes.Load())
+		})
+		m.Counter("hints_stored_total", "Commands hinted for disconnected or lagging peers.", func() float64 {
+			return float64(hints.stored.Load())
+		})
+		m.Counter("hints_delivered_total", "Hinted commands put back into the stream of their peer.", func() float64 {
+			return float64(hints.delivered.Load())
+		})
+		m.Counter("hints_dropped_total", "Commands not hinted or hints dropped because they were full, expired or unreadable.", func() float64 {
+			return float64(hints.dropped.Load())
+		})
+	}
+	if bootstrap != nil {
+		m.Counter("bootstrap_snapshots_served_total", "Snapshots taken for joining peers.", func() float64 {
+			return float64(bootstrap.served.Load())
+		})
+		m.Counter("bootstrap_bytes_total", "Bytes of snapshots received from peers while bootstrapping.", func() float64 {
+			return float64(bootstrap.bytes.Load())
+		})
+	}
+	if antiEntropy != nil {
+		m.Counter("anti_entropy_rounds_total", "Anti-entropy rounds run with a peer.", func() float64 {
+			return float64(antiEntropy.rounds.Load())
+		})
+		m.Counter("anti_entropy_errors_total", "Anti-entropy rounds that failed.", func() float64 {
+			return float64(antiEntropy.errors.Load())
+		})
+		m.Counter("anti_entropy_repaired_keys_total", "Keys repaired here or on peers by anti-entropy.", func() float64 {
+			return float64(antiEntropy.repaired.Load())
+		})
+		m.Counter("anti_entropy_bytes_total", "Bytes of values exchanged by anti-entropy.", func() float64 {
+			return float64(antiEntropy.bytes.Load())
+		})
+	}
+	if partitions != nil {
+		m.Counter("partition_forwarded_total", "Requests forwarded to the members owning their keys.", func() float64 {
+			return float64(partitions.forwarded.Load())
+		})
+		m.Counter("partition_handed_off_keys_total", "Keys pushed to their new owners after the ring changed.", func() float64 {
+			return float64(partitions.handedOff.Load())
+		})
+		m.Counter("partition_forgotten_keys_total", "Keys dropped once handed off to their owners.", func() float64 {
+			return float64(partitions.forgotten.Load())
+		})
+	}
+	m.Gauge("cluster_members", "Known cluster members.", func() float64 {
+		return float64(len(clusterActor.Members()))
+	})
+	store = m.Storage(store)
+
+	srv.Use(limiter.Middleware)
+
+	// writes is applied to the handlers of writes, in redirect mode they are
+	// sent to the raft leader.
+	writes := func(h http.Handler) http.Handler { return h }
+	if node != nil && cfg.LeaderForward == forwardRedirect {
+		writes = redirectToLeader(node, clusterActor, cfg.ForwardTimeout)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("POST /get", handleGet(actorStorage))
-	mux.Handle("POST /set", handleSet(actorStorage))
-	mux.Handle("POST /del", handleDel(actorStorage))
-	mux.Handle("POST /rename", handleRename(actorStorage))
+	mux.Handle("POST /get", limitBody(maxBody, handleGet(store)))
+	mux.Handle("POST /set", writes(limitBody(maxBody, handleSet(store))))
+	mux.Handle("POST /del", writes(limitBody(maxBody, handleDel(store))))
+	mux.Handle("POST /rename", writes(limitBody(maxBody, handleRename(store))))
+	mux.Handle("GET /kv/{key}", handleGetValue(store))
+	mux.Handle("PUT /kv/{key}", writes(limitBody(maxBody, handleSetValue(store))))
+	mux.Handle("DELETE /kv/{key}", writes(handleDelValue(store)))
+	mux.Handle("POST /scan", limitBody(maxBody, handleScan(store)))
+	mux.Handle("POST /flush", writes(limitBody(maxBody, handleFlush(store))))
+	mux.Handle("GET /stats", acl.Require(auth.Admin, handleStats(localStore)))
+	mux.Handle("GET /metrics", acl.Require(auth.Admin, m.Handler()))
+	mux.Handle("POST /admin/reload", acl.Require(auth.Admin, handleReload(conf)))
+	mux.Handle("GET /admin/info", acl.Require(auth.Admin, handleInfo(infoSource{
+		cfg:     conf.Cfg,
+		role:    role,
+		store:   localStore,
+		actors:  actorStorage,
+		engine:  clusterActor.Engine(),
+		server:  srvPID,
+		timeout: 5 * time.Second,
+	})))
+
+	if partitions != nil {
+		mux.Handle("GET /admin/ring", acl.Require(auth.Admin, handleRing(partitions)))
+	}
+	if node != nil {
+		registerMembers(mux, func(h http.Handler) http.Handler {
+			return acl.Require(auth.Admin, h)
+		}, node, cfg.RaftApplyTimeout)
+	}
+
+	health := server.NewHealth()
+	health.Live("storage", func(context.Context) error {
+		return localStore.Live()
+	})
+	health.Ready("storage", func(context.Context) error {
+		return localStore.Ready()
+	})
+	health.Ready("storage_queue", func(context.Context) error {
+		if depth, limit := localStore.QueueDepth(), conf.Cfg().ShedQueueDepth; limit > 0 && depth >= limit {
+			return fmt.Errorf("queue depth %d", depth)
+		}
+		return nil
+	})
+	health.Ready("cluster", func(context.Context) error {
+		for _, member := range clusterActor.Members() {
+			if member.ID == cfg.NodeID {
+				return nil
+			}
+		}
+		return errors.New("not joined")
+	})
+	health.Ready("replication", func(context.Context) error {
+		depth, capacity := len(replicationCommands), cap(replicationCommands)
+		if float64(depth) >= conf.Cfg().ReadyReplicationQueue*float64(capacity) {
+			return fmt.Errorf("queue saturated %d/%d", depth, capacity)
+		}
+		return nil
+	})
+	if node != nil {
+		health.Ready("raft", func(context.Context) error {
+			return node.Ready()
+		})
+	}
+	health.Ready("bootstrap", func(context.Context) error {
+		return bootstrap.Ready()
+	})
+	srv.Bypass("GET /healthz", health.LiveHandler())
+	srv.Bypass("GET /readyz", health.ReadyHandler())
 
 	srv.Register(mux)
 
-	wg := errgroup.Group{}
+	// raft restores its own snapshots
+	snapshots := cfg.SnapshotOnShutdown && node == nil
+	if snapshots {
+		if ok, err := loadSnapshot(ctx, localStore, cfg.DataDir); err != nil {
+			fatal("loadSnapshot", err)
+		} else if ok {
+			logger.Info("snapshot loaded", "dir", cfg.DataDir)
+		}
+	}
+	wg.Go(func() error {
+		if err := srv.Run(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	if certs != nil {
+		wg.Go(func() error {
+			certs.Watch(ctx, cfg.TLSReload)
+			return nil
+		})
+	}
+	wg.Go(func() error {
+		limiter.Cleanup(ctx, time.Minute)
+		return nil
+	})
+	if bootstrap != nil {
+		wg.Go(func() error {
+			bootstrap.Run(ctx)
+			return nil
+		})
+	}
+	if antiEntropy != nil {
+		wg.Go(func() error {
+			antiEntropy.Run(ctx)
+			return nil
+		})
+	}
+	if partitions != nil {
+		wg.Go(func() error {
+			partitions.Run(ctx)
+			return nil
+		})
+	}
 	wg.Go(func() error {
-		localStore.Run(ctx)
+		conf.Watch(ctx)
 		return nil
 	})
-	wg.Go(srv.Run)
 
+	// shutdowns run in order once a signal is received, see Cfg for the
+	// timeouts of the steps.
 	var shutdowns = []func() error{
-		srv.Close,
 		func() error {
-			defer clusterActor.Stop()
-			fmt.Println("STOPPING CLUSTER")
+			logger.Info("draining", "delay", cfg.ShutdownDrainDelay)
+			health.Drain()
+			time.Sleep(cfg.ShutdownDrainDelay)
 			return nil
 		},
+		func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			return srv.Shutdown(ctx)
+		},
+		func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ReplicationDrainTimeout)
+			defer cancel()
+			actorStorage.Close()
+			logger.Info("flushing replication queue", "commands", len(replicationCommands))
+			return replication.Drain(ctx)
+		},
+		func() error {
+			if !snapshots {
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			logger.Info("saving snapshot", "dir", cfg.DataDir)
+			return saveSnapshot(ctx, localStore, cfg.DataDir)
+		},
+		func() error {
+			defer clusterActor.Stop()
+			logger.Info("leaving cluster")
+			_, err := clusterActor.Engine().Request(srvPID, Leave{}, 5*time.Second).Result()
+			return err
+		},
+		replication.Close,
+		func() error {
+			if node == nil {
+				return nil
+			}
+			logger.Info("stopping raft")
+			return node.Close()
+		},
+		localStore.CloseAndWait,
+		func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return shutdownTracing(ctx)
+		},
 	}
 	wg.Go(func() (err error) {
 		<-ctx.Done()
@@ -110,6 +693,6 @@ func main() {
 	})
 
 	if err = wg.Wait(); err != nil {
-		log.Fatal(err)
+		fatal("shutdown", err)
 	}
 }
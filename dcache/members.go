@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/dmitrorezn/dcache/logging"
+	"github.com/dmitrorezn/dcache/raftnode"
+)
+
+type memberRequest struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	// Learner adds a non-voting member.
+	Learner bool `json:"learner"`
+}
+
+type transferRequest struct {
+	// ID is the new leader, any up to date voter if empty.
+	ID string `json:"id"`
+}
+
+// registerMembers serves the raft membership admin API:
+//
+//	GET    /admin/members              list members
+//	POST   /admin/members              add a voter or learner
+//	DELETE /admin/members/{id}         remove a member
+//	POST   /admin/members/{id}/demote  turn a voter into a learner
+//	POST   /admin/leader/transfer      transfer leadership
+func registerMembers(mux *http.ServeMux, admin func(http.Handler) http.Handler, node *raftnode.Node, timeout time.Duration) {
+	mux.Handle("GET /admin/members", admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		members, err := node.Members()
+		if err != nil {
+			membershipError(rw, err)
+			return
+		}
+		writeJSON(rw, r, members)
+	})))
+	mux.Handle("POST /admin/members", admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req memberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" || req.Address == "" {
+			http.Error(rw, "id and address are required", http.StatusBadRequest)
+			return
+		}
+
+		add := node.AddVoter
+		if req.Learner {
+			add = node.AddLearner
+		}
+		if err := add(req.ID, req.Address, timeout); err != nil {
+			membershipError(rw, err)
+			return
+		}
+		logging.FromContext(r.Context()).Info("member added", "id", req.ID, "address", req.Address, "learner", req.Learner)
+		rw.WriteHeader(http.StatusNoContent)
+	})))
+	mux.Handle("DELETE /admin/members/{id}", admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := node.Remove(r.PathValue("id"), timeout); err != nil {
+			membershipError(rw, err)
+			return
+		}
+		logging.FromContext(r.Context()).Info("member removed", "id", r.PathValue("id"))
+		rw.WriteHeader(http.StatusNoContent)
+	})))
+	mux.Handle("POST /admin/members/{id}/demote", admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if err := node.Demote(r.PathValue("id"), timeout); err != nil {
+			membershipError(rw, err)
+			return
+		}
+		logging.FromContext(r.Context()).Info("member demoted", "id", r.PathValue("id"))
+		rw.WriteHeader(http.StatusNoContent)
+	})))
+	mux.Handle("POST /admin/leader/transfer", admin(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req transferRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := node.TransferLeadership(req.ID); err != nil {
+			membershipError(rw, err)
+			return
+		}
+		logging.FromContext(r.Context()).Info("leadership transferred", "to", req.ID)
+		rw.WriteHeader(http.StatusNoContent)
+	})))
+}
+
+func membershipError(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, raft.ErrNotLeader):
+		http.Error(rw, err.Error(), http.StatusMisdirectedRequest)
+	case errors.Is(err, raftnode.ErrUnknownMember):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case errors.Is(err, raftnode.ErrLastVoter), errors.Is(err, raftnode.ErrNoQuorum):
+		http.Error(rw, err.Error(), http.StatusConflict)
+	case errors.Is(err, raft.ErrEnqueueTimeout), errors.Is(err, raft.ErrLeadershipTransferInProgress):
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, r *http.Request, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		logging.FromContext(r.Context()).Warn("encode response", "err", err)
+	}
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+const namespace = "dcache"
+
+type Metrics struct {
+	registry *prometheus.Registry
+	log      *slog.Logger
+
+	commands *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+func New(logger *slog.Logger) *Metrics {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		log:      logger,
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Storage commands by command and result.",
+		}, []string{"cmd", "result"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Storage command latency.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"cmd"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.commands,
+		m.latency,
+	)
+
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Gauge registers a gauge reporting the value of fn at scrape time.
+func (m *Metrics) Gauge(name, help string, fn func() float64) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// Counter registers a counter reporting the value of fn at scrape time.
+func (m *Metrics) Counter(name, help string, fn func() float64) {
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// Stats registers per namespace key, memory, hit and eviction metrics read
+// from s at scrape time.
+func (m *Metrics) Stats(s *storage.Storage) {
+	m.registry.MustRegister(&statsCollector{
+		store: s,
+		log:   m.log,
+		keys: prometheus.NewDesc(namespace+"_keys", "Number of keys.",
+			[]string{"namespace"}, nil),
+		bytes: prometheus.NewDesc(namespace+"_memory_bytes", "Size of stored values before compression.",
+			[]string{"namespace"}, nil),
+		storedBytes: prometheus.NewDesc(namespace+"_stored_bytes", "Size of stored values after compression.",
+			[]string{"namespace"}, nil),
+		hits: prometheus.NewDesc(namespace+"_hits_total", "Reads of existing keys.",
+			[]string{"namespace"}, nil),
+		misses: prometheus.NewDesc(namespace+"_misses_total", "Reads of missing keys.",
+			[]string{"namespace"}, nil),
+		evictions: prometheus.NewDesc(namespace+"_evictions_total", "Keys evicted to stay within namespace quotas.",
+			[]string{"namespace"}, nil),
+	})
+}
+
+type statsCollector struct {
+	store *storage.Storage
+	log   *slog.Logger
+
+	keys        *prometheus.Desc
+	bytes       *prometheus.Desc
+	storedBytes *prometheus.Desc
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	evictions   *prometheus.Desc
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+	ch <- c.bytes
+	ch <- c.storedBytes
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats, err := c.store.Stats(ctx)
+	if err != nil {
+		c.log.Error("collect storage stats", "err", err)
+		return
+	}
+	for name, st := range stats.Namespaces {
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(st.Keys), name)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(st.Bytes), name)
+		ch <- prometheus.MustNewConstMetric(c.storedBytes, prometheus.GaugeValue, float64(st.StoredBytes), name)
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(st.Hits), name)
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(st.Misses), name)
+		ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(st.Evictions), name)
+	}
+}
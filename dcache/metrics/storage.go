@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+// Storage records the count and latency of every command passed on to the
+// wrapped storage.
+type Storage struct {
+	storage.IStorage
+
+	m *Metrics
+}
+
+func (m *Metrics) Storage(s storage.IStorage) *Storage {
+	return &Storage{
+		IStorage: s,
+		m:        m,
+	}
+}
+
+func (s *Storage) observe(cmd storage.Cmd, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	s.m.commands.WithLabelValues(cmd.String(), result).Inc()
+	s.m.latency.WithLabelValues(cmd.String()).Observe(time.Since(start).Seconds())
+}
+
+func (s *Storage) Do(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(cmd.Cmd, start, err) }(time.Now())
+
+	return s.IStorage.Do(ctx, cmd)
+}
+
+func (s *Storage) Get(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(storage.Get, start, err) }(time.Now())
+
+	return s.IStorage.Get(ctx, cmd)
+}
+
+func (s *Storage) Set(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(storage.Set, start, err) }(time.Now())
+
+	return s.IStorage.Set(ctx, cmd)
+}
+
+func (s *Storage) Del(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(storage.Del, start, err) }(time.Now())
+
+	return s.IStorage.Del(ctx, cmd)
+}
+
+func (s *Storage) Rename(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(storage.Rename, start, err) }(time.Now())
+
+	return s.IStorage.Rename(ctx, cmd)
+}
+
+func (s *Storage) Scan(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(storage.Scan, start, err) }(time.Now())
+
+	return s.IStorage.Scan(ctx, cmd)
+}
+
+func (s *Storage) Flush(ctx context.Context, cmd storage.Command) (err error) {
+	defer func(start time.Time) { s.observe(storage.Flush, start, err) }(time.Now())
+
+	return s.IStorage.Flush(ctx, cmd)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthdm/hollywood/cluster"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/ring"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+// rebalanceSettle is how long the ring must stay the same before keys are
+// handed over, members often join or leave together.
+const rebalanceSettle = 2 * time.Second
+
+var errCrossPartition = errors.New("keys are owned by different members")
+
+type PartitionsCfg struct {
+	// VNodes is the number of tokens of each member on the ring.
+	VNodes int
+	// ReplicationFactor is the number of members keeping each key.
+	ReplicationFactor int
+	// TombstoneTTL is how long deleted keys are remembered, so a handoff
+	// does not bring them back.
+	TombstoneTTL time.Duration
+	Timeout      time.Duration
+	// ChunkSize bounds the parts of forwarded payloads and outputs.
+	ChunkSize int
+	Logger    *slog.Logger
+}
+
+// Partitions spreads the keys over the cluster members: the ring is built
+// from the members and each key is kept by the ReplicationFactor members
+// following it. Requests for keys the node does not own are forwarded to an
+// owner, writes are replicated to the other owners only, and when the ring
+// changes the keys are pushed to their new owners and dropped by the nodes
+// that no longer own them.
+type Partitions struct {
+	store   *storage.Storage
+	cluster *cluster.Cluster
+	cfg     PartitionsCfg
+
+	mu      sync.Mutex
+	ring    atomic.Pointer[ring.Ring]
+	changed chan struct{}
+
+	forwarded atomic.Uint64
+	handedOff atomic.Uint64
+	forgotten atomic.Uint64
+}
+
+func NewPartitions(store *storage.Storage, cluster *cluster.Cluster, cfg PartitionsCfg) *Partitions {
+	if cfg.VNodes <= 0 {
+		cfg.VNodes = 128
+	}
+	if cfg.ReplicationFactor <= 0 {
+		cfg.ReplicationFactor = 1
+	}
+	if cfg.TombstoneTTL <= 0 {
+		cfg.TombstoneTTL = time.Hour
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	p := &Partitions{
+		store:   store,
+		cluster: cluster,
+		cfg:     cfg,
+		changed: make(chan struct{}, 1),
+	}
+	p.ring.Store(ring.New(cfg.VNodes, ring.Member{ID: cluster.ID()}))
+
+	return p
+}
+
+// Ring returns the current ring.
+func (p *Partitions) Ring() *ring.Ring {
+	return p.ring.Load()
+}
+
+// update rebuilds the ring from the cluster members once m joined or left,
+// p may be nil.
+func (p *Partitions) update(m *cluster.Member, joined bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// the members of the cluster may not reflect the event yet
+	members := []ring.Member{{ID: p.cluster.ID()}}
+	for _, c := range p.cluster.Members() {
+		if c.ID != m.ID && c.ID != p.cluster.ID() {
+			members = append(members, ring.Member{ID: c.ID, Host: c.Host})
+		}
+	}
+	if joined && m.ID != p.cluster.ID() {
+		members = append(members, ring.Member{ID: m.ID, Host: m.Host})
+	}
+	r := ring.New(p.cfg.VNodes, members...)
+	if p.ring.Swap(r).Equal(r) {
+		return
+	}
+	p.cfg.Logger.Info("ring changed", "members", len(members))
+	p.notify()
+}
+
+func (p *Partitions) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// ringKey is the position of key of the namespace ns on the ring.
+func ringKey(ns, key string) string {
+	if ns == "" {
+		ns = storage.DefaultNamespace
+	}
+
+	return ns + "\x00" + key
+}
+
+// owners returns the members keeping the keys of cmd, which must address
+// keys.
+func (p *Partitions) owners(cmd storage.Command) ([]ring.Member, error) {
+	keys, err := storage.Keys(cmd)
+	if err != nil {
+		return nil, err
+	}
+	r := p.Ring()
+	owners := r.Owners(ringKey(cmd.Namespace, keys[0]), p.cfg.ReplicationFactor)
+	for _, k := range keys[1:] {
+		other := r.Owners(ringKey(cmd.Namespace, k), p.cfg.ReplicationFactor)
+		if len(other) != len(owners) || slices.ContainsFunc(other, func(m ring.Member) bool {
+			return !slices.Contains(owners, m)
+		}) {
+			return nil, errCrossPartition
+		}
+	}
+
+	return owners, nil
+}
+
+// replicas returns the ids of the members cmd is replicated to, nil for the
+// commands every member applies. Set as ReplicationCfg.Replicas.
+func (p *Partitions) replicas(cmd storage.Command) []string {
+	if cmd.Cmd == storage.Flush {
+		return nil
+	}
+	owners, err := p.owners(cmd)
+	if err != nil {
+		// the receivers reject it as well
+		return nil
+	}
+	ids := make([]string, len(owners))
+	for i, m := range owners {
+		ids[i] = m.ID
+	}
+
+	return ids
+}
+
+// shared reports whether the node and the member peer both keep key of ns.
+// Set as AntiEntropyCfg.Shared.
+func (p *Partitions) shared(peer, ns, key string) bool {
+	r := p.Ring()
+	return r.Owns(p.cluster.ID(), ringKey(ns, key), p.cfg.ReplicationFactor) &&
+		r.Owns(peer, ringKey(ns, key), p.cfg.ReplicationFactor)
+}
+
+// Run hands the keys over to their new owners once the ring changed and
+// settled, retrying until it succeeds, and drops the tombstones older than
+// TombstoneTTL.
+func (p *Partitions) Run(ctx context.Context) {
+	prune := time.NewTicker(p.cfg.TombstoneTTL / 2)
+	defer prune.Stop()
+	var (
+		prev   = p.Ring()
+		settle <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-prune.C:
+			// anti-entropy rounds, which prune them too, may be disabled
+			if err := p.store.PruneTombstones(ctx, time.Now().Add(-p.cfg.TombstoneTTL)); err != nil {
+				p.cfg.Logger.Warn("prune tombstones", "err", err)
+			}
+		case <-p.changed:
+			settle = time.After(rebalanceSettle)
+		case <-settle:
+			cur := p.Ring()
+			if err := p.rebalance(ctx, prev, cur); err != nil {
+				p.cfg.Logger.Warn("rebalance", "retry", rebalanceSettle, "err", err)
+				settle = time.After(rebalanceSettle)
+				continue
+			}
+			prev, settle = cur, nil
+		}
+	}
+}
+
+// rebalance pushes the stored keys whose owners changed from prev to cur to
+// the owners that may not have them, and forgets the keys the node no longer
+// owns once every owner has them.
+func (p *Partitions) rebalance(ctx context.Context, prev, cur *ring.Ring) error {
+	ctx, span := tracer.Start(ctx, "partitions.rebalance")
+	defer span.End()
+
+	stored, err := p.store.Stored(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		self      = p.cluster.ID()
+		rf        = p.cfg.ReplicationFactor
+		errs      error
+		handedOff int
+		forgotten int
+	)
+	for ns, keys := range stored {
+		push, forget := handoff(self, prev, cur, rf, ns, keys)
+		failed := make(map[string]bool)
+		for m, keys := range push {
+			if err := p.push(ctx, m, ns, keys); err != nil {
+				errs = errors.Join(errs, fmt.Errorf("push to %s: %w", m.ID, err))
+				for _, k := range keys {
+					failed[k] = true
+				}
+				continue
+			}
+			handedOff += len(keys)
+		}
+		forget = slices.DeleteFunc(forget, func(k string) bool {
+			return failed[k]
+		})
+		if err := p.store.Forget(ctx, ns, forget); err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		forgotten += len(forget)
+	}
+	p.handedOff.Add(uint64(handedOff))
+	p.forgotten.Add(uint64(forgotten))
+	p.cfg.Logger.Info("rebalanced", "members", len(cur.Members()), "handed_off", handedOff, "forgotten", forgotten)
+
+	return errs
+}
+
+// handoff returns the keys of ns stored by the member self to push to each
+// owner, and the ones self forgets once pushed, when the ring changes from
+// prev to cur. An owner of a key pushes it to the owners that were not, a
+// node no longer owning it pushes it to all of them.
+func handoff(self string, prev, cur *ring.Ring, rf int, ns string, keys []string) (map[ring.Member][]string, []string) {
+	var (
+		push   = make(map[ring.Member][]string)
+		forget []string
+	)
+	for _, k := range keys {
+		owners := cur.Owners(ringKey(ns, k), rf)
+		mine := cur.Owns(self, ringKey(ns, k), rf)
+		for _, m := range owners {
+			// the previous owners push to the new ones
+			if m.ID != self && (!mine || !prev.Owns(m.ID, ringKey(ns, k), rf)) {
+				push[m] = append(push[m], k)
+			}
+		}
+		if !mine {
+			forget = append(forget, k)
+		}
+	}
+
+	return push, forget
+}
+
+// push stores the entries and tombstones of keys on m, in messages of up to
+// DefaultChunkSize bytes of values.
+func (p *Partitions) push(ctx context.Context, m ring.Member, ns string, keys []string) error {
+	entries, err := p.store.Entries(ctx, ns, keys)
+	if err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		n, size := 0, 0
+		for n < len(entries) && (n == 0 || size+len(entries[n].Entry.Value) <= storage.DefaultChunkSize) {
+			size += len(entries[n].Entry.Value)
+			n++
+		}
+		out, err := p.cluster.Engine().Request(serverPID(m.Host, m.ID), &clusterpb.RepairRequest{
+			Version:   clusterpb.Version,
+			Namespace: ns,
+			Entries:   entriesToProto(entries[:n]),
+		}, p.cfg.Timeout).Result()
+		if err != nil {
+			return err
+		}
+		res, ok := out.(*clusterpb.RepairResponse)
+		if !ok {
+			return fmt.Errorf("unexpected response %T", out)
+		}
+		if res.GetErr() != "" {
+			return errors.New(res.GetErr())
+		}
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+var _ storage.IStorage = new(partitionedStorage)
+
+// partitionedStorage applies the commands on keys the node owns to the
+// IStorage, which replicates them to the other owners, and forwards the
+// other ones to an owner. Scans ask every member.
+type partitionedStorage struct {
+	storage.IStorage
+
+	p *Partitions
+}
+
+// route applies cmd with local if the node owns its keys, otherwise it
+// forwards it to the owners in order until one answers.
+func (s *partitionedStorage) route(ctx context.Context, cmd storage.Command, local func(context.Context, storage.Command) error) error {
+	owners, err := s.p.owners(cmd)
+	if err != nil {
+		return err
+	}
+	self := s.p.cluster.ID()
+	if slices.ContainsFunc(owners, func(m ring.Member) bool { return m.ID == self }) {
+		return local(ctx, cmd)
+	}
+	for _, m := range owners {
+		s.p.forwarded.Add(1)
+		if err = forwardTo(ctx, s.p.cluster, m.Host, m.ID, cmd, s.p.cfg.Timeout, s.p.cfg.ChunkSize); !errors.Is(err, errUnreachable) {
+			return err
+		}
+		s.p.cfg.Logger.Warn("owner unreachable", "member", m.ID, "cmd", cmd.Cmd, "err", err)
+	}
+
+	return err
+}
+
+func (s *partitionedStorage) Get(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Get
+	return s.route(ctx, cmd, s.IStorage.Get)
+}
+
+func (s *partitionedStorage) Set(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Set
+	return s.route(ctx, cmd, s.IStorage.Set)
+}
+
+func (s *partitionedStorage) Del(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Del
+	return s.route(ctx, cmd, s.IStorage.Del)
+}
+
+// Rename is only supported between keys with the same owners.
+func (s *partitionedStorage) Rename(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Rename
+	return s.route(ctx, cmd, s.IStorage.Rename)
+}
+
+// Scan merges the keys found by every member. Unreachable members are
+// skipped as long as the members that answered keep every range.
+func (s *partitionedStorage) Scan(ctx context.Context, cmd storage.Command) error {
+	cmd.Cmd = storage.Scan
+	var (
+		self = s.p.cluster.ID()
+		cur  = s.p.Ring()
+		mu   sync.Mutex
+		keys = make(map[string]struct{})
+		wg   errgroup.Group
+		// members that have the namespace
+		found int
+		// members that answered, and the error of the ones that did not
+		answered    = make(map[string]bool)
+		unreachable error
+	)
+	for _, m := range cur.Members() {
+		wg.Go(func() error {
+			var out bytes.Buffer
+			c := cmd
+			c.W = &out
+			var err error
+			if m.ID == self {
+				err = s.IStorage.Scan(ctx, c)
+			} else {
+				s.p.forwarded.Add(1)
+				err = forwardTo(ctx, s.p.cluster, m.Host, m.ID, c, s.p.cfg.Timeout, s.p.cfg.ChunkSize)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, errUnreachable) {
+				s.p.cfg.Logger.Warn("scan member unreachable", "member", m.ID, "err", err)
+				unreachable = errors.Join(unreachable, fmt.Errorf("scan %s: %w", m.ID, err))
+				return nil
+			}
+			answered[m.ID] = true
+			if errors.Is(err, storage.ErrNIL) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("scan %s: %w", m.ID, err)
+			}
+			found++
+			for _, k := range strings.Split(out.String(), "\n") {
+				if k != "" {
+					keys[k] = struct{}{}
+				}
+			}
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		return err
+	}
+	if unreachable != nil && !cur.Covered(answered, s.p.cfg.ReplicationFactor) {
+		return unreachable
+	}
+	if found == 0 {
+		return storage.ErrNIL
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var buf []byte
+	for _, k := range sorted {
+		buf = append(append(buf, k...), '\n')
+	}
+	if sw, ok := cmd.W.(storage.Sizer); ok {
+		sw.SetSize(len(buf))
+	}
+	_, err := cmd.W.Write(buf)
+
+	return err
+}
+
+// RingInfo is served by GET /admin/ring.
+type RingInfo struct {
+	VNodes            int          `json:"vnodes"`
+	ReplicationFactor int          `json:"replicationFactor"`
+	Members           []ring.Share `json:"members"`
+	// Owners are the members keeping the key asked with ?key= in the
+	// namespace asked with ?namespace=.
+	Key    string        `json:"key,omitempty"`
+	Owners []ring.Member `json:"owners,omitempty"`
+}
+
+func handleRing(p *Partitions) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		cur := p.Ring()
+		info := RingInfo{
+			VNodes:            cur.VNodes(),
+			ReplicationFactor: p.cfg.ReplicationFactor,
+			Members:           cur.Shares(p.cfg.ReplicationFactor),
+		}
+		if key := r.URL.Query().Get("key"); key != "" {
+			info.Key = key
+			info.Owners = cur.Owners(ringKey(r.URL.Query().Get("namespace"), key), p.cfg.ReplicationFactor)
+		}
+		writeJSON(rw, r, info)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/dmitrorezn/dcache/ring"
+)
+
+func TestHandoff(t *testing.T) {
+	const rf = 2
+	var ms []ring.Member
+	for _, id := range []string{"a", "b", "c", "d"} {
+		ms = append(ms, ring.Member{ID: id, Host: id + ":4000"})
+	}
+	// stored returns the keys a member of r keeps
+	stored := func(r *ring.Ring, id string) []string {
+		var keys []string
+		for i := 0; i < 2000; i++ {
+			if k := fmt.Sprint("key", i); r.Owns(id, ringKey("", k), rf) {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+	pushedTo := func(push map[ring.Member][]string) map[string][]string {
+		out := make(map[string][]string)
+		for m, keys := range push {
+			for _, k := range keys {
+				out[k] = append(out[k], m.ID)
+			}
+		}
+		return out
+	}
+	owners := func(r *ring.Ring, k string) []string {
+		var ids []string
+		for _, m := range r.Owners(ringKey("", k), rf) {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	t.Run("join", func(t *testing.T) {
+		prev, cur := ring.New(32, ms[:3]...), ring.New(32, ms...)
+		keys := stored(prev, "a")
+		push, forget := handoff("a", prev, cur, rf, "", keys)
+		pushed := pushedTo(push)
+		var kept, lost int
+		for _, k := range keys {
+			got := pushed[k]
+			slices.Sort(got)
+			switch mine := cur.Owns("a", ringKey("", k), rf); {
+			case mine && slices.Contains(owners(cur, k), "d"):
+				// only the joining member misses it
+				kept++
+				if !slices.Equal(got, []string{"d"}) {
+					t.Fatalf("%s pushed to %v, want [d]", k, got)
+				}
+			case mine:
+				if len(got) > 0 {
+					t.Fatalf("%s owned by the same members pushed to %v", k, got)
+				}
+			default:
+				// handed over to every owner, then forgotten
+				lost++
+				want := owners(cur, k)
+				slices.Sort(want)
+				if !slices.Equal(got, want) || !slices.Contains(forget, k) {
+					t.Fatalf("%s pushed to %v, want %v and forgotten", k, got, want)
+				}
+			}
+		}
+		if kept == 0 || lost == 0 || len(forget) != lost {
+			t.Fatalf("%d keys shared with d, %d handed over, %d forgotten", kept, lost, len(forget))
+		}
+	})
+
+	t.Run("leave", func(t *testing.T) {
+		prev, cur := ring.New(32, ms...), ring.New(32, ms[:3]...)
+		push, forget := handoff("a", prev, cur, rf, "", stored(prev, "a"))
+		if len(forget) != 0 {
+			t.Fatalf("a member left, yet %d keys are forgotten", len(forget))
+		}
+		for k, got := range pushedTo(push) {
+			for _, id := range got {
+				if id == "a" || id == "d" || prev.Owns(id, ringKey("", k), rf) {
+					t.Fatalf("%s pushed to %s", k, id)
+				}
+			}
+		}
+		if len(push) == 0 {
+			t.Fatal("nothing handed to the new owners")
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+const snapshotFile = "snapshot"
+
+// saveSnapshot writes the storage to dir, replacing the previous snapshot
+// only once the new one is completely written.
+func saveSnapshot(ctx context.Context, s *storage.Storage, dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, snapshotFile+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = s.Save(ctx, f); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	if err = f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(dir, snapshotFile))
+}
+
+// loadSnapshot restores the storage from dir, if a snapshot was saved there.
+func loadSnapshot(ctx context.Context, s *storage.Storage, dir string) (bool, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return true, s.Load(ctx, f)
+}
@@ -0,0 +1,54 @@
+package raftnode
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/dmitrorezn/dcache/crypt"
+)
+
+// sealedLogs encrypts the data of the entries of a log store, so the values
+// of writes are not kept in the clear in the raft log.
+type sealedLogs struct {
+	raft.LogStore
+	keys crypt.KeyProvider
+}
+
+func (s *sealedLogs) GetLog(index uint64, log *raft.Log) error {
+	if err := s.LogStore.GetLog(index, log); err != nil {
+		return err
+	}
+	if len(log.Data) == 0 {
+		return nil
+	}
+	data, err := crypt.Open(s.keys, log.Data)
+	if err != nil {
+		return fmt.Errorf("log %d: %w", index, err)
+	}
+	log.Data = data
+
+	return nil
+}
+
+func (s *sealedLogs) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs seals copies of logs, raft keeps using the entries it passed.
+func (s *sealedLogs) StoreLogs(logs []*raft.Log) error {
+	sealed := make([]*raft.Log, len(logs))
+	for i, log := range logs {
+		c := *log
+		if len(c.Data) > 0 {
+			data, err := crypt.Seal(s.keys, c.Data)
+			if err != nil {
+				return fmt.Errorf("log %d: %w", c.Index, err)
+			}
+			c.Data = data
+		}
+		sealed[i] = &c
+	}
+
+	return s.LogStore.StoreLogs(sealed)
+}
@@ -0,0 +1,200 @@
+package raftnode
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var (
+	ErrUnknownMember = errors.New("unknown member")
+	ErrLastVoter     = errors.New("refusing to remove the last voter")
+	ErrNoQuorum      = errors.New("refusing to change the voters without a quorum in contact")
+)
+
+type Member struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+	Self     bool   `json:"self"`
+}
+
+// Members returns the members of the latest raft configuration.
+func (n *Node) Members() ([]Member, error) {
+	conf, _, err := n.configuration()
+	if err != nil {
+		return nil, err
+	}
+	_, leader := n.LeaderWithID()
+	members := make([]Member, 0, len(conf.Servers))
+	for _, srv := range conf.Servers {
+		members = append(members, Member{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+			Leader:   srv.ID == leader,
+			Self:     srv.ID == n.id,
+		})
+	}
+
+	return members, nil
+}
+
+func (n *Node) configuration() (raft.Configuration, uint64, error) {
+	f := n.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return raft.Configuration{}, 0, err
+	}
+
+	return f.Configuration(), f.Index(), nil
+}
+
+// AddVoter adds a member taking part in elections and commits, or promotes
+// a learner.
+func (n *Node) AddVoter(id, addr string, timeout time.Duration) error {
+	return n.change(func(conf raft.Configuration, index uint64) raft.IndexFuture {
+		return n.Raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), index, timeout)
+	})
+}
+
+// AddLearner adds a member receiving the log without voting.
+func (n *Node) AddLearner(id, addr string, timeout time.Duration) error {
+	return n.change(func(conf raft.Configuration, index uint64) raft.IndexFuture {
+		return n.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), index, timeout)
+	})
+}
+
+// Remove removes a member, a removed leader steps down.
+func (n *Node) Remove(id string, timeout time.Duration) error {
+	return n.change(func(conf raft.Configuration, index uint64) raft.IndexFuture {
+		if err := keepsQuorum(conf, raft.ServerID(id), n.reachable); err != nil {
+			return errorFuture{err}
+		}
+		return n.RemoveServer(raft.ServerID(id), index, timeout)
+	})
+}
+
+// Demote turns a voter into a learner.
+func (n *Node) Demote(id string, timeout time.Duration) error {
+	return n.change(func(conf raft.Configuration, index uint64) raft.IndexFuture {
+		if err := keepsQuorum(conf, raft.ServerID(id), n.reachable); err != nil {
+			return errorFuture{err}
+		}
+		return n.DemoteVoter(raft.ServerID(id), index, timeout)
+	})
+}
+
+// TransferLeadership hands leadership to the voter id, or to the most up to
+// date voter if id is empty.
+func (n *Node) TransferLeadership(id string) error {
+	if id == "" {
+		return n.leaderErr(n.LeadershipTransfer().Error())
+	}
+	conf, _, err := n.configuration()
+	if err != nil {
+		return err
+	}
+	for _, srv := range conf.Servers {
+		if srv.ID == raft.ServerID(id) {
+			return n.leaderErr(n.LeadershipTransferToServer(srv.ID, srv.Address).Error())
+		}
+	}
+
+	return fmt.Errorf("%w %q", ErrUnknownMember, id)
+}
+
+// change applies a configuration change based on the current configuration,
+// raft rejects it if the configuration changed in between.
+func (n *Node) change(fn func(conf raft.Configuration, index uint64) raft.IndexFuture) error {
+	conf, index, err := n.configuration()
+	if err != nil {
+		return err
+	}
+
+	return n.leaderErr(fn(conf, index).Error())
+}
+
+// keepsQuorum checks that the voters of conf other than id, the ones left
+// once it is removed or demoted, include a quorum of reachable ones.
+// Otherwise the cluster would be unable to commit until they are back.
+func keepsQuorum(conf raft.Configuration, id raft.ServerID, reachable func(raft.ServerID) bool) error {
+	var found bool
+	voters, inContact := 0, 0
+	for _, srv := range conf.Servers {
+		if srv.ID == id {
+			found = true
+		}
+		if srv.Suffrage == raft.Voter && srv.ID != id {
+			voters++
+			if reachable(srv.ID) {
+				inContact++
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w %q", ErrUnknownMember, id)
+	}
+	if voters == 0 {
+		return ErrLastVoter
+	}
+	if quorum := voters/2 + 1; inContact < quorum {
+		return fmt.Errorf("%w: %d of %d voters left reachable, quorum is %d", ErrNoQuorum, inContact, voters, quorum)
+	}
+
+	return nil
+}
+
+// reachable reports whether the leader heartbeats the member id, the
+// leader itself is.
+func (n *Node) reachable(id raft.ServerID) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return !n.unreachable[id]
+}
+
+// observe follows the heartbeats of the leader to its followers until Close.
+func (n *Node) observe() {
+	defer close(n.done)
+	for o := range n.observations {
+		n.mu.Lock()
+		switch data := o.Data.(type) {
+		case raft.FailedHeartbeatObservation:
+			n.unreachable[data.PeerID] = true
+		case raft.ResumedHeartbeatObservation:
+			delete(n.unreachable, data.PeerID)
+		case raft.PeerObservation:
+			if data.Removed {
+				delete(n.unreachable, data.Peer.ID)
+			}
+		case raft.LeaderObservation:
+			// a new leader heartbeats from scratch
+			clear(n.unreachable)
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) leaderErr(err error) error {
+	if errors.Is(err, raft.ErrNotLeader) {
+		addr, _ := n.LeaderWithID()
+		return fmt.Errorf("%w, leader is %q", err, addr)
+	}
+
+	return err
+}
+
+type errorFuture struct {
+	err error
+}
+
+func (f errorFuture) Error() error {
+	return f.err
+}
+
+func (f errorFuture) Index() uint64 {
+	return 0
+}
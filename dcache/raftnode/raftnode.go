@@ -0,0 +1,232 @@
+// Package raftnode runs a hashicorp/raft instance with its log and stable
+// store in a bolt file and its snapshots in files under a directory.
+package raftnode
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+
+	"github.com/dmitrorezn/dcache/crypt"
+)
+
+type Cfg struct {
+	ID string
+	// Addr is the address the transport listens on and advertises.
+	Addr string
+	Dir  string
+	// Peers bootstraps a new cluster, it is ignored once the node has state.
+	// Nodes missing in Peers wait to be added by the leader.
+	Peers          raft.Configuration
+	Timeout        time.Duration
+	SnapshotRetain int
+	// Keys encrypts the data of the log entries when set, snapshots are
+	// written by the FSM.
+	Keys crypt.KeyProvider
+	// TLS secures the connections between the nodes when set, it is used
+	// to both accept and dial them.
+	TLS *tls.Config
+
+	LogOutput io.Writer
+	LogLevel  string
+	LogJSON   bool
+}
+
+type Node struct {
+	*raft.Raft
+
+	id        raft.ServerID
+	transport *raft.NetworkTransport
+	store     *raftboltdb.BoltStore
+
+	observer     *raft.Observer
+	observations chan raft.Observation
+	done         chan struct{}
+	mu           sync.Mutex
+	// unreachable holds the followers the leader fails to heartbeat.
+	unreachable map[raft.ServerID]bool
+}
+
+// ReadPeers reads the bootstrap configuration, a JSON list of
+// {"id": "...", "address": "...", "non_voter": false} objects.
+func ReadPeers(path string) (raft.Configuration, error) {
+	cfg, err := raft.ReadConfigJSON(path)
+	if err != nil {
+		return raft.Configuration{}, fmt.Errorf("peers %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+func New(cfg Cfg, fsm raft.FSM) (*Node, error) {
+	if cfg.SnapshotRetain <= 0 {
+		cfg.SnapshotRetain = 2
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = os.Stderr
+	}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       "raft",
+		Level:      hclog.LevelFromString(cfg.LogLevel),
+		Output:     cfg.LogOutput,
+		JSONFormat: cfg.LogJSON,
+	})
+
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("bolt store: %w", err)
+	}
+	var stored raft.LogStore = store
+	if cfg.Keys != nil {
+		stored = &sealedLogs{LogStore: store, keys: cfg.Keys}
+	}
+	logs, err := raft.NewLogCache(512, stored)
+	if err != nil {
+		return nil, errors.Join(err, store.Close())
+	}
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(cfg.Dir, cfg.SnapshotRetain, logger)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("snapshot store: %w", err), store.Close())
+	}
+	transport, err := newTransport(cfg, logger)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("transport: %w", err), store.Close())
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.ID)
+	conf.Logger = logger
+
+	if err = bootstrap(cfg, conf, logs, store, snapshots, transport); err != nil {
+		return nil, errors.Join(err, transport.Close(), store.Close())
+	}
+	r, err := raft.NewRaft(conf, fsm, logs, store, snapshots, transport)
+	if err != nil {
+		return nil, errors.Join(err, transport.Close(), store.Close())
+	}
+
+	n := &Node{
+		Raft:         r,
+		id:           conf.LocalID,
+		transport:    transport,
+		store:        store,
+		observations: make(chan raft.Observation, 64),
+		done:         make(chan struct{}),
+		unreachable:  make(map[raft.ServerID]bool),
+	}
+	n.observer = raft.NewObserver(n.observations, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation,
+			raft.LeaderObservation, raft.PeerObservation:
+			return true
+		}
+		return false
+	})
+	r.RegisterObserver(n.observer)
+	go n.observe()
+
+	return n, nil
+}
+
+func newTransport(cfg Cfg, logger hclog.Logger) (*raft.NetworkTransport, error) {
+	if cfg.TLS == nil {
+		return raft.NewTCPTransportWithLogger(cfg.Addr, nil, 3, cfg.Timeout, logger)
+	}
+	stream, err := listenTLS(cfg.Addr, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return raft.NewNetworkTransportWithLogger(stream, 3, cfg.Timeout, logger), nil
+}
+
+func bootstrap(
+	cfg Cfg,
+	conf *raft.Config,
+	logs raft.LogStore,
+	stable raft.StableStore,
+	snapshots raft.SnapshotStore,
+	transport raft.Transport,
+) error {
+	exists, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil || exists {
+		return err
+	}
+	for _, srv := range cfg.Peers.Servers {
+		if srv.ID != conf.LocalID {
+			continue
+		}
+		if srv.Address != transport.LocalAddr() {
+			return fmt.Errorf("peers list %s at %s, but the node listens on %s", srv.ID, srv.Address, transport.LocalAddr())
+		}
+		return raft.BootstrapCluster(conf, logs, stable, snapshots, transport, cfg.Peers)
+	}
+
+	return nil
+}
+
+// Addr returns the address of the transport, which differs from Cfg.Addr
+// when that has port 0.
+func (n *Node) Addr() raft.ServerAddress {
+	return n.transport.LocalAddr()
+}
+
+// Ready returns nil once there is a leader and all committed entries are
+// applied, i.e. the log has been replayed after a start.
+func (n *Node) Ready() error {
+	if addr, _ := n.LeaderWithID(); addr == "" {
+		return errors.New("no leader")
+	}
+	if applied, commit := n.AppliedIndex(), n.CommitIndex(); applied < commit {
+		return fmt.Errorf("applied %d of %d entries", applied, commit)
+	}
+
+	return nil
+}
+
+// Close transfers leadership when leading, shuts raft down and closes the
+// transport and stores.
+func (n *Node) Close() error {
+	var err error
+	if n.State() == raft.Leader && len(n.voters()) > 1 {
+		err = n.LeadershipTransfer().Error()
+	}
+
+	n.DeregisterObserver(n.observer)
+	close(n.observations)
+	<-n.done
+
+	return errors.Join(
+		err,
+		n.Shutdown().Error(),
+		n.transport.Close(),
+		n.store.Close(),
+	)
+}
+
+func (n *Node) voters() []raft.Server {
+	f := n.GetConfiguration()
+	if f.Error() != nil {
+		return nil
+	}
+	var voters []raft.Server
+	for _, srv := range f.Configuration().Servers {
+		if srv.Suffrage == raft.Voter {
+			voters = append(voters, srv)
+		}
+	}
+
+	return voters
+}
@@ -0,0 +1,501 @@
+package raftnode
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/dmitrorezn/dcache/crypt"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+type testNode struct {
+	cfg   Cfg
+	node  *Node
+	store *storage.Storage
+	repl  *storage.ReplicatorStorage
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func (n *testNode) start(t *testing.T) {
+	t.Helper()
+	n.store = storage.New()
+	go n.store.Run(context.Background())
+
+	node, err := New(n.cfg, n.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.node = node
+	n.repl = storage.NewReplicator(n.store, node.Raft, 5*time.Second)
+}
+
+func (n *testNode) stop(t *testing.T) {
+	t.Helper()
+	if err := n.node.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.store.CloseAndWait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startCluster starts size voters, configure changes the config of every
+// node before it starts.
+func startCluster(t *testing.T, size int, configure ...func(*Cfg)) []*testNode {
+	t.Helper()
+	dir := t.TempDir()
+	var peers raft.Configuration
+	nodes := make([]*testNode, size)
+	for i := range nodes {
+		id := fmt.Sprintf("node%d", i)
+		nodes[i] = &testNode{
+			cfg: Cfg{
+				ID:        id,
+				Addr:      freeAddr(t),
+				Dir:       filepath.Join(dir, id),
+				Timeout:   time.Second,
+				LogOutput: io.Discard,
+			},
+		}
+		peers.Servers = append(peers.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(nodes[i].cfg.Addr),
+		})
+	}
+	for _, n := range nodes {
+		n.cfg.Peers = peers
+		for _, fn := range configure {
+			fn(&n.cfg)
+		}
+		n.start(t)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			if n.node != nil {
+				_ = n.node.Close()
+				_ = n.store.CloseAndWait()
+			}
+		}
+	})
+
+	return nodes
+}
+
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n.node != nil && n.node.State() == raft.Leader {
+				return n
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+
+	return nil
+}
+
+func set(ctx context.Context, s storage.IStorage, key, value string) error {
+	payload, slot := storage.NewPayload(key, len(value))
+	copy(slot, value)
+
+	return s.Set(ctx, storage.Command{Payload: payload})
+}
+
+func get(ctx context.Context, s storage.IStorage, key string) (string, error) {
+	var buf bytes.Buffer
+	err := s.Get(ctx, storage.Command{
+		Payload: storage.AppendKey(nil, key),
+		W:       &buf,
+	})
+
+	return buf.String(), err
+}
+
+func waitValue(t *testing.T, n *testNode, key, want string) {
+	t.Helper()
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := get(ctx, n.store, key)
+		if err == nil && got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s = %q, %v, want %q", n.cfg.ID, key, got, err, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a raft cluster")
+	}
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+
+	if err := set(ctx, leader.repl, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// acknowledged writes are applied on the leader
+	if got, err := get(ctx, leader.store, "a"); err != nil || got != "1" {
+		t.Fatalf("leader: a = %q, %v", got, err)
+	}
+	for _, n := range nodes {
+		waitValue(t, n, "a", "1")
+	}
+
+	rename := storage.Command{Payload: storage.AppendKey(storage.AppendKey(nil, "missing"), "b")}
+	if err := leader.repl.Rename(ctx, rename); !errors.Is(err, storage.ErrNIL) {
+		t.Fatalf("rename missing key: %v, want ErrNIL", err)
+	}
+
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+	if err := set(ctx, follower.repl, "b", "2"); !errors.Is(err, storage.ErrNotLeader) {
+		t.Fatalf("write to follower: %v, want ErrNotLeader", err)
+	}
+
+	// a restarted follower restores its snapshot and catches up on the log
+	if err := follower.node.Snapshot().Error(); err != nil {
+		t.Fatal(err)
+	}
+	follower.stop(t)
+	follower.node = nil
+	if err := set(ctx, leader.repl, "c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.repl.Del(ctx, storage.Command{Payload: storage.AppendKey(nil, "a")}); err != nil {
+		t.Fatal(err)
+	}
+	follower.start(t)
+	waitValue(t, follower, "c", "3")
+	if _, err := get(ctx, follower.store, "a"); !errors.Is(err, storage.ErrNIL) {
+		t.Fatalf("deleted key: %v, want ErrNIL", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.node.Ready() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("restarted follower not ready: %v", follower.node.Ready())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func suffrage(t *testing.T, n *testNode, id string) string {
+	t.Helper()
+	members, err := n.node.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range members {
+		if m.ID == id {
+			return m.Suffrage
+		}
+	}
+
+	return ""
+}
+
+func TestMembership(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a raft cluster")
+	}
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	if err := set(ctx, leader.repl, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	joining := &testNode{cfg: nodes[0].cfg}
+	joining.cfg.ID = "node3"
+	joining.cfg.Addr = freeAddr(t)
+	joining.cfg.Dir = filepath.Join(t.TempDir(), "node3")
+	joining.start(t)
+	t.Cleanup(func() {
+		_ = joining.node.Close()
+		_ = joining.store.CloseAndWait()
+	})
+
+	for _, n := range nodes {
+		if n != leader {
+			err := n.node.AddLearner("node3", joining.cfg.Addr, time.Second)
+			if !errors.Is(err, raft.ErrNotLeader) {
+				t.Fatalf("add on follower: %v, want ErrNotLeader", err)
+			}
+			break
+		}
+	}
+	if err := leader.node.AddLearner("node3", joining.cfg.Addr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitValue(t, joining, "a", "1")
+	if got := suffrage(t, leader, "node3"); got != raft.Nonvoter.String() {
+		t.Fatalf("learner suffrage %q", got)
+	}
+
+	if err := leader.node.AddVoter("node3", joining.cfg.Addr, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := suffrage(t, leader, "node3"); got != raft.Voter.String() {
+		t.Fatalf("promoted suffrage %q", got)
+	}
+	if err := leader.node.Demote("node3", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := suffrage(t, leader, "node3"); got != raft.Nonvoter.String() {
+		t.Fatalf("demoted suffrage %q", got)
+	}
+	if err := leader.node.Remove("node3", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := suffrage(t, leader, "node3"); got != "" {
+		t.Fatalf("removed member still has suffrage %q", got)
+	}
+	if err := leader.node.Remove("node3", time.Second); !errors.Is(err, ErrUnknownMember) {
+		t.Fatalf("remove unknown member: %v, want ErrUnknownMember", err)
+	}
+}
+
+func TestRemoveLastVoter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a raft cluster")
+	}
+	nodes := startCluster(t, 1)
+	leader := waitLeader(t, nodes)
+	if err := leader.node.Remove(leader.cfg.ID, time.Second); !errors.Is(err, ErrLastVoter) {
+		t.Fatalf("remove last voter: %v, want ErrLastVoter", err)
+	}
+	if err := leader.node.Demote(leader.cfg.ID, time.Second); !errors.Is(err, ErrLastVoter) {
+		t.Fatalf("demote last voter: %v, want ErrLastVoter", err)
+	}
+}
+
+func TestRemoveWithoutQuorum(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a raft cluster")
+	}
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	var followers []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+	down, up := followers[0], followers[1]
+	down.stop(t)
+	down.node = nil
+
+	// without down, removing up leaves the leader alone of two voters
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.node.reachable(raft.ServerID(down.cfg.ID)) {
+		if time.Now().After(deadline) {
+			t.Fatal("leader still reaches the stopped follower")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := leader.node.Remove(up.cfg.ID, time.Second); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("remove reachable voter: %v, want ErrNoQuorum", err)
+	}
+	if err := leader.node.Demote(up.cfg.ID, time.Second); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("demote reachable voter: %v, want ErrNoQuorum", err)
+	}
+	if err := leader.node.Remove(down.cfg.ID, time.Second); err != nil {
+		t.Fatalf("remove unreachable voter: %v", err)
+	}
+}
+
+func TestReadConsistency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a raft cluster")
+	}
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	if err := set(ctx, leader.repl, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(n *testNode, c storage.Consistency, maxLag time.Duration) (string, error) {
+		var buf bytes.Buffer
+		err := n.repl.Get(ctx, storage.Command{
+			Payload:     storage.AppendKey(nil, "a"),
+			W:           &buf,
+			Consistency: c,
+			MaxLag:      maxLag,
+		})
+		return buf.String(), err
+	}
+	for _, c := range []storage.Consistency{storage.Stale, storage.Bounded, storage.LeaderLease, storage.Linearizable} {
+		if got, err := read(leader, c, 0); err != nil || got != "1" {
+			t.Fatalf("%s read on leader: %q, %v", c, got, err)
+		}
+	}
+
+	var follower *testNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+	waitValue(t, follower, "a", "1")
+	for _, c := range []storage.Consistency{storage.LeaderLease, storage.Linearizable} {
+		if _, err := read(follower, c, 0); !errors.Is(err, storage.ErrNotLeader) {
+			t.Fatalf("%s read on follower: %v, want ErrNotLeader", c, err)
+		}
+	}
+	if got, err := read(follower, storage.Bounded, 5*time.Second); err != nil || got != "1" {
+		t.Fatalf("bounded read on follower: %q, %v", got, err)
+	}
+
+	// without a leader the lag of the follower grows past the bound, shut
+	// the leader down without handing over leadership
+	if err := leader.node.Shutdown().Error(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := read(follower, storage.Bounded, time.Nanosecond); !errors.Is(err, storage.ErrStaleRead) {
+		t.Fatalf("bounded read on lagging follower: %v, want ErrStaleRead", err)
+	}
+}
+
+type testKeys crypt.Key
+
+func (k testKeys) Current() (crypt.Key, error) {
+	return crypt.Key(k), nil
+}
+
+func (k testKeys) Key(id string) (crypt.Key, error) {
+	if id != k.ID {
+		return crypt.Key{}, crypt.ErrUnknownKey
+	}
+	return crypt.Key(k), nil
+}
+
+// testTLS returns a config trusting a single self-signed certificate for
+// 127.0.0.1, presented and required on both ends.
+func testTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "raft"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestEncryptedCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a raft cluster")
+	}
+	ctx := context.Background()
+	keys := testKeys{ID: "1", Bytes: bytes.Repeat([]byte{7}, crypt.KeySize)}
+	config := testTLS(t)
+	nodes := startCluster(t, 3, func(cfg *Cfg) {
+		cfg.Keys = keys
+		cfg.TLS = config
+	})
+	leader := waitLeader(t, nodes)
+
+	const value = "plaintext-value-in-the-raft-log"
+	if err := set(ctx, leader.repl, "a", value); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		waitValue(t, n, "a", value)
+	}
+
+	// a node restarted from its log reads the sealed entries back
+	leader.stop(t)
+	leader.node = nil
+	raw, err := os.ReadFile(filepath.Join(leader.cfg.Dir, "raft.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte(value)) {
+		t.Fatal("raft log keeps the value in the clear")
+	}
+	leader.start(t)
+	waitValue(t, leader, "a", value)
+
+	// a node without the certificate is refused
+	stream := &tlsStream{config: &tls.Config{InsecureSkipVerify: true}}
+	conn, err := stream.Dial(nodes[1].node.Addr(), time.Second)
+	if err == nil {
+		// a TLS 1.3 client learns it was refused on its first read
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("dial without a certificate: %v", err)
+	}
+}
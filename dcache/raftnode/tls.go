@@ -0,0 +1,37 @@
+package raftnode
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// tlsStream is a raft stream layer over TLS, config is used on both ends
+// of the connections so it must have a certificate and verify the peers.
+type tlsStream struct {
+	net.Listener
+	config *tls.Config
+}
+
+func listenTLS(addr string, config *tls.Config) (*tlsStream, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// the address is advertised to the peers, like by the TCP transport
+	if tcp, ok := ln.Addr().(*net.TCPAddr); !ok || tcp.IP == nil || tcp.IP.IsUnspecified() {
+		return nil, errors.Join(errors.New("local bind address is not advertisable"), ln.Close())
+	}
+
+	return &tlsStream{
+		Listener: tls.NewListener(ln, config),
+		config:   config,
+	}, nil
+}
+
+func (s *tlsStream) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", string(address), s.config)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/dmitrorezn/dcache/logging"
+)
+
+// reloader reloads the config on SIGHUP or POST /admin/reload and applies
+// the settings that can be changed while running. apply must not change
+// anything when it fails, the config in effect stays the previous one.
+type reloader struct {
+	loader *cfgLoader
+	apply  func(ctx context.Context, cfg Cfg) error
+	log    *slog.Logger
+
+	mu  sync.Mutex
+	cfg atomic.Pointer[Cfg]
+}
+
+func newReloader(loader *cfgLoader, cfg Cfg, apply func(context.Context, Cfg) error, log *slog.Logger) *reloader {
+	r := &reloader{
+		loader: loader,
+		apply:  apply,
+		log:    log,
+	}
+	r.cfg.Store(&cfg)
+
+	return r
+}
+
+// Cfg returns the config currently in effect.
+func (r *reloader) Cfg() Cfg {
+	return *r.cfg.Load()
+}
+
+type ReloadResult struct {
+	// Changed lists the settings applied.
+	Changed []string `json:"changed"`
+	// Restart lists changed settings that need a restart to take effect.
+	Restart []string `json:"restart,omitempty"`
+}
+
+func (r *reloader) Reload(ctx context.Context) (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.loader.Load()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	cfg, changed, restart := r.Cfg().Reload(next)
+	if err = r.apply(ctx, cfg); err != nil {
+		return ReloadResult{}, err
+	}
+	r.cfg.Store(&cfg)
+
+	r.log.Info("config reloaded", "changed", changed)
+	if len(restart) > 0 {
+		r.log.Warn("config changes need a restart", "settings", restart)
+	}
+
+	return ReloadResult{
+		Changed: changed,
+		Restart: restart,
+	}, nil
+}
+
+// Watch reloads the config on SIGHUP until ctx is done.
+func (r *reloader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if _, err := r.Reload(ctx); err != nil {
+				r.log.Error("config reload", "err", err)
+			}
+		}
+	}
+}
+
+func handleReload(r *reloader) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		res, err := r.Reload(req.Context())
+		if err != nil {
+			var status = http.StatusBadRequest
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(rw).Encode(res); err != nil {
+			logging.FromContext(req.Context()).Warn("encode reload result", "err", err)
+		}
+	}
+}
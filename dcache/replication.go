@@ -0,0 +1,665 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthdm/hollywood/actor"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/storage"
+	"github.com/dmitrorezn/dcache/tracing"
+)
+
+type ReplicationCfg struct {
+	// Origin identifies the node to the receivers of its commands.
+	Origin      string
+	Compression storage.Compression
+	// RetryMin and RetryMax bound the backoff of resending unacknowledged
+	// commands.
+	RetryMin time.Duration
+	RetryMax time.Duration
+	// MaxUnacked is the number of unacknowledged commands kept per peer,
+	// further ones are hinted, or the oldest given up without Hints.
+	MaxUnacked int
+	// BatchSize and BatchBytes bound the commands sent in one message,
+	// Linger is how long a batch waits for more commands before it is sent
+	// anyway.
+	BatchSize  int
+	BatchBytes int
+	Linger     time.Duration
+	// Hints, if set, keeps the commands of disconnected peers until they
+	// join again.
+	Hints *Hints
+	// Replicas, if set, returns the ids of the members a command is sent
+	// to, every peer gets the commands it returns nil for.
+	Replicas func(cmd storage.Command) []string
+	Logger   *slog.Logger
+}
+
+// Replication sends the commands of the node to every peer as an ordered
+// stream: the commands of a stream are numbered without gaps, sent in
+// batches and applied by the receiver in order, which acknowledges the
+// highest sequence number applied. Unacknowledged commands are resent from
+// the first one after a backoff, or at once when the receiver saw a gap.
+// The commands of a disconnected peer, or of one too far behind, are hinted
+// and put back in its stream once it caught up.
+//
+// Replication is shared by the Server instances of a node.
+type Replication struct {
+	commands chan storage.Command
+	peers    *peerTable
+	cfg      ReplicationCfg
+
+	// epoch tells the streams of a restarted node from the ones of its
+	// previous run.
+	epoch   int64
+	once    sync.Once
+	started atomic.Bool
+	done    chan struct{}
+
+	mu       sync.Mutex
+	ctx      context.Context
+	send     func(pid *actor.PID, batch *clusterpb.ReplicateBatch)
+	streams  map[string]*stream
+	received map[string]*window
+
+	batches atomic.Uint64
+	retries atomic.Uint64
+	failed  atomic.Uint64
+	lost    atomic.Uint64
+}
+
+func NewReplication(commands chan storage.Command, cfg ReplicationCfg) *Replication {
+	if cfg.RetryMin <= 0 {
+		cfg.RetryMin = 200 * time.Millisecond
+	}
+	if cfg.RetryMax < cfg.RetryMin {
+		cfg.RetryMax = cfg.RetryMin
+	}
+	if cfg.MaxUnacked <= 0 {
+		cfg.MaxUnacked = 10000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 128
+	}
+	if cfg.BatchBytes <= 0 {
+		cfg.BatchBytes = storage.DefaultChunkSize
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	return &Replication{
+		commands: commands,
+		peers:    newPeerTable(),
+		cfg:      cfg,
+		epoch:    time.Now().UnixNano(),
+		done:     make(chan struct{}),
+		streams:  make(map[string]*stream),
+		received: make(map[string]*window),
+	}
+}
+
+// stream holds the commands sent to a peer and not acknowledged yet: queue
+// has the sequence numbers base+1, base+2... up to next, everything up to
+// base was acknowledged or given up.
+type stream struct {
+	// id is the member id of the peer, its hints are kept under it.
+	id        string
+	pid       *actor.PID
+	connected bool
+	running   bool
+	wake      chan struct{}
+	left      time.Time
+	// hinted is set while the commands following the queue are hinted.
+	hinted bool
+	// adding counts the commands being hinted and refilling is set while
+	// hints are read, both without r.mu, hinted stays set meanwhile so
+	// the hints are read back in order.
+	adding    int
+	refilling bool
+	// dropped counts the commands not kept for the peer since it left,
+	// without hints or after they expired.
+	dropped uint64
+
+	queue []queued
+	base  uint64
+	next  uint64
+	// sent is the last sequence number sent since the stream was last
+	// rewound to base.
+	sent uint64
+	// progress is when the peer last acknowledged a command, or when the
+	// oldest command in flight was sent.
+	progress time.Time
+	rewound  time.Time
+	attempts int
+}
+
+type queued struct {
+	cmd *clusterpb.Command
+	at  time.Time
+}
+
+func (st *stream) notify() {
+	select {
+	case st.wake <- struct{}{}:
+	default:
+	}
+}
+
+// rewind makes the stream send again from the oldest unacknowledged command.
+func (st *stream) rewind(now time.Time) {
+	st.sent = st.base
+	st.rewound = now
+}
+
+func (r *Replication) backoff(attempts int) time.Duration {
+	d := r.cfg.RetryMin << min(attempts, 16)
+
+	return min(d, r.cfg.RetryMax)
+}
+
+// Start dispatches the queued commands to the streams of the connected
+// peers and sends the streams with send until the queue is closed and
+// drained or ctx is done.
+func (r *Replication) Start(ctx context.Context, send func(pid *actor.PID, batch *clusterpb.ReplicateBatch)) {
+	r.mu.Lock()
+	r.ctx, r.send = ctx, send
+	for _, st := range r.streams {
+		r.spawn(st)
+	}
+	r.mu.Unlock()
+	r.started.Store(true)
+
+	go func() {
+		defer close(r.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case cmd, ok := <-r.commands:
+				if !ok {
+					return
+				}
+				r.dispatch(ctx, cmd)
+			}
+		}
+	}()
+}
+
+// spawn starts the sender of st once Start was called, r.mu must be held.
+func (r *Replication) spawn(st *stream) {
+	if st.running || r.send == nil {
+		return
+	}
+	st.running = true
+	go r.sendStream(r.ctx, st, r.send)
+}
+
+// dispatch appends cmd to the streams of the connected peers, or of its
+// replicas.
+func (r *Replication) dispatch(ctx context.Context, cmd storage.Command) {
+	payload, codec := r.cfg.Compression.Encode(cmd.Payload)
+	var replicas []string
+	if r.cfg.Replicas != nil {
+		replicas = r.cfg.Replicas(cmd)
+	}
+
+	ctx, span := tracer.Start(tracing.Extract(ctx, cmd.Trace), "replication.dispatch",
+		trace.WithSpanKind(trace.SpanKindProducer),
+	)
+	defer span.End()
+
+	// the hints are written once r.mu is released
+	var hints []streamHint
+	defer func() {
+		for _, h := range hints {
+			r.hint(h)
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	span.SetAttributes(attribute.Int("peers", len(r.streams)))
+	now := time.Now()
+	carrier := tracing.Inject(ctx)
+	for addr, st := range r.streams {
+		if replicas != nil && !slices.Contains(replicas, st.id) {
+			continue
+		}
+		q := queued{at: now, cmd: &clusterpb.Command{
+			Cmd:       int32(cmd.Cmd),
+			Codec:     int32(codec),
+			Namespace: cmd.Namespace,
+			Payload:   payload,
+			Trace:     carrier,
+			Modified:  cmd.Modified,
+		}}
+		if r.hinting(st, now) {
+			st.adding++
+			hints = append(hints, streamHint{addr: addr, id: st.id, st: st, q: q})
+			continue
+		}
+		if !st.connected {
+			if st.dropped == 0 {
+				r.cfg.Logger.Warn("peer disconnected, dropping its commands until it joins again",
+					"peer", addr, "hints", r.cfg.Hints != nil)
+			}
+			st.dropped++
+			r.lost.Add(1)
+			r.peers.lost(addr, 1)
+			continue
+		}
+		st.next++
+		q.cmd.Seq = st.next
+		st.queue = append(st.queue, q)
+		if len(st.queue) > r.cfg.MaxUnacked {
+			lost := st.queue[0].cmd
+			st.queue = st.queue[1:]
+			st.base++
+			st.sent = max(st.sent, st.base)
+			r.lost.Add(1)
+			r.peers.lost(addr, 1)
+			r.cfg.Logger.Error("too many unacknowledged commands, giving up the oldest",
+				"peer", addr, "seq", lost.GetSeq(), "cmd", storage.Cmd(lost.GetCmd()), "namespace", lost.GetNamespace())
+		}
+		st.notify()
+	}
+}
+
+// hinting reports whether the commands of st are hinted, r.mu must be held.
+// A peer disconnected for longer than the hints are kept gets none.
+func (r *Replication) hinting(st *stream, now time.Time) bool {
+	switch {
+	case r.cfg.Hints == nil:
+		return false
+	case !st.connected:
+		return now.Sub(st.left) <= r.cfg.Hints.cfg.MaxAge
+	}
+
+	return st.hinted || len(st.queue) >= r.cfg.MaxUnacked
+}
+
+// streamHint is a command to hint for the stream st of the member id at
+// addr.
+type streamHint struct {
+	addr string
+	id   string
+	st   *stream
+	q    queued
+}
+
+// hint keeps h.q until the peer takes it, r.mu must not be held and
+// h.st.adding must have been incremented for it.
+func (r *Replication) hint(h streamHint) {
+	dropped, err := r.cfg.Hints.add(h.id, h.q)
+	if err != nil {
+		r.cfg.Logger.Error("hinting commands", "peer", h.addr, "err", err)
+	}
+	if dropped > 0 {
+		r.lost.Add(uint64(dropped))
+		r.peers.lost(h.addr, dropped)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h.st.adding--
+	if dropped == 0 {
+		h.st.hinted = true
+	}
+}
+
+// refill moves the hints of st to its queue. r.mu must be held, it is
+// released while the hints are read.
+func (r *Replication) refill(st *stream, now time.Time) {
+	st.refilling = true
+	id, n := st.id, r.cfg.MaxUnacked-len(st.queue)
+	r.mu.Unlock()
+	hints, done, err := r.cfg.Hints.next(id, n, now)
+	r.mu.Lock()
+	st.refilling = false
+
+	if err != nil {
+		r.cfg.Logger.Error("reading hints", "peer", st.pid.GetAddress(), "err", err)
+	}
+	for _, q := range hints {
+		st.next++
+		q.cmd.Seq = st.next
+		st.queue = append(st.queue, q)
+	}
+	if (done || err != nil) && st.adding == 0 {
+		st.hinted = false
+	}
+	if !st.connected {
+		// left meanwhile, the queue is hinted now that it has the hints
+		r.hintQueue(st)
+	}
+}
+
+// sendStream sends the batches of st until ctx is done.
+func (r *Replication) sendStream(ctx context.Context, st *stream, send func(pid *actor.PID, batch *clusterpb.ReplicateBatch)) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		batch, pid, wait := r.nextBatch(st, time.Now())
+		if batch != nil {
+			send(pid, batch)
+			r.batches.Add(1)
+			r.peers.sent(pid.GetAddress(), len(batch.Commands))
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-st.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// nextBatch returns the next batch to send to st, or how long to wait for
+// one.
+func (r *Replication) nextBatch(st *stream, now time.Time) (*clusterpb.ReplicateBatch, *actor.PID, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	const idle = time.Minute
+	if !st.connected {
+		return nil, nil, idle
+	}
+	if st.hinted && len(st.queue) <= r.cfg.MaxUnacked/2 {
+		r.refill(st, now)
+		if !st.connected {
+			return nil, nil, idle
+		}
+	}
+	inFlight := st.sent > st.base
+	if inFlight && !now.Before(st.progress.Add(r.backoff(st.attempts))) {
+		r.retries.Add(st.sent - st.base)
+		r.peers.retried(st.pid.GetAddress(), int(st.sent-st.base))
+		st.rewind(now)
+		st.attempts++
+		inFlight = false
+	}
+
+	pending := st.queue[st.sent-st.base:]
+	if len(pending) == 0 {
+		if inFlight {
+			return nil, nil, st.progress.Add(r.backoff(st.attempts)).Sub(now)
+		}
+		return nil, nil, idle
+	}
+
+	n, size := 0, 0
+	for n < len(pending) && n < r.cfg.BatchSize {
+		size += len(pending[n].cmd.Payload)
+		if n > 0 && size > r.cfg.BatchBytes {
+			break
+		}
+		n++
+	}
+	full := n < len(pending) || n == r.cfg.BatchSize || size >= r.cfg.BatchBytes
+	if linger := pending[0].at.Add(r.cfg.Linger); !full && now.Before(linger) {
+		return nil, nil, linger.Sub(now)
+	}
+
+	batch := &clusterpb.ReplicateBatch{
+		Version:  clusterpb.Version,
+		Origin:   r.cfg.Origin,
+		Epoch:    r.epoch,
+		Base:     st.base,
+		Commands: make([]*clusterpb.Command, n),
+	}
+	for i := range batch.Commands {
+		batch.Commands[i] = pending[i].cmd
+	}
+	if !inFlight {
+		st.progress = now
+	}
+	st.sent += uint64(n)
+
+	return batch, st.pid, 0
+}
+
+// join starts replicating to the member id at pid, resending the commands
+// it did not acknowledge and the ones hinted while disconnected.
+func (r *Replication) join(id string, pid *actor.PID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st, ok := r.streams[pid.GetAddress()]
+	if !ok {
+		st = &stream{wake: make(chan struct{}, 1)}
+		r.streams[pid.GetAddress()] = st
+	}
+	st.id = id
+	st.pid = pid
+	if r.cfg.Hints != nil && r.cfg.Hints.pending(id) {
+		st.hinted = true
+	}
+	if st.dropped > 0 {
+		r.cfg.Logger.Warn("peer joined after commands were dropped, anti-entropy repairs them",
+			"peer", pid.GetAddress(), "dropped", st.dropped)
+		st.dropped = 0
+	}
+	st.connected = true
+	st.attempts = 0
+	st.rewind(time.Now())
+	r.spawn(st)
+	st.notify()
+}
+
+// leave stops sending to the peer at addr, its unacknowledged commands are
+// hinted, or kept in memory without Hints, and resent when it joins again.
+func (r *Replication) leave(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st, ok := r.streams[addr]
+	if !ok || !st.connected {
+		return
+	}
+	st.connected = false
+	st.left = time.Now()
+	if !st.refilling {
+		// otherwise the refill hints the queue with the hints it read
+		r.hintQueue(st)
+	}
+}
+
+// hintQueue puts the unacknowledged commands of the disconnected st before
+// its hints, r.mu must be held.
+func (r *Replication) hintQueue(st *stream) {
+	if r.cfg.Hints == nil || len(st.queue) == 0 {
+		return
+	}
+	// the hints get the same sequence numbers again, so the peer skips
+	// the ones it applied
+	if err := r.cfg.Hints.prepend(st.id, st.queue); err != nil {
+		r.cfg.Logger.Error("hinting unacknowledged commands", "peer", st.pid.GetAddress(), "commands", len(st.queue), "err", err)
+		return
+	}
+	st.hinted = true
+	st.queue, st.next, st.sent = nil, st.base, st.base
+}
+
+// targets returns the connected peers.
+func (r *Replication) targets() []*actor.PID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pids := make([]*actor.PID, 0, len(r.streams))
+	for _, st := range r.streams {
+		if st.connected {
+			pids = append(pids, st.pid)
+		}
+	}
+
+	return pids
+}
+
+// ack processes the acknowledgement of the peer at addr. Commands the peer
+// failed to apply are not resent, retrying would fail again, those it could
+// not apply yet are reported as a gap and resent.
+func (r *Replication) ack(addr string, ack *clusterpb.ReplicateAck) {
+	if ack.GetEpoch() != r.epoch {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	st, ok := r.streams[addr]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	acked := 0
+	if ack.GetSeq() > st.base {
+		acked = int(min(ack.GetSeq(), st.next) - st.base)
+		st.queue = st.queue[acked:]
+		st.base += uint64(acked)
+		st.sent = max(st.sent, st.base)
+		st.progress = now
+		st.attempts = 0
+	}
+	// every batch in flight after a missing one reports the gap, rewind
+	// once for all of them
+	if ack.GetGap() && st.sent > st.base && now.Sub(st.rewound) >= r.cfg.RetryMin {
+		st.rewind(now)
+		st.notify()
+	}
+	if acked > 0 && st.hinted {
+		st.notify()
+	}
+	r.mu.Unlock()
+
+	if acked > 0 {
+		r.peers.acked(addr, acked)
+	}
+	for _, e := range ack.GetErrors() {
+		r.failed.Add(1)
+		r.peers.failed(addr, e.GetErr())
+		r.cfg.Logger.Error("peer failed to apply replicated command", "peer", addr, "seq", e.GetSeq(), "err", e.GetErr())
+	}
+}
+
+// unacked returns the number of unacknowledged commands of the peer at addr,
+// or of all peers if addr is empty.
+func (r *Replication) unacked(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for a, st := range r.streams {
+		if addr == "" || a == addr {
+			n += len(st.queue)
+		}
+	}
+
+	return n
+}
+
+// window is the last sequence number applied of the stream of an origin.
+type window struct {
+	mu    sync.Mutex
+	epoch int64
+	low   uint64
+}
+
+// window returns the window of the stream of origin, locked, or nil for a
+// stream of an earlier epoch.
+func (r *Replication) window(origin string, epoch int64) *window {
+	r.mu.Lock()
+	w, ok := r.received[origin]
+	if !ok {
+		w = &window{epoch: epoch}
+		r.received[origin] = w
+	}
+	r.mu.Unlock()
+
+	w.mu.Lock()
+	switch {
+	case epoch < w.epoch:
+		w.mu.Unlock()
+		return nil
+	case epoch > w.epoch:
+		w.epoch, w.low = epoch, 0
+	}
+
+	return w
+}
+
+// Close closes the hints, once the streams are stopped.
+func (r *Replication) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cfg.Hints == nil {
+		return nil
+	}
+
+	return r.cfg.Hints.Close()
+}
+
+var errNotStarted = errors.New("replication not started")
+
+// Drain waits until the queue, which has to be closed first, is dispatched
+// and the connected peers acknowledged it, or ctx is done.
+func (r *Replication) Drain(ctx context.Context) error {
+	if !r.started.Load() {
+		if n := len(r.commands); n > 0 {
+			return fmt.Errorf("%d commands not replicated: %w", n, errNotStarted)
+		}
+		return nil
+	}
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return fmt.Errorf("%d commands not replicated: %w", len(r.commands), ctx.Err())
+	}
+
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		n := r.connectedUnacked()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d commands not acknowledged: %w", n, ctx.Err())
+		}
+	}
+}
+
+func (r *Replication) connectedUnacked() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, st := range r.streams {
+		if st.connected {
+			n += len(st.queue)
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/hollywood/actor"
+
+	"github.com/dmitrorezn/dcache/clusterpb"
+	"github.com/dmitrorezn/dcache/storage"
+)
+
+func TestDispatchDisconnected(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hints, err := NewHints(HintsCfg{Dir: t.TempDir(), MaxBytes: 1 << 20, MaxAge: time.Minute, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = hints.Close() })
+
+	for _, tc := range []struct {
+		name  string
+		hints *Hints
+	}{
+		{name: "without hints"},
+		{name: "hints expired", hints: hints},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewReplication(nil, ReplicationCfg{Hints: tc.hints, Logger: logger})
+			r.streams["peer"] = &stream{
+				id:   "peer",
+				wake: make(chan struct{}, 1),
+				left: time.Now().Add(-2 * time.Minute),
+			}
+			cmd := storage.Command{Cmd: storage.Set, Payload: storage.AppendKey(nil, "k")}
+			r.dispatch(context.Background(), cmd)
+			r.dispatch(context.Background(), cmd)
+
+			if lost := r.lost.Load(); lost != 2 {
+				t.Fatalf("lost %d commands, want 2", lost)
+			}
+			peers := r.peers.list()
+			if len(peers) != 1 || peers[0].Lost != 2 {
+				t.Fatalf("peers %+v, want 2 lost", peers)
+			}
+		})
+	}
+}
+
+// TestHintsRefillOrder dispatches commands while the stream reads its hints
+// back, the peer must get every command once and in order.
+func TestHintsRefillOrder(t *testing.T) {
+	const hinted, dispatched = 50, 200
+	h := newTestHints(t, HintsCfg{})
+	addHints(t, h, 0, hinted, time.Now())
+	r := NewReplication(nil, ReplicationCfg{
+		Hints:      h,
+		MaxUnacked: 8,
+		BatchSize:  4,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	st := &stream{id: hintPeer, pid: actor.NewPID("peer:4000", "server/peer"), wake: make(chan struct{}, 1), connected: true, hinted: true}
+	r.streams["peer:4000"] = st
+
+	go func() {
+		for i := hinted; i < hinted+dispatched; i++ {
+			r.dispatch(context.Background(), storage.Command{Cmd: storage.Set, Payload: []byte(fmt.Sprintf("%03d", i))})
+		}
+	}()
+	var got []string
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got) < hinted+dispatched && time.Now().Before(deadline) {
+		batch, _, _ := r.nextBatch(st, time.Now())
+		if batch == nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		for _, c := range batch.GetCommands() {
+			got = append(got, string(c.GetPayload()))
+		}
+		last := batch.GetCommands()[len(batch.GetCommands())-1]
+		r.ack("peer:4000", &clusterpb.ReplicateAck{Epoch: r.epoch, Seq: last.GetSeq()})
+	}
+	if want := payloads(0, hinted+dispatched); !slices.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+}
+
+// TestReplicationOrder sends a Set and a Del of the same keys through a
+// stream losing batches, the receiver must apply them in order whatever the
+// batches and retries.
+func TestReplicationOrder(t *testing.T) {
+	const (
+		addr       = "peer:4000"
+		batchSize  = 4
+		batchBytes = 64
+		linger     = 5 * time.Millisecond
+		// every command has the same time, the last one applied wins
+		modified = 1
+	)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := NewReplication(nil, ReplicationCfg{
+		Origin:     "origin",
+		RetryMin:   time.Nanosecond,
+		RetryMax:   time.Nanosecond,
+		BatchSize:  batchSize,
+		BatchBytes: batchBytes,
+		Linger:     linger,
+		Logger:     logger,
+	})
+	st := &stream{id: "peer", pid: actor.NewPID(addr, "server/peer"), wake: make(chan struct{}, 1), connected: true}
+	r.streams[addr] = st
+
+	receiver := newTestServer(0, 0)
+	receiver.repl = NewReplication(nil, ReplicationCfg{Logger: logger})
+	store := storage.New()
+	go store.Run(context.Background())
+	t.Cleanup(func() { _ = store.CloseAndWait() })
+	receiver.store = store
+
+	want := make(map[string]string)
+	cmd := func(c storage.Cmd, key, value string) {
+		r.dispatch(context.Background(), storage.Command{
+			Cmd:      c,
+			Payload:  append(storage.AppendKey(nil, key), value...),
+			Modified: modified,
+		})
+		if c == storage.Set {
+			want[key] = value
+		} else {
+			delete(want, key)
+		}
+	}
+
+	var (
+		now                       = time.Now()
+		sent                      int
+		dropped                   = make(map[uint64]bool)
+		lingered, bySize, byBytes int
+	)
+	deliver := func() {
+		// the commands were just queued, a batch that is not full lingers
+		now = time.Now()
+		for i := 0; r.unacked(addr) > 0; i++ {
+			if i > 10000 {
+				t.Fatalf("%d commands never acknowledged", r.unacked(addr))
+			}
+			batch, _, wait := r.nextBatch(st, now)
+			if batch == nil {
+				if pending := st.queue[st.sent-st.base:]; len(pending) > 0 {
+					// only a batch that is not full lingers
+					size := 0
+					for _, q := range pending {
+						size += len(q.cmd.GetPayload())
+					}
+					if len(pending) >= batchSize || size >= batchBytes {
+						t.Fatalf("full batch of %d commands, %d bytes held back", len(pending), size)
+					}
+					lingered++
+				}
+				now = now.Add(wait)
+				continue
+			}
+
+			cmds := batch.GetCommands()
+			size := 0
+			for _, c := range cmds {
+				size += len(c.GetPayload())
+			}
+			switch next := st.queue[st.sent-st.base:]; {
+			case len(cmds) > batchSize:
+				t.Fatalf("batch of %d commands", len(cmds))
+			case len(cmds) > 1 && size > batchBytes:
+				t.Fatalf("batch of %d bytes", size)
+			case len(cmds) == batchSize:
+				bySize++
+			case len(next) > 0 && size+len(next[0].cmd.GetPayload()) > batchBytes:
+				byBytes++
+			}
+
+			// lose every third batch the first time it is sent
+			sent++
+			if first := cmds[0].GetSeq(); sent%3 == 0 && !dropped[first] {
+				dropped[first] = true
+				continue
+			}
+			r.ack(addr, receiver.receive(context.Background(), batch))
+		}
+	}
+
+	// Set and Del alternate on a few keys, with values of every size
+	for round := 0; round < 6; round++ {
+		for k := 0; k < 5; k++ {
+			key := fmt.Sprintf("k%d", k)
+			cmd(storage.Set, key, strings.Repeat(string(rune('a'+round)), 1+(round*7+k*13)%40))
+			cmd(storage.Del, key, "")
+			if (round+k)%2 == 0 {
+				cmd(storage.Set, key, fmt.Sprintf("last %d", round))
+			}
+		}
+		if round%2 == 0 {
+			// the others are sent along with the next round
+			deliver()
+		}
+	}
+	deliver()
+
+	if len(dropped) == 0 || lingered == 0 || bySize == 0 || byBytes == 0 {
+		t.Fatalf("limits not exercised: %d dropped, %d lingered, %d full by count, %d by bytes",
+			len(dropped), lingered, bySize, byBytes)
+	}
+	for k := 0; k < 5; k++ {
+		key := fmt.Sprintf("k%d", k)
+		var out bytes.Buffer
+		err := store.Get(context.Background(), storage.Command{Payload: storage.AppendKey(nil, key), W: &out})
+		v, ok := want[key]
+		switch {
+		case !ok && !errors.Is(err, storage.ErrNIL):
+			t.Errorf("%s: got %q, %v, want it deleted", key, out.String(), err)
+		case ok && (err != nil || out.String() != v):
+			t.Errorf("%s: got %q, %v, want %q", key, out.String(), err, v)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Package ring maps keys to cluster members with consistent hashing. Every
+// member owns VNodes tokens on a 64 bit ring and a key belongs to the
+// members of the first tokens following its hash, so adding or removing a
+// member only moves the keys of the ranges next to its tokens.
+package ring
+
+import (
+	"slices"
+	"strconv"
+)
+
+// Member is a node of the ring.
+type Member struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+}
+
+type token struct {
+	hash   uint64
+	member int
+}
+
+// Ring is an immutable consistent hash ring.
+type Ring struct {
+	vnodes  int
+	members []Member
+	tokens  []token
+}
+
+// New returns the ring of members with vnodes tokens each. Members are
+// identified by ID, the ring is the same whatever their order.
+func New(vnodes int, members ...Member) *Ring {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	members = slices.Clone(members)
+	slices.SortFunc(members, func(a, b Member) int {
+		switch {
+		case a.ID < b.ID:
+			return -1
+		case a.ID > b.ID:
+			return 1
+		}
+		return 0
+	})
+	members = slices.CompactFunc(members, func(a, b Member) bool {
+		return a.ID == b.ID
+	})
+
+	r := &Ring{
+		vnodes:  vnodes,
+		members: members,
+		tokens:  make([]token, 0, vnodes*len(members)),
+	}
+	for i, m := range members {
+		for v := 0; v < vnodes; v++ {
+			r.tokens = append(r.tokens, token{hash: Hash(m.ID + "#" + strconv.Itoa(v)), member: i})
+		}
+	}
+	slices.SortFunc(r.tokens, func(a, b token) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		// a collision is settled the same way on every node
+		return a.member - b.member
+	})
+
+	return r
+}
+
+// Hash returns the position of s on the ring: FNV-1a finished with the
+// murmur3 mixer, FNV alone leaves similar keys close to each other.
+func Hash(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
+
+// VNodes returns the tokens per member.
+func (r *Ring) VNodes() int {
+	return r.vnodes
+}
+
+// Members returns the members sorted by ID.
+func (r *Ring) Members() []Member {
+	return slices.Clone(r.members)
+}
+
+// Equal reports whether both rings place the keys the same way.
+func (r *Ring) Equal(other *Ring) bool {
+	return r.vnodes == other.vnodes && slices.Equal(r.members, other.members)
+}
+
+// Owners returns the n members keeping key, the first one is its primary
+// owner. It returns fewer when the ring has fewer members.
+func (r *Ring) Owners(key string, n int) []Member {
+	n = min(n, len(r.members))
+	if n <= 0 {
+		return nil
+	}
+	h := Hash(key)
+	i, _ := slices.BinarySearchFunc(r.tokens, h, func(t token, h uint64) int {
+		switch {
+		case t.hash < h:
+			return -1
+		case t.hash > h:
+			return 1
+		}
+		return 0
+	})
+
+	owners := make([]Member, 0, n)
+	seen := make([]bool, len(r.members))
+	for j := 0; len(owners) < n; j++ {
+		t := r.tokens[(i+j)%len(r.tokens)]
+		if !seen[t.member] {
+			seen[t.member] = true
+			owners = append(owners, r.members[t.member])
+		}
+	}
+
+	return owners
+}
+
+// Owns reports whether the member id is one of the n owners of key.
+func (r *Ring) Owns(id, key string, n int) bool {
+	return slices.ContainsFunc(r.Owners(key, n), func(m Member) bool {
+		return m.ID == id
+	})
+}
+
+// Share is the part of the keyspace a member keeps.
+type Share struct {
+	Member
+	Tokens int `json:"tokens"`
+	// Primary is the fraction of the keyspace the member is the primary
+	// owner of, Replica the fraction it keeps as any of the n owners.
+	Primary float64 `json:"primary"`
+	Replica float64 `json:"replica"`
+}
+
+// Shares returns the part of the keyspace each member keeps with n owners
+// per key, in the order of Members.
+func (r *Ring) Shares(n int) []Share {
+	shares := make([]Share, len(r.members))
+	for i, m := range r.members {
+		shares[i] = Share{Member: m, Tokens: r.vnodes}
+	}
+	if len(r.tokens) == 0 {
+		return shares
+	}
+
+	const keyspace = float64(1<<63) * 2
+	n = min(n, len(r.members))
+	for i, t := range r.tokens {
+		// the range from the previous token up to t belongs to the owners
+		// starting at t
+		prev := r.tokens[(i+len(r.tokens)-1)%len(r.tokens)].hash
+		size := float64(t.hash - prev)
+		if len(r.tokens) == 1 {
+			size = keyspace
+		}
+		seen := make([]bool, len(r.members))
+		for j, k := 0, 0; k < n; j++ {
+			m := r.tokens[(i+j)%len(r.tokens)].member
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			if k == 0 {
+				shares[m].Primary += size / keyspace
+			}
+			shares[m].Replica += size / keyspace
+			k++
+		}
+	}
+
+	return shares
+}
+
+// Covered reports whether every key has one of its n owners among the
+// members ids.
+func (r *Ring) Covered(ids map[string]bool, n int) bool {
+	n = min(n, len(r.members))
+	for i := range r.tokens {
+		// the owners of the range ending at token i
+		seen := make([]bool, len(r.members))
+		covered := false
+		for j, k := 0, 0; k < n && !covered; j++ {
+			m := r.tokens[(i+j)%len(r.tokens)].member
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			covered = ids[r.members[m].ID]
+			k++
+		}
+		if !covered {
+			return false
+		}
+	}
+
+	return true
+}
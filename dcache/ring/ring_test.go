@@ -0,0 +1,128 @@
+package ring
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func members(n int) []Member {
+	ms := make([]Member, n)
+	for i := range ms {
+		ms[i] = Member{ID: fmt.Sprintf("node%d", i), Host: fmt.Sprintf("10.0.0.%d:4000", i)}
+	}
+
+	return ms
+}
+
+func TestOwners(t *testing.T) {
+	ms := members(5)
+	r := New(64, ms...)
+	reversed := New(64, ms[4], ms[3], ms[2], ms[1], ms[0], ms[2])
+	if !r.Equal(reversed) {
+		t.Fatal("ring depends on the order of the members")
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key", i)
+		owners := r.Owners(key, 3)
+		if len(owners) != 3 {
+			t.Fatalf("%s: %d owners, want 3", key, len(owners))
+		}
+		seen := make(map[string]bool)
+		for _, m := range owners {
+			if seen[m.ID] {
+				t.Fatalf("%s: owners %v are not distinct", key, owners)
+			}
+			seen[m.ID] = true
+			if !r.Owns(m.ID, key, 3) {
+				t.Fatalf("%s: owner %s does not own it", key, m.ID)
+			}
+		}
+		if other := reversed.Owners(key, 3); fmt.Sprint(other) != fmt.Sprint(owners) {
+			t.Fatalf("%s: owners %v and %v", key, owners, other)
+		}
+	}
+}
+
+func TestAddMember(t *testing.T) {
+	const keys = 20000
+	ms := members(6)
+	before, after := New(128, ms[:5]...), New(128, ms...)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprint("key", i)
+		from, to := before.Owners(key, 1)[0], after.Owners(key, 1)[0]
+		if from != to {
+			moved++
+			if to.ID != ms[5].ID {
+				t.Fatalf("%s moved from %s to %s, not to the new member", key, from.ID, to.ID)
+			}
+		}
+	}
+	// about 1/6 of the keys move to the new member
+	if share := float64(moved) / keys; share < 0.12 || share > 0.22 {
+		t.Fatalf("%.3f of the keys moved, want about %.3f", share, 1.0/6)
+	}
+}
+
+func TestShares(t *testing.T) {
+	r := New(64, members(5)...)
+	var primary, replica float64
+	for _, s := range r.Shares(3) {
+		if s.Tokens != 64 {
+			t.Fatalf("%s has %d tokens, want 64", s.ID, s.Tokens)
+		}
+		primary += s.Primary
+		replica += s.Replica
+	}
+	if math.Abs(primary-1) > 1e-9 {
+		t.Fatalf("primary shares sum to %f, want 1", primary)
+	}
+	if math.Abs(replica-3) > 1e-9 {
+		t.Fatalf("replica shares sum to %f, want 3", replica)
+	}
+}
+
+func TestFewerMembersThanReplicas(t *testing.T) {
+	ms := members(2)
+	r := New(16, ms...)
+	if owners := r.Owners("key", 5); len(owners) != 2 {
+		t.Fatalf("owners %v, want both members", owners)
+	}
+	for _, s := range r.Shares(5) {
+		if math.Abs(s.Replica-1) > 1e-9 {
+			t.Fatalf("%s keeps %f of the keyspace, want all of it", s.ID, s.Replica)
+		}
+	}
+	if owners := New(16).Owners("key", 3); len(owners) != 0 {
+		t.Fatalf("empty ring has owners %v", owners)
+	}
+	if shares := New(1, ms[0]).Shares(3); len(shares) != 1 || shares[0].Primary != 1 {
+		t.Fatalf("single token shares %+v", shares)
+	}
+}
+
+func TestCovered(t *testing.T) {
+	ms := members(4)
+	r := New(32, ms...)
+	all := map[string]bool{"node0": true, "node1": true, "node2": true, "node3": true}
+	if !r.Covered(all, 2) {
+		t.Fatal("all members do not cover the ring")
+	}
+	for _, m := range ms {
+		others := map[string]bool{}
+		for id := range all {
+			others[id] = id != m.ID
+		}
+		if !r.Covered(others, 2) {
+			t.Fatalf("ring without %s not covered with 2 owners", m.ID)
+		}
+		if r.Covered(others, 1) {
+			t.Fatalf("ring without %s covered with 1 owner", m.ID)
+		}
+	}
+	// some ranges are kept by node0 and node1 only
+	if r.Covered(map[string]bool{"node2": true, "node3": true}, 2) {
+		t.Fatal("ring without two members covered with 2 owners")
+	}
+}
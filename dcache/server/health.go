@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDraining = errors.New("shutting down")
+
+// Check returns nil when the checked component is healthy.
+type Check func(ctx context.Context) error
+
+type check struct {
+	name string
+	fn   Check
+}
+
+// Health serves liveness and readiness probes. Liveness checks tell whether
+// the process has to be restarted, readiness checks whether it should
+// receive traffic; every liveness check is a readiness check as well.
+type Health struct {
+	mu        sync.RWMutex
+	liveness  []check
+	readiness []check
+	draining  atomic.Bool
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+func (h *Health) Live(name string, fn Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness = append(h.liveness, check{name: name, fn: fn})
+}
+
+func (h *Health) Ready(name string, fn Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness = append(h.readiness, check{name: name, fn: fn})
+}
+
+// Drain makes the node unready for the rest of its life, so it is taken
+// out of rotation before it shuts down.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+type HealthStatus struct {
+	Status string `json:"status"`
+	// Checks maps check names to "ok" or the error they returned.
+	Checks map[string]string `json:"checks"`
+}
+
+func (h *Health) run(ctx context.Context, ready bool) (HealthStatus, bool) {
+	h.mu.RLock()
+	checks := append([]check(nil), h.liveness...)
+	if ready {
+		checks = append(checks, h.readiness...)
+	}
+	h.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var (
+		st = HealthStatus{
+			Status: "ok",
+			Checks: make(map[string]string, len(checks)+1),
+		}
+		ok = true
+	)
+	if ready && h.draining.Load() {
+		st.Checks["shutdown"] = ErrDraining.Error()
+		ok = false
+	}
+	for _, c := range checks {
+		if err := c.fn(ctx); err != nil {
+			st.Checks[c.name] = err.Error()
+			ok = false
+			continue
+		}
+		st.Checks[c.name] = "ok"
+	}
+	if !ok {
+		st.Status = "unavailable"
+	}
+
+	return st, ok
+}
+
+func (h *Health) handler(ready bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		st, ok := h.run(r.Context(), ready)
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		if !ok {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(rw).Encode(st)
+	}
+}
+
+// LiveHandler serves /healthz.
+func (h *Health) LiveHandler() http.Handler {
+	return h.handler(false)
+}
+
+// ReadyHandler serves /readyz.
+func (h *Health) ReadyHandler() http.Handler {
+	return h.handler(true)
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"time"
@@ -9,9 +10,14 @@ import (
 
 type HTTPServer struct {
 	*http.Server
-	ln net.Listener
+	ln          net.Listener
+	tlsConfig   *tls.Config
+	middlewares []Middleware
+	bypass      *http.ServeMux
 }
 
+type Middleware func(http.Handler) http.Handler
+
 func NewHTTP(addr string) *HTTPServer {
 	return &HTTPServer{
 		Server: &http.Server{
@@ -20,7 +26,37 @@ func NewHTTP(addr string) *HTTPServer {
 	}
 }
 
+// Use adds middlewares wrapping the handler passed to Register, the first
+// one being the outermost.
+func (s *HTTPServer) Use(mw ...Middleware) {
+	s.middlewares = append(s.middlewares, mw...)
+}
+
+// WithTLS makes Run serve HTTPS with cfg.
+func (s *HTTPServer) WithTLS(cfg *tls.Config) *HTTPServer {
+	s.tlsConfig = cfg
+
+	return s
+}
+
+// Bypass serves h for pattern without the middlewares, e.g. for probes
+// that must answer without credentials and regardless of load. It has to
+// be called before Register.
+func (s *HTTPServer) Bypass(pattern string, h http.Handler) {
+	if s.bypass == nil {
+		s.bypass = http.NewServeMux()
+	}
+	s.bypass.Handle(pattern, h)
+}
+
 func (s *HTTPServer) Register(h http.Handler) {
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	if s.bypass != nil {
+		s.bypass.Handle("/", h)
+		h = s.bypass
+	}
 	s.Handler = h
 }
 
@@ -32,6 +68,9 @@ func (s *HTTPServer) Run() (err error) {
 	if s.ln, err = net.Listen("tcp", s.Server.Addr); err != nil {
 		return err
 	}
+	if s.tlsConfig != nil {
+		s.ln = tls.NewListener(s.ln, s.tlsConfig)
+	}
 
 	return s.Server.Serve(s.ln)
 }
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type limiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter keeps a token bucket per client, refilled at Rate tokens per
+// second up to Burst. Buckets idle for longer than the cleanup interval are
+// dropped. A zero rate disables limiting.
+type RateLimiter struct {
+	key func(r *http.Request) string
+
+	mu       sync.Mutex
+	rate     rate.Limit
+	burst    int
+	limiters map[string]*limiter
+}
+
+func NewRateLimiter(rps float64, burst int, key func(r *http.Request) string) *RateLimiter {
+	return &RateLimiter{
+		rate:     rate.Limit(rps),
+		burst:    burst,
+		key:      key,
+		limiters: make(map[string]*limiter),
+	}
+}
+
+// SetLimit changes the rate and burst of all clients.
+func (l *RateLimiter) SetLimit(rps float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate.Limit(rps)
+	l.burst = burst
+	for _, lim := range l.limiters {
+		lim.SetLimit(l.rate)
+		lim.SetBurst(l.burst)
+	}
+}
+
+// get returns the bucket of key, or nil when limiting is disabled.
+func (l *RateLimiter) get(key string) *limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return nil
+	}
+	lim, ok := l.limiters[key]
+	if !ok {
+		lim = &limiter{
+			Limiter: rate.NewLimiter(l.rate, l.burst),
+		}
+		l.limiters[key] = lim
+	}
+	lim.lastSeen = time.Now()
+
+	return lim
+}
+
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lim := l.get(l.key(r))
+		if lim == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		res := lim.Reserve()
+		if delay := res.Delay(); delay > 0 {
+			res.Cancel()
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(rw, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Cleanup drops buckets not used for idle until ctx is done.
+func (l *RateLimiter) Cleanup(ctx context.Context, idle time.Duration) {
+	t := time.NewTicker(idle)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.mu.Lock()
+			for k, lim := range l.limiters {
+				if now.Sub(lim.lastSeen) > idle {
+					delete(l.limiters, k)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Shed rejects requests with 503 while depth reports a queue at or above
+// threshold, instead of letting them pile up behind a saturated queue.
+// A zero threshold disables shedding.
+func Shed(depth, threshold func() int) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if t := threshold(); t > 0 && depth() >= t {
+				rw.Header().Set("Retry-After", "1")
+				http.Error(rw, "server overloaded", http.StatusServiceUnavailable)
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
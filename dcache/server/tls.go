@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type TLSCfg struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies peer certificates: clients of the HTTP API when
+	// ClientAuth is set, and the other side of cluster connections.
+	CAFile     string
+	ClientAuth bool
+	Logger     *slog.Logger
+}
+
+func (c TLSCfg) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// CertReloader serves the certificate, key and CA pool from TLSCfg and
+// reloads them when the files change, so certificates can be rotated
+// without a restart.
+type CertReloader struct {
+	cfg TLSCfg
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func NewCertReloader(cfg TLSCfg) (*CertReloader, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	r := &CertReloader{
+		cfg: cfg,
+	}
+
+	return r, r.Reload()
+}
+
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.cfg.CAFile != "" {
+		pem, err := os.ReadFile(r.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", r.cfg.CAFile)
+		}
+	}
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.pool = pool
+	r.modTime = modTime
+
+	return nil
+}
+
+func (r *CertReloader) lastModified() (t time.Time, err error) {
+	for _, f := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+
+	return t, nil
+}
+
+// Watch polls the files every interval and reloads them on change until ctx
+// is done. A failed reload keeps serving the previous certificates.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			modTime, err := r.lastModified()
+			if err != nil {
+				r.cfg.Logger.Warn("stat certificates", "err", err)
+				continue
+			}
+			r.mu.RLock()
+			changed := modTime.After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err = r.Reload(); err != nil {
+				r.cfg.Logger.Error("reload certificates", "cert", r.cfg.CertFile, "err", err)
+				continue
+			}
+			r.cfg.Logger.Info("certificates reloaded", "cert", r.cfg.CertFile)
+		}
+	}
+}
+
+func (r *CertReloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert
+}
+
+func (r *CertReloader) caPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.pool
+}
+
+// ServerConfig returns a config for listeners, requiring and verifying
+// client certificates when ClientAuth is set.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate()},
+			}
+			if r.cfg.ClientAuth {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = r.caPool()
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns a config for dialing peers that presents our
+// certificate and verifies the peer against the current CA pool.
+func (r *CertReloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+		// the CA pool may change at runtime, so verification is done in
+		// VerifyConnection against the pool loaded last.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("tls: no peer certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         r.caPool(),
+				DNSName:       cs.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+var ErrNoCA = errors.New("tls: no CA pool to verify peers")
+
+// PeerConfig returns a config usable on both ends of a mutually
+// authenticated connection, as needed by the cluster transport. It needs
+// CAFile, peers are never verified against the system roots.
+func (r *CertReloader) PeerConfig() (*tls.Config, error) {
+	if r.caPool() == nil {
+		return nil, ErrNoCA
+	}
+	cfg := r.ClientConfig()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*r.certificate()},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    r.caPool(),
+		}, nil
+	}
+
+	return cfg, nil
+}
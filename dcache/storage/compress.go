@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type Codec uint8
+
+const (
+	NoCompression Codec = iota
+	Snappy
+	Zstd
+)
+
+func (c Codec) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	}
+
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return NoCompression, nil
+	case "snappy":
+		return Snappy, nil
+	case "zstd":
+		return Zstd, nil
+	}
+
+	return NoCompression, fmt.Errorf("unknown compression codec %q", name)
+}
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Compression compresses values of at least Threshold bytes with Codec.
+// Smaller values, and values that do not shrink, are kept as is.
+type Compression struct {
+	Codec     Codec
+	Threshold int
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// initZstd panics if the codec cannot be set up, the options are fixed so
+// it only fails on a broken build.
+func initZstd() {
+	var err error
+	if zstdEnc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); err != nil {
+		panic(fmt.Sprintf("storage: zstd encoder: %v", err))
+	}
+	if zstdDec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0)); err != nil {
+		panic(fmt.Sprintf("storage: zstd decoder: %v", err))
+	}
+}
+
+func (c Compression) Encode(value []byte) ([]byte, Codec) {
+	if c.Codec == NoCompression || len(value) < c.Threshold {
+		return value, NoCompression
+	}
+
+	var res []byte
+	switch c.Codec {
+	case Snappy:
+		res = snappy.Encode(nil, value)
+	case Zstd:
+		zstdOnce.Do(initZstd)
+		res = zstdEnc.EncodeAll(value, make([]byte, 0, len(value)/2))
+	default:
+		return value, NoCompression
+	}
+	if len(res) >= len(value) {
+		return value, NoCompression
+	}
+
+	return res, c.Codec
+}
+
+func Decode(codec Codec, value []byte) ([]byte, error) {
+	switch codec {
+	case NoCompression:
+		return value, nil
+	case Snappy:
+		return snappy.Decode(nil, value)
+	case Zstd:
+		zstdOnce.Do(initZstd)
+		return zstdDec.DecodeAll(value, nil)
+	}
+
+	return nil, fmt.Errorf("%w %d", ErrUnknownCodec, codec)
+}
+
+// Entry is a stored value. Value holds Size bytes of the original value
+// encoded with Codec.
+type Entry struct {
+	Value []byte `json:"v"`
+	Codec Codec  `json:"c,omitempty"`
+	Size  int    `json:"s"`
+	// Sum is the checksum of the original value and Modified the time of
+	// the write in unix nanoseconds, anti-entropy compares them.
+	Sum      uint64 `json:"h,omitempty"`
+	Modified int64  `json:"m,omitempty"`
+}
+
+func (e Entry) Bytes() ([]byte, error) {
+	return Decode(e.Codec, e.Value)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	const threshold = 64
+	var (
+		small          = []byte(strings.Repeat("a", threshold-1))
+		large          = []byte(strings.Repeat("abcd", 1024))
+		incompressible = make([]byte, 1024)
+	)
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := range incompressible {
+		incompressible[i] = byte(rnd.Uint32())
+	}
+	for _, codec := range []Codec{Snappy, Zstd} {
+		c := Compression{Codec: codec, Threshold: threshold}
+		for _, tc := range []struct {
+			name  string
+			value []byte
+			codec Codec
+		}{
+			{name: "below threshold", value: small, codec: NoCompression},
+			{name: "above threshold", value: large, codec: codec},
+			{name: "does not shrink", value: incompressible, codec: NoCompression},
+			{name: "empty", value: []byte{}, codec: NoCompression},
+		} {
+			t.Run(codec.String()+"/"+tc.name, func(t *testing.T) {
+				enc, got := c.Encode(tc.value)
+				if got != tc.codec {
+					t.Fatalf("encoded with %s, want %s", got, tc.codec)
+				}
+				if got != NoCompression && len(enc) >= len(tc.value) {
+					t.Fatalf("compressed %d bytes to %d", len(tc.value), len(enc))
+				}
+				dec, err := Decode(got, enc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(dec, tc.value) {
+					t.Fatalf("decoded %d bytes, want the %d encoded", len(dec), len(tc.value))
+				}
+			})
+		}
+	}
+	if _, err := Decode(Codec(42), nil); err == nil {
+		t.Fatal("unknown codec decoded")
+	}
+}
+
+func TestCompressedGet(t *testing.T) {
+	for _, codec := range []Codec{Snappy, Zstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			s := newTestStorage(t, WithCompression(Compression{Codec: codec, Threshold: 64}))
+			small, large := "short", strings.Repeat("compressible ", 512)
+			set(t, s, "", "small", small, 0)
+			set(t, s, "", "large", large, 0)
+
+			entries, err := s.Entries(context.Background(), DefaultNamespace, []string{"small", "large"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			codecs := make(map[string]Codec)
+			for _, e := range entries {
+				codecs[e.Key] = e.Entry.Codec
+			}
+			if codecs["small"] != NoCompression || codecs["large"] != codec {
+				t.Fatalf("stored with %v", codecs)
+			}
+			for k, want := range map[string]string{"small": small, "large": large} {
+				if v, ok := get(t, s, "", k); !ok || v != want {
+					t.Fatalf("%s: got %d bytes, want the %d set", k, len(v), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	s := newTestStorage(t, WithCompression(Compression{Codec: Snappy, Threshold: 64}))
+	large := strings.Repeat("x", 4096)
+	set(t, s, "", "large", large, 0)
+	set(t, s, "", "small", "short", 0)
+
+	stats, err := s.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := stats.Namespaces[DefaultNamespace]
+	if ns.Bytes != int64(len(large)+len("short")) {
+		t.Fatalf("bytes %d, want %d", ns.Bytes, len(large)+len("short"))
+	}
+	if ns.StoredBytes <= 0 || ns.StoredBytes >= ns.Bytes {
+		t.Fatalf("stored %d bytes of %d", ns.StoredBytes, ns.Bytes)
+	}
+	if want := float64(ns.Bytes) / float64(ns.StoredBytes); ns.CompressionRatio != want || stats.CompressionRatio != want {
+		t.Fatalf("ratio %f, total %f, want %f", ns.CompressionRatio, stats.CompressionRatio, want)
+	}
+
+	uncompressed := newTestStorage(t)
+	set(t, uncompressed, "", "large", large, 0)
+	if stats, err = uncompressed.Stats(context.Background()); err != nil || stats.CompressionRatio != 1 {
+		t.Fatalf("ratio without compression %f, %v", stats.CompressionRatio, err)
+	}
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Consistency is the guarantee a read gives about seeing earlier writes.
+type Consistency uint8
+
+const (
+	// Stale reads the local memory.
+	Stale Consistency = iota
+	// Bounded reads the local memory unless the replica lags behind the
+	// leader by more than Command.MaxLag.
+	Bounded
+	// LeaderLease reads on the leader while it holds a lease confirmed by
+	// a quorum.
+	LeaderLease
+	// Linearizable reads on the leader once a barrier entry of its term is
+	// committed and every entry before it applied.
+	Linearizable
+)
+
+var consistencyNames = [...]string{
+	Stale:        "stale",
+	Bounded:      "bounded",
+	LeaderLease:  "leader-lease",
+	Linearizable: "linearizable",
+}
+
+func (c Consistency) String() string {
+	if int(c) < len(consistencyNames) {
+		return consistencyNames[c]
+	}
+
+	return fmt.Sprintf("Consistency(%d)", c)
+}
+
+var (
+	ErrUnknownConsistency     = errors.New("unknown consistency")
+	ErrUnsupportedConsistency = errors.New("consistency not supported by this replication mode")
+	ErrStaleRead              = errors.New("replica lags behind the leader")
+)
+
+// ParseConsistency parses the name of a level, empty is Stale.
+func ParseConsistency(name string) (Consistency, error) {
+	if name == "" {
+		return Stale, nil
+	}
+	for c, n := range consistencyNames {
+		if n == name {
+			return Consistency(c), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w %q", ErrUnknownConsistency, name)
+}
+
+// waitApplied waits until applied reaches index.
+func waitApplied(ctx context.Context, index uint64, applied func() uint64) error {
+	if applied() >= index {
+		return nil
+	}
+	t := time.NewTicker(time.Millisecond)
+	defer t.Stop()
+	for applied() < index {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// MerkleDepth is the depth of the Merkle trees of namespaces, which have
+// 1<<MerkleDepth leaves.
+const MerkleDepth = 10
+
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+// fnv64 continues the FNV-1a hash h with b.
+func fnv64[T string | []byte](h uint64, b T) uint64 {
+	for i := 0; i < len(b); i++ {
+		h ^= uint64(b[i])
+		h *= prime64
+	}
+
+	return h
+}
+
+func checksum(value []byte) uint64 {
+	return fnv64(offset64, value)
+}
+
+// digest identifies the state of key in its leaf, deleted keys have a
+// digest of their own so a tombstone differs from a missing key.
+func digest(key string, sum uint64, deleted bool) uint64 {
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[:], sum)
+	if deleted {
+		b[8] = 1
+	}
+
+	return fnv64(fnv64(offset64, key), b[:])
+}
+
+func leafOf(key string) int {
+	return int(fnv64(offset64, key) >> (64 - MerkleDepth))
+}
+
+// leaves holds the XOR of the digests of the keys of each leaf, so writes
+// update them in place.
+type leaves [1 << MerkleDepth]uint64
+
+func (l *leaves) toggle(key string, d uint64) {
+	l[leafOf(key)] ^= d
+}
+
+// MerkleTree is a Merkle tree in heap order: node i has the children 2i+1
+// and 2i+2, the last 1<<MerkleDepth nodes are the leaves. Empty subtrees
+// hash to 0.
+type MerkleTree []uint64
+
+// FirstLeaf is the node of the first leaf.
+const FirstLeaf = 1<<MerkleDepth - 1
+
+func (l *leaves) tree() MerkleTree {
+	t := make(MerkleTree, FirstLeaf+len(l))
+	copy(t[FirstLeaf:], l[:])
+	for i := FirstLeaf - 1; i >= 0; i-- {
+		left, right := t[2*i+1], t[2*i+2]
+		if left == 0 && right == 0 {
+			continue
+		}
+		var b [16]byte
+		binary.LittleEndian.PutUint64(b[:8], left)
+		binary.LittleEndian.PutUint64(b[8:], right)
+		t[i] = fnv64(offset64, b[:])
+	}
+
+	return t
+}
+
+// Root returns the hash of the whole tree.
+func (t MerkleTree) Root() uint64 {
+	return t[0]
+}
+
+// KeyDigest describes a key, or its tombstone, to anti-entropy. Evicted is
+// set for a key evicted to keep the quota, whose value is gone.
+type KeyDigest struct {
+	Key      string
+	Sum      uint64
+	Size     int
+	Modified int64
+	Deleted  bool
+	Evicted  bool
+}
+
+// Newer reports whether d wins over other, the last write wins.
+func (d KeyDigest) Newer(other KeyDigest) bool {
+	if d.Modified != other.Modified {
+		return d.Modified > other.Modified
+	}
+	if d.Deleted != other.Deleted {
+		return d.Deleted
+	}
+
+	return d.Sum > other.Sum
+}
+
+// Same reports whether both digests describe the same value, regardless of
+// when it was written.
+func (d KeyDigest) Same(other KeyDigest) bool {
+	return d.Deleted == other.Deleted && (d.Deleted || d.Sum == other.Sum)
+}
+
+// KeyEntry is an entry, or a tombstone deleted at Entry.Modified, exchanged
+// by anti-entropy.
+type KeyEntry struct {
+	Key     string
+	Entry   Entry
+	Deleted bool
+}
+
+func (e KeyEntry) digest() KeyDigest {
+	return KeyDigest{
+		Key:      e.Key,
+		Sum:      e.Entry.Sum,
+		Size:     e.Entry.Size,
+		Modified: e.Entry.Modified,
+		Deleted:  e.Deleted,
+	}
+}
+
+// lookup returns the entry or tombstone of key, it must only be called
+// from the processing goroutine.
+func (n *namespace) lookup(key string) (KeyEntry, bool) {
+	if it, ok := n.values[key]; ok {
+		return KeyEntry{Key: key, Entry: it.entry}, true
+	}
+	if at, ok := n.deleted[key]; ok {
+		return KeyEntry{Key: key, Entry: Entry{Modified: at}, Deleted: true}, true
+	}
+
+	return KeyEntry{}, false
+}
+
+// Trees returns the Merkle trees of the namespaces with keys or tombstones.
+func (s *Storage) Trees(ctx context.Context) (map[string]MerkleTree, error) {
+	copies := make(map[string]*leaves)
+	err := s.exec(ctx, func() {
+		for name, n := range s.namespaces {
+			if len(n.values) > 0 || len(n.deleted) > 0 {
+				l := *n.leaves
+				copies[name] = &l
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	trees := make(map[string]MerkleTree, len(copies))
+	for name, l := range copies {
+		trees[name] = l.tree()
+	}
+
+	return trees, nil
+}
+
+// Digests returns the keys and tombstones of the namespace ns in the given
+// leaves, sorted by key.
+func (s *Storage) Digests(ctx context.Context, ns string, leaves []int) ([]KeyDigest, error) {
+	wanted := make(map[int]bool, len(leaves))
+	for _, l := range leaves {
+		wanted[l] = true
+	}
+
+	var digests []KeyDigest
+	err := s.exec(ctx, func() {
+		n, ok := s.namespaces[ns]
+		if !ok {
+			return
+		}
+		for k := range n.values {
+			if wanted[leafOf(k)] {
+				e, _ := n.lookup(k)
+				digests = append(digests, e.digest())
+			}
+		}
+		for k := range n.deleted {
+			if wanted[leafOf(k)] {
+				e, _ := n.lookup(k)
+				digests = append(digests, e.digest())
+			}
+		}
+		for k, e := range n.evicted {
+			if wanted[leafOf(k)] {
+				digests = append(digests, KeyDigest{Key: k, Modified: e.modified, Evicted: true})
+			}
+		}
+	})
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i].Key < digests[j].Key
+	})
+
+	return digests, err
+}
+
+// Entries returns the entries and tombstones of keys in the namespace ns,
+// keys with neither are skipped.
+func (s *Storage) Entries(ctx context.Context, ns string, keys []string) ([]KeyEntry, error) {
+	var entries []KeyEntry
+	err := s.exec(ctx, func() {
+		n, ok := s.namespaces[ns]
+		if !ok {
+			return
+		}
+		for _, k := range keys {
+			if e, ok := n.lookup(k); ok {
+				entries = append(entries, e)
+			}
+		}
+	})
+
+	return entries, err
+}
+
+// Repair stores the entries and tombstones newer than the local ones, and
+// than the version of the keys evicted here, in the namespace ns and returns
+// how many it stored.
+func (s *Storage) Repair(ctx context.Context, ns string, entries []KeyEntry) (int, error) {
+	var (
+		repaired int
+		err      error
+	)
+	if execErr := s.exec(ctx, func() {
+		n := s.ns(ns)
+		for _, e := range entries {
+			if ev, ok := n.evicted[e.Key]; ok && e.Entry.Modified <= ev.modified {
+				continue
+			}
+			if local, ok := n.lookup(e.Key); ok {
+				if d := e.digest(); d.Same(local.digest()) || !d.Newer(local.digest()) {
+					continue
+				}
+			}
+			if e.Deleted {
+				n.remove(e.Key, e.Entry.Modified)
+				repaired++
+				continue
+			}
+			if setErr := n.set(e.Key, e.Entry); setErr != nil {
+				err = errors.Join(err, setErr)
+				continue
+			}
+			repaired++
+		}
+	}); execErr != nil {
+		return 0, execErr
+	}
+
+	return repaired, err
+}
+
+// PruneTombstones drops the tombstones of keys deleted before t.
+func (s *Storage) PruneTombstones(ctx context.Context, t time.Time) error {
+	return s.exec(ctx, func() {
+		for _, n := range s.namespaces {
+			n.prune(t.UnixNano())
+		}
+	})
+}
+
+// Stored returns the keys and tombstones of every namespace.
+func (s *Storage) Stored(ctx context.Context) (map[string][]string, error) {
+	keys := make(map[string][]string)
+	err := s.exec(ctx, func() {
+		for name, n := range s.namespaces {
+			for k := range n.values {
+				keys[name] = append(keys[name], k)
+			}
+			for k := range n.deleted {
+				keys[name] = append(keys[name], k)
+			}
+		}
+	})
+
+	return keys, err
+}
+
+// Forget drops keys of the namespace ns, and their tombstones, without
+// recording a delete, once other nodes took them over.
+func (s *Storage) Forget(ctx context.Context, ns string, keys []string) error {
+	return s.exec(ctx, func() {
+		n, ok := s.namespaces[ns]
+		if !ok {
+			return
+		}
+		for _, k := range keys {
+			n.del(k)
+			n.undelete(k)
+		}
+	})
+}
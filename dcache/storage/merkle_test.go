@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLeavesToggle(t *testing.T) {
+	n := newNamespace("ns", NamespaceCfg{})
+	n.put("k", Entry{Sum: 1, Modified: 100})
+	set := *n.leaves
+
+	// set, del and set again cancel out
+	n.remove("k", 200)
+	if *n.leaves == set {
+		t.Fatal("delete left the leaf unchanged")
+	}
+	n.put("k", Entry{Sum: 1, Modified: 300})
+	if *n.leaves != set {
+		t.Fatal("leaf differs after set, del and set of the same value")
+	}
+
+	// replacing a value toggles the old digest out
+	n.put("k", Entry{Sum: 2, Modified: 400})
+	n.put("k", Entry{Sum: 1, Modified: 500})
+	if *n.leaves != set {
+		t.Fatal("leaf differs after replacing the value back")
+	}
+
+	n.del("k")
+	if *n.leaves != (leaves{}) || n.leaves.tree().Root() != 0 {
+		t.Fatal("empty namespace has a non zero tree")
+	}
+}
+
+func TestTombstoneDiffersFromMissing(t *testing.T) {
+	if digest("k", 0, true) == digest("k", 0, false) {
+		t.Fatal("tombstone digest equals the digest of an empty value")
+	}
+
+	ctx := context.Background()
+	deleted, missing := newTestStorage(t), newTestStorage(t)
+	set(t, deleted, "", "k", "v", 100)
+	del(t, deleted, "", "k", 200)
+	set(t, deleted, "", "other", "v", 100)
+	set(t, missing, "", "other", "v", 100)
+
+	a, err := deleted.Trees(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := missing.Trees(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a[DefaultNamespace].Root() == b[DefaultNamespace].Root() {
+		t.Fatal("a tombstone hashes like a missing key")
+	}
+}
+
+func TestDigestOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		a, b        KeyDigest
+		newer, same bool
+	}{
+		{"later write", KeyDigest{Sum: 1, Modified: 2}, KeyDigest{Sum: 2, Modified: 1}, true, false},
+		{"earlier write", KeyDigest{Sum: 2, Modified: 1}, KeyDigest{Sum: 1, Modified: 2}, false, false},
+		{"delete wins a tie", KeyDigest{Modified: 1, Deleted: true}, KeyDigest{Sum: 1, Modified: 1}, true, false},
+		{"value loses a tie to a delete", KeyDigest{Sum: 1, Modified: 1}, KeyDigest{Modified: 1, Deleted: true}, false, false},
+		{"higher sum wins a tie", KeyDigest{Sum: 2, Modified: 1}, KeyDigest{Sum: 1, Modified: 1}, true, false},
+		{"same value written twice", KeyDigest{Sum: 1, Modified: 2}, KeyDigest{Sum: 1, Modified: 1}, true, true},
+		{"identical", KeyDigest{Sum: 1, Modified: 1}, KeyDigest{Sum: 1, Modified: 1}, false, true},
+		{"tombstones", KeyDigest{Sum: 1, Modified: 1, Deleted: true}, KeyDigest{Modified: 2, Deleted: true}, false, true},
+	} {
+		if got := tc.a.Newer(tc.b); got != tc.newer {
+			t.Errorf("%s: Newer = %v", tc.name, got)
+		}
+		if got := tc.a.Same(tc.b); got != tc.same || tc.b.Same(tc.a) != got {
+			t.Errorf("%s: Same = %v", tc.name, got)
+		}
+	}
+}
+
+func TestEvictedKeysNotRepaired(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t, WithNamespace("lru", NamespaceCfg{MaxKeys: 1, Policy: EvictLRU}))
+
+	set(t, s, "lru", "a", "1", 100)
+	set(t, s, "lru", "b", "2", 200)
+	if _, ok := get(t, s, "lru", "a"); ok {
+		t.Fatal("a was not evicted")
+	}
+
+	// the version a peer still has must not come back
+	n, err := s.Repair(ctx, "lru", []KeyEntry{{Key: "a", Entry: Entry{Value: []byte("1"), Size: 1, Sum: checksum([]byte("1")), Modified: 100}}})
+	if err != nil || n != 0 {
+		t.Fatalf("repaired %d keys, err %v", n, err)
+	}
+	if _, ok := get(t, s, "lru", "b"); !ok {
+		t.Fatal("repairing an evicted key evicted b")
+	}
+	digests, err := s.Digests(ctx, "lru", []int{leafOf("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, d := range digests {
+		if d.Key == "a" {
+			found = d.Evicted && d.Modified == 100
+		}
+	}
+	if !found {
+		t.Fatalf("no evicted digest for a in %+v", digests)
+	}
+
+	// a newer write is taken
+	n, err = s.Repair(ctx, "lru", []KeyEntry{{Key: "a", Entry: Entry{Value: []byte("3"), Size: 1, Sum: checksum([]byte("3")), Modified: 300}}})
+	if err != nil || n != 1 {
+		t.Fatalf("repaired %d keys, err %v", n, err)
+	}
+	if v, _ := get(t, s, "lru", "a"); v != "3" {
+		t.Fatalf("a = %q", v)
+	}
+}
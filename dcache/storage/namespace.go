@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const DefaultNamespace = "default"
+
+type EvictionPolicy uint8
+
+const (
+	// NoEviction rejects writes exceeding the namespace quota with ErrQuotaExceeded.
+	NoEviction EvictionPolicy = iota
+	// EvictLRU evicts the least recently used keys.
+	EvictLRU
+	// EvictRandom evicts arbitrary keys.
+	EvictRandom
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case NoEviction:
+		return "noeviction"
+	case EvictLRU:
+		return "lru"
+	case EvictRandom:
+		return "random"
+	}
+
+	return fmt.Sprintf("policy(%d)", uint8(p))
+}
+
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "noeviction":
+		return NoEviction, nil
+	case "lru":
+		return EvictLRU, nil
+	case "random":
+		return EvictRandom, nil
+	}
+
+	return NoEviction, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// NamespaceCfg limits a namespace. Zero MaxKeys or MaxBytes means unlimited;
+// MaxBytes counts stored (compressed) bytes. A nil Compression uses the
+// storage wide setting.
+type NamespaceCfg struct {
+	MaxKeys     int
+	MaxBytes    int64
+	Policy      EvictionPolicy
+	Compression *Compression
+}
+
+type item struct {
+	key   string
+	entry Entry
+	elem  *list.Element
+}
+
+type namespace struct {
+	name   string
+	cfg    NamespaceCfg
+	values map[string]*item
+	lru    *list.List
+	// deleted holds the time keys were deleted at, so anti-entropy tells
+	// deleted keys from missed writes.
+	deleted map[string]int64
+	// evicted holds the keys evicted to keep the quota, so anti-entropy
+	// does not bring them back from peers.
+	evicted map[string]evictedKey
+	leaves  *leaves
+
+	rawBytes    int64
+	storedBytes int64
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+}
+
+func newNamespace(name string, cfg NamespaceCfg) *namespace {
+	return &namespace{
+		name:    name,
+		cfg:     cfg,
+		values:  make(map[string]*item),
+		lru:     list.New(),
+		deleted: make(map[string]int64),
+		evicted: make(map[string]evictedKey),
+		leaves:  new(leaves),
+	}
+}
+
+// evictedKey is the write time of an evicted entry and when it was evicted.
+type evictedKey struct {
+	modified int64
+	at       int64
+}
+
+func (n *namespace) get(key string) (Entry, bool) {
+	it, ok := n.values[key]
+	if !ok {
+		n.misses++
+		return Entry{}, false
+	}
+	n.hits++
+	n.lru.MoveToFront(it.elem)
+
+	return it.entry, true
+}
+
+func (n *namespace) set(key string, e Entry) error {
+	var (
+		keys  = len(n.values)
+		bytes = n.storedBytes + int64(len(e.Value))
+	)
+	if old, ok := n.values[key]; ok {
+		keys--
+		bytes -= int64(len(old.entry.Value))
+	}
+	if n.cfg.MaxBytes > 0 && int64(len(e.Value)) > n.cfg.MaxBytes {
+		return fmt.Errorf("%w: value of %d bytes exceeds %d", ErrQuotaExceeded, len(e.Value), n.cfg.MaxBytes)
+	}
+	if n.cfg.Policy == NoEviction && n.overQuota(keys+1, bytes) {
+		return fmt.Errorf("%w: namespace %q", ErrQuotaExceeded, n.name)
+	}
+
+	n.put(key, e)
+	for n.overQuota(len(n.values), n.storedBytes) && n.evict(key) {
+	}
+
+	return nil
+}
+
+func (n *namespace) put(key string, e Entry) {
+	n.del(key)
+	n.undelete(key)
+	delete(n.evicted, key)
+	n.leaves.toggle(key, digest(key, e.Sum, false))
+	it := &item{
+		key:   key,
+		entry: e,
+	}
+	it.elem = n.lru.PushFront(it)
+	n.values[key] = it
+	n.rawBytes += int64(e.Size)
+	n.storedBytes += int64(len(e.Value))
+}
+
+func (n *namespace) del(key string) bool {
+	it, ok := n.values[key]
+	if !ok {
+		return false
+	}
+	n.lru.Remove(it.elem)
+	delete(n.values, key)
+	n.leaves.toggle(key, digest(key, it.entry.Sum, false))
+	n.rawBytes -= int64(it.entry.Size)
+	n.storedBytes -= int64(len(it.entry.Value))
+
+	return true
+}
+
+// remove deletes key at the unix nanosecond time at and keeps a tombstone,
+// unlike del which is also used to replace and evict keys.
+func (n *namespace) remove(key string, at int64) bool {
+	ok := n.del(key)
+	n.undelete(key)
+	delete(n.evicted, key)
+	n.deleted[key] = at
+	n.leaves.toggle(key, digest(key, 0, true))
+
+	return ok
+}
+
+func (n *namespace) undelete(key string) {
+	if _, ok := n.deleted[key]; ok {
+		delete(n.deleted, key)
+		n.leaves.toggle(key, digest(key, 0, true))
+	}
+}
+
+// prune drops the tombstones, and the marks of evicted keys, older than
+// before.
+func (n *namespace) prune(before int64) {
+	for k, at := range n.deleted {
+		if at < before {
+			n.undelete(k)
+		}
+	}
+	for k, e := range n.evicted {
+		if e.at < before {
+			delete(n.evicted, k)
+		}
+	}
+}
+
+// newer reports whether key, or its tombstone, was written after the unix
+// nanosecond time at, so a write made at at must not replace it.
+func (n *namespace) newer(key string, at int64) bool {
+	if it, ok := n.values[key]; ok {
+		return it.entry.Modified > at
+	}
+	if del, ok := n.deleted[key]; ok {
+		return del > at
+	}
+
+	return false
+}
+
+func (n *namespace) rename(from, to string, at int64) (bool, error) {
+	it, ok := n.values[from]
+	if !ok {
+		return false, nil
+	}
+	e := it.entry
+	e.Modified = at
+	n.remove(from, at)
+	if err := n.set(to, e); err != nil {
+		n.put(from, it.entry)
+		return true, err
+	}
+
+	return true, nil
+}
+
+func (n *namespace) overQuota(keys int, bytes int64) bool {
+	return (n.cfg.MaxKeys > 0 && keys > n.cfg.MaxKeys) ||
+		(n.cfg.MaxBytes > 0 && bytes > n.cfg.MaxBytes)
+}
+
+// evict removes one key other than keep according to the eviction policy
+// and reports whether there was anything to evict.
+func (n *namespace) evict(keep string) bool {
+	switch n.cfg.Policy {
+	case EvictRandom:
+		for k := range n.values {
+			if k != keep {
+				n.evictKey(k)
+				return true
+			}
+		}
+	default:
+		for e := n.lru.Back(); e != nil; e = e.Prev() {
+			if k := e.Value.(*item).key; k != keep {
+				n.evictKey(k)
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (n *namespace) evictKey(key string) {
+	n.evicted[key] = evictedKey{modified: n.values[key].entry.Modified, at: time.Now().UnixNano()}
+	n.del(key)
+	n.evictions++
+}
+
+func (n *namespace) flush() {
+	clear(n.values)
+	clear(n.deleted)
+	clear(n.evicted)
+	n.lru.Init()
+	n.leaves = new(leaves)
+	n.rawBytes = 0
+	n.storedBytes = 0
+}
+
+// removeAll removes every key written up to at, keeping tombstones.
+func (n *namespace) removeAll(at int64) {
+	for k, it := range n.values {
+		if it.entry.Modified <= at {
+			n.remove(k, at)
+		}
+	}
+}
+
+func (n *namespace) scan(prefix string) []string {
+	keys := make([]string, 0)
+	for k := range n.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// entries returns the values and the tombstones of n.
+func (n *namespace) entries() map[string]snapshotEntry {
+	kv := make(map[string]snapshotEntry, len(n.values)+len(n.deleted))
+	for k, it := range n.values {
+		kv[k] = snapshotEntry{Entry: it.entry}
+	}
+	for k, at := range n.deleted {
+		kv[k] = snapshotEntry{Entry: Entry{Modified: at}, Deleted: true}
+	}
+
+	return kv
+}
+
+type NamespaceStats struct {
+	Keys             int     `json:"keys"`
+	Bytes            int64   `json:"bytes"`
+	StoredBytes      int64   `json:"storedBytes"`
+	CompressionRatio float64 `json:"compressionRatio"`
+	Tombstones       int     `json:"tombstones"`
+	MaxKeys          int     `json:"maxKeys,omitempty"`
+	MaxBytes         int64   `json:"maxBytes,omitempty"`
+	Policy           string  `json:"policy"`
+	Hits             uint64  `json:"hits"`
+	Misses           uint64  `json:"misses"`
+	Evictions        uint64  `json:"evictions"`
+}
+
+func (n *namespace) stats() NamespaceStats {
+	st := NamespaceStats{
+		Keys:        len(n.values),
+		Bytes:       n.rawBytes,
+		StoredBytes: n.storedBytes,
+		Tombstones:  len(n.deleted),
+		MaxKeys:     n.cfg.MaxKeys,
+		MaxBytes:    n.cfg.MaxBytes,
+		Policy:      n.cfg.Policy.String(),
+		Hits:        n.hits,
+		Misses:      n.misses,
+		Evictions:   n.evictions,
+	}
+	if st.StoredBytes > 0 {
+		st.CompressionRatio = float64(st.Bytes) / float64(st.StoredBytes)
+	}
+
+	return st
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/dmitrorezn/dcache/crypt"
+)
+
+// DefaultChunkSize is the size of the chunks large values are written and
+// replicated in.
+const DefaultChunkSize = 64 << 10
+
+type Option func(s *Storage)
+
+// WithMaxValueSize rejects Set commands with values larger than n bytes
+// with ErrValueTooLarge. Zero disables the limit.
+func WithMaxValueSize(n int) Option {
+	return func(s *Storage) {
+		s.maxValueSize = n
+	}
+}
+
+// WithChunkSize sets the size of the chunks Get writes values in.
+func WithChunkSize(n int) Option {
+	return func(s *Storage) {
+		if n > 0 {
+			s.chunkSize = n
+		}
+	}
+}
+
+// WithCompression compresses stored values according to c.
+func WithCompression(c Compression) Option {
+	return func(s *Storage) {
+		s.compression = c
+	}
+}
+
+// WithEncryption encrypts snapshots written by Persist with keys from kp.
+func WithEncryption(kp crypt.KeyProvider) Option {
+	return func(s *Storage) {
+		s.keys = kp
+	}
+}
+
+// WithNamespace configures the quotas and eviction policy of the namespace called name.
+func WithNamespace(name string, cfg NamespaceCfg) Option {
+	return func(s *Storage) {
+		s.nsCfg[name] = cfg
+	}
+}
+
+// WithDefaultNamespaceCfg configures namespaces that have no WithNamespace settings.
+func WithDefaultNamespaceCfg(cfg NamespaceCfg) Option {
+	return func(s *Storage) {
+		s.defaultNsCfg = cfg
+	}
+}
+
+// WithEnqueueTimeout fails commands with ErrOverloaded when the request
+// queue stays full for longer than d, instead of blocking until it drains.
+func WithEnqueueTimeout(d time.Duration) Option {
+	return func(s *Storage) {
+		s.enqueueTimeout.Store(int64(d))
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Storage) {
+		s.log = l
+	}
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var ErrNotLeader = errors.New("not the raft leader")
+
+var _ IStorage = new(ReplicatorStorage)
+
+// ReplicatorStorage writes through the raft log: a write returns once it is
+// committed and applied by the leader's Storage, which is the FSM of the
+// raft instance. Reads are served by the local Storage after checking their
+// Consistency.
+type ReplicatorStorage struct {
+	IStorage
+
+	store   *Storage
+	raft    *raft.Raft
+	timeout time.Duration
+
+	maxLag time.Duration
+	lease  time.Duration
+	// leaseStart is when the last confirmation of the leadership started,
+	// in unix nanoseconds.
+	leaseStart atomic.Int64
+}
+
+type ReplicatorOption func(r *ReplicatorStorage)
+
+// WithMaxLag sets the lag Bounded reads accept unless the command sets one.
+func WithMaxLag(d time.Duration) ReplicatorOption {
+	return func(r *ReplicatorStorage) {
+		r.maxLag = d
+	}
+}
+
+// WithLease sets how long a confirmation of the leadership serves
+// LeaderLease reads. It has to be shorter than the election timeout of the
+// followers.
+func WithLease(d time.Duration) ReplicatorOption {
+	return func(r *ReplicatorStorage) {
+		r.lease = d
+	}
+}
+
+func NewReplicator(s *Storage, raft *raft.Raft, timeout time.Duration, opts ...ReplicatorOption) *ReplicatorStorage {
+	r := &ReplicatorStorage{
+		IStorage: s,
+		store:    s,
+		raft:     raft,
+		timeout:  timeout,
+		maxLag:   time.Second,
+		lease:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+func (r *ReplicatorStorage) notLeader() error {
+	addr, _ := r.raft.LeaderWithID()
+	return fmt.Errorf("%w, leader is %q", ErrNotLeader, addr)
+}
+
+// logModified flags the command byte of log entries carrying the write
+// time, entries written before it have none and are stamped when applied.
+const logModified = 0x80
+
+// encodeLog encodes cmd as a raft log entry, see parseRPC.
+func encodeLog(cmd Command) []byte {
+	buf := make([]byte, 0, uint8ByteSize+8+len(cmd.Namespace)+4+len(cmd.Payload))
+	buf = append(buf, byte(cmd.Cmd)|logModified)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(cmd.Modified))
+	buf = AppendKey(buf, cmd.Namespace)
+
+	return append(buf, cmd.Payload...)
+}
+
+func (r *ReplicatorStorage) apply(ctx context.Context, cmd Command) error {
+	timeout := r.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+
+	// stamped once, so every replica and every replay of the log keeps
+	// the same write time
+	cmd.stamp()
+	f := r.raft.Apply(encodeLog(cmd), timeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return r.notLeader()
+		}
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+func (r *ReplicatorStorage) Set(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ReplicatorStorage.Set")
+	cmd.Cmd = Set
+	if _, err := r.store.parseSet(cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.apply(ctx, cmd))
+}
+
+func (r *ReplicatorStorage) Del(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ReplicatorStorage.Del")
+	cmd.Cmd = Del
+	if _, err := parseRPC(cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.apply(ctx, cmd))
+}
+
+func (r *ReplicatorStorage) Rename(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ReplicatorStorage.Rename")
+	cmd.Cmd = Rename
+	if _, err := parseRPC(cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.apply(ctx, cmd))
+}
+
+func (r *ReplicatorStorage) Flush(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ReplicatorStorage.Flush")
+	cmd.Cmd = Flush
+
+	return endSpan(span, r.apply(ctx, cmd))
+}
+
+// read checks that the local Storage can serve a read with the consistency
+// of cmd.
+func (r *ReplicatorStorage) read(ctx context.Context, cmd Command) error {
+	switch cmd.Consistency {
+	case Stale:
+		return nil
+	case Bounded:
+		maxLag := cmd.MaxLag
+		if maxLag <= 0 {
+			maxLag = r.maxLag
+		}
+		if lag := r.lag(); lag > maxLag {
+			return fmt.Errorf("%w: %s > %s", ErrStaleRead, lag.Round(time.Millisecond), maxLag)
+		}
+		// entries the replica knows to be committed are applied soon
+		ctx, cancel := context.WithTimeout(ctx, maxLag)
+		defer cancel()
+		if err := waitApplied(ctx, r.raft.CommitIndex(), r.raft.AppliedIndex); err != nil {
+			return fmt.Errorf("%w: applying committed entries: %w", ErrStaleRead, err)
+		}
+		return nil
+	case LeaderLease:
+		start := time.Unix(0, r.leaseStart.Load())
+		if r.raft.State() == raft.Leader && time.Since(start) < r.lease {
+			return nil
+		}
+		return r.verifyLeader()
+	case Linearizable:
+		return r.barrier(ctx)
+	default:
+		return fmt.Errorf("%w %s", ErrUnknownConsistency, cmd.Consistency)
+	}
+}
+
+// lag is the time since the replica heard from the leader, zero on the
+// leader.
+func (r *ReplicatorStorage) lag() time.Duration {
+	if r.raft.State() == raft.Leader {
+		return 0
+	}
+	last := r.raft.LastContact()
+	if last.IsZero() {
+		return time.Duration(math.MaxInt64)
+	}
+
+	return time.Since(last)
+}
+
+// verifyLeader confirms with a quorum that the node is still the leader
+// and renews the lease.
+func (r *ReplicatorStorage) verifyLeader() error {
+	start := time.Now()
+	if err := r.raft.VerifyLeader().Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return r.notLeader()
+		}
+		return err
+	}
+	r.leaseStart.Store(start.UnixNano())
+
+	return nil
+}
+
+// barrier commits an entry of the current term and waits until the
+// entries before it are applied. Unlike the commit index alone, which lags
+// on a new leader, this covers every write acknowledged by a former leader.
+// It confirms the leadership too and renews the lease.
+func (r *ReplicatorStorage) barrier(ctx context.Context) error {
+	timeout := r.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+
+	start := time.Now()
+	if err := r.raft.Barrier(timeout).Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return r.notLeader()
+		}
+		return err
+	}
+	r.leaseStart.Store(start.UnixNano())
+
+	return nil
+}
+
+func (r *ReplicatorStorage) Get(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ReplicatorStorage.Get")
+	if err := r.read(ctx, cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.store.Get(ctx, cmd))
+}
+
+func (r *ReplicatorStorage) Scan(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ReplicatorStorage.Scan")
+	if err := r.read(ctx, cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.store.Scan(ctx, cmd))
+}
@@ -7,11 +7,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/anthdm/hollywood/actor"
+	"github.com/dmitrorezn/dcache/crypt"
+	"github.com/dmitrorezn/dcache/tracing"
 	"github.com/hashicorp/raft"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"log/slog"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,35 +30,102 @@ const (
 	Rename
 	Wait
 	Continue
+	Scan
+	Flush
 	lastCmd
 )
 
+var cmdNames = [...]string{
+	Undefined: "undefined",
+	Get:       "get",
+	Set:       "set",
+	Del:       "del",
+	Rename:    "rename",
+	Wait:      "wait",
+	Continue:  "continue",
+	Scan:      "scan",
+	Flush:     "flush",
+}
+
+func (c Cmd) String() string {
+	if c < lastCmd {
+		return cmdNames[c]
+	}
+
+	return "cmd(" + strconv.Itoa(int(c)) + ")"
+}
+
 type Command struct {
 	Cmd Cmd
 
-	Payload []byte
-	W       io.Writer
+	// Namespace selects the logical database the command applies to,
+	// DefaultNamespace when empty.
+	Namespace string
+	Payload   []byte
+	W         io.Writer
+	// Trace carries the trace context of the originating request to the
+	// nodes the command is replicated to.
+	Trace map[string]string
+
+	// Consistency of Get and Scan, MaxLag bounds the lag of Bounded reads
+	// and defaults to the bound of the replicator.
+	Consistency Consistency
+	MaxLag      time.Duration
+
+	// Modified is the unix nanosecond time of a write at its origin, where
+	// it is stamped if 0. Replicas keep it, so the last write wins on every
+	// node, and skip a write older than the key they have.
+	Modified int64
+}
+
+// stamp sets the write time of cmd unless it has one.
+func (c *Command) stamp() {
+	if c.Modified == 0 {
+		c.Modified = time.Now().UnixNano()
+	}
 }
 
 type Result struct {
 }
 
 type request struct {
-	cmd    Command
-	keys   []string
-	value  []byte
-	values [][]byte
-	ack    chan error
+	cmd     Command
+	ns      string
+	keys    []string
+	values  [][]byte
+	entries []Entry
+	fn      func()
+	ack     chan error
+	// reply writes the result of a read to cmd.W, it is set before ack is
+	// closed and run by the caller, which owns the writer.
+	reply func() error
 }
 
 type Storage struct {
-	values map[string][]byte
+	namespaces map[string]*namespace
+
+	cfgMu        sync.RWMutex
+	nsCfg        map[string]NamespaceCfg
+	defaultNsCfg NamespaceCfg
+
+	maxValueSize int
+	chunkSize    int
+	compression  Compression
+	keys         crypt.KeyProvider
+
+	enqueueTimeout atomic.Int64
+
+	log *slog.Logger
 
 	wg       sync.WaitGroup
 	requests chan *request
 	quit     chan struct{}
 	pause    chan struct{}
 	start    chan struct{}
+
+	running   atomic.Bool
+	paused    atomic.Bool
+	restoring atomic.Int32
 }
 
 type Cfg struct {
@@ -66,121 +138,121 @@ type IStorage interface {
 	Set(ctx context.Context, cmd Command) error
 	Del(ctx context.Context, cmd Command) error
 	Rename(ctx context.Context, cmd Command) error
+	Scan(ctx context.Context, cmd Command) error
+	Flush(ctx context.Context, cmd Command) error
 	//Join(ctx context.Context, addr string) error
 	CloseAndWait() error
 }
 
 var _ IStorage = new(Storage)
-var _ IStorage = new(ReplicatorStorage)
 
-type ReplicatorStorage struct {
-	IStorage
-
-	srvID raft.ServerID
-	raft  *raft.Raft
-	wg    sync.WaitGroup
-}
-
-func NewReplicator(s IStorage, srvID raft.ServerID, raft *raft.Raft) *ReplicatorStorage {
-	rs := &ReplicatorStorage{
-		IStorage: s,
-		raft:     raft,
-		srvID:    srvID,
+func New(opts ...Option) *Storage {
+	s := &Storage{
+		wg:         sync.WaitGroup{},
+		namespaces: make(map[string]*namespace),
+		nsCfg:      make(map[string]NamespaceCfg),
+		chunkSize:  DefaultChunkSize,
+		quit:       make(chan struct{}),
+		pause:      make(chan struct{}),
+		start:      make(chan struct{}),
+		requests:   make(chan *request, 10_000),
+		log:        slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
-	return rs
-}
-
-func (r *ReplicatorStorage) CloseAndWait() error {
-	defer r.wg.Wait()
-
-	return r.IStorage.CloseAndWait()
+	return s
 }
 
-func (r *ReplicatorStorage) apply(cmd Command) {
-	buf := make([]byte, uint8ByteSize+len(cmd.Payload))
-	n := binary.PutUvarint(buf[0:uint8ByteSize], uint64(cmd.Cmd))
-	copy(buf[n:], cmd.Payload)
-	r.wg.Add(1)
+func (s *Storage) Run(ctx context.Context) {
+	defer s.wg.Wait()
 
+	s.wg.Add(1)
 	go func() {
-		defer r.wg.Done()
-
-		r.raft.Apply(buf, 5*time.Second)
+		defer s.wg.Done()
+		s.process(ctx)
 	}()
 }
 
-func (r *ReplicatorStorage) Set(ctx context.Context, cmd Command) error {
-	cmd.Cmd = Set
-	r.apply(cmd)
+func (s *Storage) parse(cmd Command) (*request, error) {
+	r, err := parseRPC(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if r.cmd.Cmd == Set {
+		compression := s.compression
+		if c := s.namespaceCfg(r.ns).Compression; c != nil {
+			compression = *c
+		}
+		r.entries = make([]Entry, len(r.values))
+		for i, v := range r.values {
+			value, codec := compression.Encode(v)
+			r.entries[i] = Entry{
+				Value: value,
+				Codec: codec,
+				Size:  len(v),
+				Sum:   checksum(v),
+			}
+		}
+	}
 
-	return r.IStorage.Set(ctx, cmd)
+	return r, nil
 }
 
-func (r *ReplicatorStorage) Del(ctx context.Context, cmd Command) error {
-	r.wg.Add(1)
-	cmd.Cmd = Del
-	go func() {
-		defer r.wg.Done()
-		r.apply(cmd)
-	}()
-
-	return r.IStorage.Del(ctx, cmd)
-}
+func (s *Storage) namespaceCfg(name string) NamespaceCfg {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
 
-func (r *ReplicatorStorage) Rename(ctx context.Context, cmd Command) error {
-	r.wg.Add(1)
-	cmd.Cmd = Rename
-	go func() {
-		defer r.wg.Done()
-		r.apply(cmd)
-	}()
+	if cfg, ok := s.nsCfg[name]; ok {
+		return cfg
+	}
 
-	return r.IStorage.Rename(ctx, cmd)
+	return s.defaultNsCfg
 }
 
-func New() *Storage {
-	s := &Storage{
-		wg:       sync.WaitGroup{},
-		values:   make(map[string][]byte),
-		quit:     make(chan struct{}),
-		pause:    make(chan struct{}),
-		start:    make(chan struct{}),
-		requests: make(chan *request, 10_000),
+// ns returns the namespace called name, creating it on first use.
+// It must only be called from the processing goroutine.
+func (s *Storage) ns(name string) *namespace {
+	n, ok := s.namespaces[name]
+	if !ok {
+		n = newNamespace(name, s.namespaceCfg(name))
+		s.namespaces[name] = n
 	}
 
-	return s
+	return n
 }
 
-func (s *Storage) Run(ctx context.Context) {
-	defer s.wg.Wait()
-
-	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		s.process(ctx)
-	}()
-}
+var _ raft.FSM = new(Storage)
 
+// Apply applies a committed log entry written by ReplicatorStorage and
+// returns the resulting error, if any.
 func (s *Storage) Apply(log *raft.Log) interface{} {
-	r, err := parseRPC(Command{
+	r, err := s.parse(Command{
 		Cmd:     Undefined,
 		Payload: log.Data,
 	})
 	if err != nil {
 		return err
 	}
+
+	return s.enqueue(r)
+}
+
+// enqueue runs r without the enqueue timeout, committed entries have to be
+// applied however loaded the storage is.
+func (s *Storage) enqueue(r *request) error {
 	select {
 	case s.requests <- r:
 	case <-s.quit:
 		return ErrStorageClosed
 	}
 
-	return nil
+	return <-r.ack
 }
 
 func (s *Storage) Do(ctx context.Context, cmd Command) error {
-	r, err := parseRPC(cmd)
+	r, err := s.parse(cmd)
 	if err != nil {
 		return err
 	}
@@ -191,25 +263,29 @@ func (s *Storage) Do(ctx context.Context, cmd Command) error {
 	case <-s.quit:
 		return ErrStorageClosed
 	}
+	if err = <-r.ack; err != nil || r.reply == nil {
+		return err
+	}
 
-	return <-r.ack
+	return r.reply()
 }
 
 var _ raft.FSMSnapshot = new(Storage)
 
+// Snapshot pauses processing until Release, so Persist writes the state as
+// of the last applied entry.
 func (s *Storage) Snapshot() (raft.FSMSnapshot, error) {
-	s.requests <- &request{
-		cmd: Command{
-			Cmd: Undefined,
-		},
+	select {
+	case s.pause <- struct{}{}:
+	case <-s.quit:
+		return nil, ErrStorageClosed
 	}
+
 	return s, nil
 }
 
 func (s *Storage) Persist(sink raft.SnapshotSink) error {
-	s.pause <- struct{}{}
-	s.values["id"] = []byte(sink.ID())
-	if err := json.NewEncoder(sink).Encode(s.values); err != nil {
+	if err := s.encodeSnapshot(sink); err != nil {
 		return errors.Join(
 			sink.Cancel(),
 			sink.Close(),
@@ -225,42 +301,165 @@ func (s *Storage) Release() {
 }
 
 func (s *Storage) Restore(snapshot io.ReadCloser) error {
-	kv := make(map[string][]byte)
-	if err := json.NewDecoder(snapshot).Decode(&kv); err != nil {
-		return err
+	s.restoring.Add(1)
+	defer s.restoring.Add(-1)
+
+	kv, err := s.decodeSnapshot(snapshot)
+	if err != nil {
+		return errors.Join(err, snapshot.Close())
 	}
-	s.do(func() {
-		keys := make([]string, 0, len(kv))
-		values := make([][]byte, 0, len(kv))
+	err = s.enqueue(&request{
+		fn: func() {
+			s.load(kv)
+		},
+		ack: make(chan error, 1),
+	})
 
-		for k, v := range kv {
-			keys = append(keys, k)
-			values = append(values, v)
-		}
-		s.requests <- &request{
-			cmd: Command{
-				Cmd: Set,
-			},
-			keys:   keys,
-			values: values,
-			ack:    make(chan error),
+	return errors.Join(err, snapshot.Close())
+}
+
+// load replaces all namespaces with snap. It must only be called from the
+// processing goroutine.
+func (s *Storage) load(snap snapshot) {
+	for _, n := range s.namespaces {
+		n.flush()
+	}
+	for name, values := range snap {
+		n := s.ns(name)
+		for k, e := range values {
+			if e.Deleted {
+				n.remove(k, e.Modified)
+				continue
+			}
+			if e.Sum == 0 {
+				// written before entries had a checksum
+				if v, err := e.Bytes(); err == nil {
+					e.Sum = checksum(v)
+				}
+			}
+			n.put(k, e.Entry)
 		}
+	}
+}
+
+// Save writes all namespaces to w in the snapshot format, encrypted when a
+// key provider is set. Commands wait until it is written.
+func (s *Storage) Save(ctx context.Context, w io.Writer) error {
+	var err error
+	if execErr := s.exec(ctx, func() {
+		err = s.encodeSnapshot(w)
+	}); execErr != nil {
+		return execErr
+	}
+
+	return err
+}
+
+// Load replaces all namespaces with a snapshot written by Save.
+func (s *Storage) Load(ctx context.Context, r io.Reader) error {
+	s.restoring.Add(1)
+	defer s.restoring.Add(-1)
+
+	snap, err := s.decodeSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	return s.exec(ctx, func() {
+		s.load(snap)
 	})
+}
+
+// snapshot maps namespaces to their keys, tombstones keep the deletes
+// from being undone by peers that missed them.
+type snapshot map[string]map[string]snapshotEntry
+
+// snapshotEntry is a stored entry, or the tombstone of a key deleted at
+// Modified.
+type snapshotEntry struct {
+	Entry
+	Deleted bool `json:"d,omitempty"`
+}
+
+func (s *Storage) snapshot() snapshot {
+	snap := make(snapshot, len(s.namespaces))
+	for name, n := range s.namespaces {
+		snap[name] = n.entries()
+	}
+
+	return snap
+}
+
+// encodeSnapshot writes all namespaces to w, encrypted when a key provider
+// is set. The processing goroutine must be paused.
+func (s *Storage) encodeSnapshot(w io.Writer) error {
+	if s.keys == nil {
+		return json.NewEncoder(w).Encode(s.snapshot())
+	}
+
+	enc, err := crypt.NewWriter(w, s.keys)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(enc).Encode(s.snapshot()); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+func (s *Storage) decodeSnapshot(r io.Reader) (snapshot, error) {
+	if s.keys != nil {
+		dec, err := crypt.NewReader(r, s.keys)
+		if err != nil {
+			return nil, err
+		}
+		r = dec
+	}
 
-	return snapshot.Close()
+	kv := make(snapshot)
+	if err := json.NewDecoder(r).Decode(&kv); err != nil {
+		return nil, err
+	}
+
+	return kv, nil
 }
 
 var ErrNIL = errors.New("nil")
 var ErrWriteResult = errors.New("error write result")
+var ErrValueTooLarge = errors.New("value too large")
 
-func (s *Storage) do(fn func()) {
-	s.wg.Add(1)
+// Sizer is implemented by writers that want to know the value size
+// before the first chunk is written, e.g. to set Content-Length.
+type Sizer interface {
+	SetSize(n int)
+}
 
-	go func() {
-		defer s.wg.Done()
+type flusher interface {
+	Flush()
+}
 
-		fn()
-	}()
+func (s *Storage) write(w io.Writer, value []byte) error {
+	if sw, ok := w.(Sizer); ok {
+		sw.SetSize(len(value))
+	}
+	f, _ := w.(flusher)
+	for len(value) > 0 {
+		chunk := value[:min(s.chunkSize, len(value))]
+		n, err := w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		if n != len(chunk) {
+			return ErrWriteResult
+		}
+		if f != nil {
+			f.Flush()
+		}
+		value = value[n:]
+	}
+
+	return nil
 }
 
 func (r *Storage) CloseAndWait() error {
@@ -270,7 +469,44 @@ func (r *Storage) CloseAndWait() error {
 	return nil
 }
 
+type Stats struct {
+	Keys             int                       `json:"keys"`
+	Bytes            int64                     `json:"bytes"`
+	StoredBytes      int64                     `json:"storedBytes"`
+	CompressionRatio float64                   `json:"compressionRatio"`
+	Namespaces       map[string]NamespaceStats `json:"namespaces"`
+}
+
+func (s *Storage) Stats(ctx context.Context) (stats Stats, err error) {
+	err = s.exec(ctx, func() {
+		stats.Namespaces = make(map[string]NamespaceStats, len(s.namespaces))
+		for name, n := range s.namespaces {
+			st := n.stats()
+			stats.Namespaces[name] = st
+			stats.Keys += st.Keys
+			stats.Bytes += st.Bytes
+			stats.StoredBytes += st.StoredBytes
+		}
+	})
+	if stats.StoredBytes > 0 {
+		stats.CompressionRatio = float64(stats.Bytes) / float64(stats.StoredBytes)
+	}
+
+	return stats, err
+}
+
+// exec runs fn on the processing goroutine, serialized with all other commands.
+func (s *Storage) exec(ctx context.Context, fn func()) error {
+	return s.applyRPC(ctx, &request{
+		fn:  fn,
+		ack: make(chan error, 1),
+	})
+}
+
 func (s *Storage) process(ctx context.Context) {
+	s.running.Store(true)
+	defer s.running.Store(false)
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -278,57 +514,93 @@ func (s *Storage) process(ctx context.Context) {
 		case <-s.quit:
 			return
 		case <-s.pause:
+			s.paused.Store(true)
 			<-s.start
+			s.paused.Store(false)
 		case r := <-s.requests:
+			if r.fn != nil {
+				r.fn()
+				close(r.ack)
+				break
+			}
+			s.log.Debug("command", "cmd", r.cmd.Cmd, "namespace", r.ns, "keys", r.keys)
+			n, ok := s.namespaces[r.ns]
+			switch {
+			case ok:
+			case r.cmd.Cmd == Set || r.cmd.Cmd == Del:
+				n = s.ns(r.ns)
+			default:
+				// nothing to read, rename or flush in a namespace never written
+				if r.cmd.Cmd != Flush {
+					r.ack <- ErrNIL
+				}
+				close(r.ack)
+				continue
+			}
 			switch r.cmd.Cmd {
 			case Get:
-				fmt.Println(s.values)
-				res, ok := s.values[r.keys[0]]
+				res, ok := n.get(r.keys[0])
 				if !ok {
 					r.ack <- ErrNIL
 					close(r.ack)
 					break
 				}
 
-				fmt.Println("res", string(res))
-				s.do(func() {
-					defer close(r.ack)
-					fmt.Println("res", string(res))
-
-					n, err := r.cmd.W.Write(res)
+				r.reply = func() error {
+					value, err := res.Bytes()
 					if err != nil {
-						r.ack <- err
-						return
+						return err
 					}
-					if n != len(res) {
-						r.ack <- ErrWriteResult
-					}
-				})
+					return s.write(r.cmd.W, value)
+				}
+				close(r.ack)
 			case Set:
-
+				var err error
+				r.cmd.stamp()
 				for i, k := range r.keys {
-					s.values[k] = r.values[i]
+					if n.newer(k, r.cmd.Modified) {
+						continue
+					}
+					r.entries[i].Modified = r.cmd.Modified
+					err = errors.Join(err, n.set(k, r.entries[i]))
+				}
+				if err != nil {
+					r.ack <- err
 				}
-				fmt.Println(s.values)
-
 				close(r.ack)
 
 			case Del:
+				r.cmd.stamp()
 				for _, k := range r.keys {
-					delete(s.values, k)
+					if !n.newer(k, r.cmd.Modified) {
+						n.remove(k, r.cmd.Modified)
+					}
 				}
 				close(r.ack)
 
 			case Rename:
-				res, ok := s.values[r.keys[0]]
-				if !ok {
+				r.cmd.stamp()
+				if renamed, err := n.rename(r.keys[0], r.keys[1], r.cmd.Modified); err != nil {
+					r.ack <- err
+				} else if !renamed {
 					r.ack <- ErrNIL
-					close(r.ack)
-					break
 				}
-				delete(s.values, r.keys[0])
-				s.values[r.keys[1]] = res
+				close(r.ack)
 
+			case Scan:
+				keys := n.scan(r.keys[0])
+				r.reply = func() error {
+					var buf []byte
+					for _, k := range keys {
+						buf = append(append(buf, k...), '\n')
+					}
+					return s.write(r.cmd.W, buf)
+				}
+				close(r.ack)
+
+			case Flush:
+				r.cmd.stamp()
+				n.removeAll(r.cmd.Modified)
 				close(r.ack)
 			}
 		}
@@ -336,15 +608,14 @@ func (s *Storage) process(ctx context.Context) {
 }
 
 const (
-	uint8ByteSize  = 1
-	uint32ByteSize = 4
+	uint8ByteSize = 1
 )
 
-func readKey(cmd Command) ([]byte, int, error) {
-	if len(cmd.Payload) < uint8ByteSize {
-		return nil, 0, errors.New("wrong len" + fmt.Sprint(len(cmd.Payload)))
+func readKey(payload []byte) ([]byte, int, error) {
+	if len(payload) < uint8ByteSize {
+		return nil, 0, errors.New("wrong len" + fmt.Sprint(len(payload)))
 	}
-	l, payload, ok := bytes.Cut(cmd.Payload, []byte{':'})
+	l, rest, ok := bytes.Cut(payload, []byte{':'})
 	if !ok {
 		return nil, 0, errors.New("cut fail")
 	}
@@ -352,69 +623,234 @@ func readKey(cmd Command) ([]byte, int, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	if keyLen > len(payload) {
+	if keyLen < 0 || keyLen > len(rest) {
 		return nil, 0, fmt.Errorf("key size is to big %d", keyLen)
 	}
-	return payload[:keyLen], int(keyLen), nil
+
+	return rest[:keyLen], len(l) + 1 + keyLen, nil
+}
+
+// AppendKey appends key to buf in the "<len>:<key>" form expected by parseRPC.
+func AppendKey(buf []byte, key string) []byte {
+	buf = strconv.AppendInt(buf, int64(len(key)), 10)
+	buf = append(buf, ':')
+
+	return append(buf, key...)
+}
+
+// NewPayload allocates a Set payload for key with room for a value of valueSize
+// bytes and returns it together with the value slot, so callers can read a
+// value straight into the payload without an intermediate copy.
+func NewPayload(key string, valueSize int) (payload []byte, value []byte) {
+	payload = AppendKey(make([]byte, 0, len(strconv.Itoa(len(key)))+1+len(key)+valueSize), key)
+	n := len(payload)
+	payload = payload[:n+valueSize]
+
+	return payload, payload[n:]
 }
 
 func parseRPC(cmd Command) (*request, error) {
 	if cmd.Cmd == Undefined {
-		c, n := binary.Uvarint(cmd.Payload[:uint8ByteSize])
-		if n != uint8ByteSize {
-			return nil, fmt.Errorf("error parze cmd size %d", n)
+		if len(cmd.Payload) < uint8ByteSize {
+			return nil, fmt.Errorf("error parze cmd size %d", len(cmd.Payload))
+		}
+		c, rest := cmd.Payload[0], cmd.Payload[uint8ByteSize:]
+		if c&logModified != 0 {
+			if len(rest) < 8 {
+				return nil, fmt.Errorf("error parze modified size %d", len(rest))
+			}
+			cmd.Modified = int64(binary.BigEndian.Uint64(rest))
+			c &^= logModified
+			rest = rest[8:]
 		}
 		cmd.Cmd = Cmd(c)
-		cmd.Payload = cmd.Payload[:uint8ByteSize]
+		ns, n, err := readKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("readKey namespace %w", err)
+		}
+		cmd.Namespace = string(ns)
+		cmd.Payload = rest[n:]
 	}
 
-	key, kl, err := readKey(cmd)
+	ns := cmd.Namespace
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+	if cmd.Cmd == Flush {
+		return &request{
+			cmd: cmd,
+			ns:  ns,
+			ack: make(chan error, 1),
+		}, nil
+	}
+
+	key, n, err := readKey(cmd.Payload)
 	if err != nil {
 		return nil, fmt.Errorf("readKey %w", err)
 	}
-	var keys = []string{
-		string(key),
-	}
+	var (
+		keys = []string{
+			string(key),
+		}
+		rest = cmd.Payload[n:]
+	)
 
 	switch cmd.Cmd {
 	case Rename:
-		k, n, err := readKey(cmd)
+		k, n, err := readKey(rest)
 		if err != nil {
-			return nil, fmt.Errorf("error parze cmd size %d", n)
+			return nil, fmt.Errorf("readKey %w", err)
 		}
 		keys = append(keys, string(k))
-		kl += uint32ByteSize + n
+		rest = rest[n:]
 	}
 
 	return &request{
 		cmd:    cmd,
+		ns:     ns,
 		keys:   keys,
-		values: [][]byte{cmd.Payload[uint32ByteSize+kl:]},
-		ack:    make(chan error),
+		values: [][]byte{rest},
+		ack:    make(chan error, 1),
 	}, nil
 }
 
+// Keys returns the keys cmd addresses.
+func Keys(cmd Command) ([]string, error) {
+	r, err := parseRPC(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.keys, nil
+}
+
 func (s *Storage) Get(ctx context.Context, cmd Command) error {
 	cmd.Cmd = Get
 	r, err := parseRPC(cmd)
 	if err != nil {
 		return err
 	}
-	fmt.Println("CMD", cmd)
 
 	return s.applyRPC(ctx, r)
 }
 
 var ErrStorageClosed = errors.New("storage closed")
 
+var ErrOverloaded = errors.New("storage overloaded")
+
+var (
+	ErrNotRunning = errors.New("storage not running")
+	ErrPaused     = errors.New("storage paused")
+	ErrRestoring  = errors.New("snapshot restore in progress")
+)
+
+// Live returns ErrNotRunning unless the processing goroutine is running.
+func (s *Storage) Live() error {
+	if !s.running.Load() {
+		return ErrNotRunning
+	}
+
+	return nil
+}
+
+// Ready reports whether requests are served right away: the storage is
+// running and neither paused for a snapshot nor restoring one.
+func (s *Storage) Ready() error {
+	switch {
+	case !s.running.Load():
+		return ErrNotRunning
+	case s.paused.Load():
+		return ErrPaused
+	case s.restoring.Load() > 0:
+		return ErrRestoring
+	}
+
+	return nil
+}
+
+func (s *Storage) SetEnqueueTimeout(d time.Duration) {
+	s.enqueueTimeout.Store(int64(d))
+}
+
+// SetNamespaces replaces the namespace settings, def applying to namespaces
+// missing in cfg. Namespaces over their new quota are evicted down to it,
+// unless their policy is NoEviction. The settings are replaced if and only
+// if it returns nil.
+func (s *Storage) SetNamespaces(ctx context.Context, def NamespaceCfg, cfg map[string]NamespaceCfg) error {
+	// whoever claims the request first decides: the processing goroutine
+	// applies it, or the caller gives up on it
+	var claimed atomic.Bool
+	r := &request{
+		ack: make(chan error, 1),
+	}
+	r.fn = func() {
+		if !claimed.CompareAndSwap(false, true) {
+			return
+		}
+		s.cfgMu.Lock()
+		s.defaultNsCfg = def
+		s.nsCfg = cfg
+		s.cfgMu.Unlock()
+
+		for name, n := range s.namespaces {
+			n.cfg = s.namespaceCfg(name)
+			if n.cfg.Policy == NoEviction {
+				continue
+			}
+			for n.overQuota(len(n.values), n.storedBytes) && n.evict("") {
+			}
+		}
+	}
+	err := s.applyRPC(ctx, r)
+	if err != nil && !claimed.CompareAndSwap(false, true) {
+		<-r.ack
+		return nil
+	}
+
+	return err
+}
+
+// QueueDepth returns the number of requests waiting to be processed.
+func (s *Storage) QueueDepth() int {
+	return len(s.requests)
+}
+
+func (s *Storage) QueueCap() int {
+	return cap(s.requests)
+}
+
 func (s *Storage) applyRPC(ctx context.Context, r *request) error {
+	ctx, span := tracer.Start(ctx, "Storage.applyRPC", trace.WithAttributes(
+		attribute.String("cmd", r.cmd.Cmd.String()),
+		attribute.String("namespace", r.ns),
+	))
+
+	err := s.enqueueAndWait(ctx, span, r)
+	if err == nil && r.reply != nil {
+		err = r.reply()
+	}
+
+	return endSpan(span, err)
+}
+
+func (s *Storage) enqueueAndWait(ctx context.Context, span trace.Span, r *request) error {
+	var timeout <-chan time.Time
+	if d := time.Duration(s.enqueueTimeout.Load()); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case s.requests <- r:
 	case <-s.quit:
 		return ErrStorageClosed
+	case <-timeout:
+		return ErrOverloaded
 	}
+	span.AddEvent("enqueued")
 
 	select {
 	case <-ctx.Done():
@@ -426,7 +862,7 @@ func (s *Storage) applyRPC(ctx context.Context, r *request) error {
 
 func (s *Storage) Set(ctx context.Context, cmd Command) error {
 	cmd.Cmd = Set
-	r, err := parseRPC(cmd)
+	r, err := s.parseSet(cmd)
 	if err != nil {
 		return err
 	}
@@ -434,6 +870,19 @@ func (s *Storage) Set(ctx context.Context, cmd Command) error {
 	return s.applyRPC(ctx, r)
 }
 
+// parseSet parses a Set command and checks the value size.
+func (s *Storage) parseSet(cmd Command) (*request, error) {
+	r, err := s.parse(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.maxValueSize > 0 && len(r.values[0]) > s.maxValueSize {
+		return nil, fmt.Errorf("%w: %d > %d", ErrValueTooLarge, len(r.values[0]), s.maxValueSize)
+	}
+
+	return r, nil
+}
+
 func (s *Storage) Del(ctx context.Context, cmd Command) error {
 	cmd.Cmd = Del
 	r, err := parseRPC(cmd)
@@ -454,57 +903,190 @@ func (s *Storage) Rename(ctx context.Context, cmd Command) error {
 	return s.applyRPC(ctx, r)
 }
 
+// Scan writes the keys of the namespace starting with the key of cmd,
+// one per line.
+func (s *Storage) Scan(ctx context.Context, cmd Command) error {
+	cmd.Cmd = Scan
+	r, err := parseRPC(cmd)
+	if err != nil {
+		return err
+	}
+
+	return s.applyRPC(ctx, r)
+}
+
+// Flush removes all keys of the namespace.
+func (s *Storage) Flush(ctx context.Context, cmd Command) error {
+	cmd.Cmd = Flush
+	r, err := parseRPC(cmd)
+	if err != nil {
+		return err
+	}
+
+	return s.applyRPC(ctx, r)
+}
+
 func (s *Storage) Join(ctx context.Context, cmd Command) error {
-	fmt.Println("joined")
+	s.log.Info("joined")
 
 	return nil
 }
 
+var (
+	ErrReplicationQueueFull = errors.New("replication queue full")
+	ErrReplicationClosed    = errors.New("replication queue closed")
+)
+
+// ActorStorage applies writes locally and queues them to be replicated to
+// the peers by the Server actors.
 type ActorStorage struct {
 	IStorage
 
-	pid      []*actor.PID
-	engine   *actor.Engine
-	commands chan Command
+	commands       chan Command
+	enqueueTimeout atomic.Int64
+	dropped        atomic.Uint64
+
+	log *slog.Logger
+
+	mu     sync.RWMutex
+	closed bool
 }
 
-func NewActorStorage(s IStorage, commands chan Command, engine *actor.Engine) *ActorStorage {
+func NewActorStorage(s IStorage, commands chan Command, enqueueTimeout time.Duration, logger *slog.Logger) *ActorStorage {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	rs := &ActorStorage{
 		IStorage: s,
-		engine:   engine,
 		commands: commands,
+		log:      logger,
 	}
+	rs.SetEnqueueTimeout(enqueueTimeout)
 
 	return rs
 }
 
-func (r *ActorStorage) apply(cmd Command) {
+// SetEnqueueTimeout sets how long a write waits for room in the replication
+// queue.
+func (r *ActorStorage) SetEnqueueTimeout(d time.Duration) {
+	r.enqueueTimeout.Store(int64(d))
+}
+
+// replicate queues cmd, which was applied locally, for replication. The
+// error tells the caller the peers will not see the write.
+func (r *ActorStorage) replicate(ctx context.Context, cmd Command) error {
+	cmd.W = nil
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return r.drop(cmd, ErrReplicationClosed)
+	}
 	select {
 	case r.commands <- cmd:
+		return nil
 	default:
-		fmt.Println("ERROR apply CMD")
 	}
+
+	t := time.NewTimer(time.Duration(r.enqueueTimeout.Load()))
+	defer t.Stop()
+	select {
+	case r.commands <- cmd:
+		return nil
+	case <-t.C:
+		return r.drop(cmd, ErrReplicationQueueFull)
+	case <-ctx.Done():
+		return r.drop(cmd, ctx.Err())
+	}
+}
+
+func (r *ActorStorage) drop(cmd Command, err error) error {
+	r.dropped.Add(1)
+	r.log.Warn("command applied locally but not replicated", "cmd", cmd.Cmd, "namespace", cmd.Namespace, "err", err)
+
+	return fmt.Errorf("applied locally, not replicated: %w", err)
+}
+
+// Close stops queueing commands for replication and closes the queue, so
+// its consumers can drain it.
+func (r *ActorStorage) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.commands)
+}
+
+// Dropped returns the number of commands not replicated because the
+// replication queue was full or closed.
+func (r *ActorStorage) Dropped() uint64 {
+	return r.dropped.Load()
 }
 
 func (r *ActorStorage) Set(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ActorStorage.Set")
 	cmd.Cmd = Set
-	go r.apply(cmd)
+	cmd.Trace = tracing.Inject(ctx)
+	cmd.stamp()
+	if err := r.IStorage.Set(ctx, cmd); err != nil {
+		return endSpan(span, err)
+	}
 
-	return r.IStorage.Set(ctx, cmd)
+	return endSpan(span, r.replicate(ctx, cmd))
 }
 
 func (r *ActorStorage) Del(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ActorStorage.Del")
 	cmd.Cmd = Del
+	cmd.Trace = tracing.Inject(ctx)
+	cmd.stamp()
+	if err := r.IStorage.Del(ctx, cmd); err != nil {
+		return endSpan(span, err)
+	}
 
-	go r.apply(cmd)
-
-	return r.IStorage.Del(ctx, cmd)
+	return endSpan(span, r.replicate(ctx, cmd))
 }
 
 func (r *ActorStorage) Rename(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ActorStorage.Rename")
 	cmd.Cmd = Rename
+	cmd.Trace = tracing.Inject(ctx)
+	cmd.stamp()
+	if err := r.IStorage.Rename(ctx, cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.replicate(ctx, cmd))
+}
 
-	go r.apply(cmd)
+func (r *ActorStorage) Flush(ctx context.Context, cmd Command) error {
+	ctx, span := tracer.Start(ctx, "ActorStorage.Flush")
+	cmd.Cmd = Flush
+	cmd.Trace = tracing.Inject(ctx)
+	cmd.stamp()
+	if err := r.IStorage.Flush(ctx, cmd); err != nil {
+		return endSpan(span, err)
+	}
+
+	return endSpan(span, r.replicate(ctx, cmd))
+}
+
+// Get and Scan only give Stale reads, replication to peers is asynchronous.
+func (r *ActorStorage) Get(ctx context.Context, cmd Command) error {
+	if cmd.Consistency != Stale {
+		return fmt.Errorf("%w: %s", ErrUnsupportedConsistency, cmd.Consistency)
+	}
+
+	return r.IStorage.Get(ctx, cmd)
+}
+
+func (r *ActorStorage) Scan(ctx context.Context, cmd Command) error {
+	if cmd.Consistency != Stale {
+		return fmt.Errorf("%w: %s", ErrUnsupportedConsistency, cmd.Consistency)
+	}
 
-	return r.IStorage.Rename(ctx, cmd)
+	return r.IStorage.Scan(ctx, cmd)
 }
@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func newTestStorage(t *testing.T, opts ...Option) *Storage {
+	t.Helper()
+	s := New(opts...)
+	go s.Run(context.Background())
+	t.Cleanup(func() {
+		if err := s.CloseAndWait(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return s
+}
+
+func set(t *testing.T, s IStorage, ns, key, value string, modified int64) {
+	t.Helper()
+	if err := s.Set(context.Background(), Command{
+		Namespace: ns,
+		Payload:   append(AppendKey(nil, key), value...),
+		Modified:  modified,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func del(t *testing.T, s IStorage, ns, key string, modified int64) {
+	t.Helper()
+	if err := s.Del(context.Background(), Command{
+		Namespace: ns,
+		Payload:   AppendKey(nil, key),
+		Modified:  modified,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get returns the value of key, "" with ok unset if it is missing.
+func get(t *testing.T, s IStorage, ns, key string) (string, bool) {
+	t.Helper()
+	var out bytes.Buffer
+	err := s.Get(context.Background(), Command{
+		Namespace: ns,
+		Payload:   AppendKey(nil, key),
+		W:         &out,
+	})
+	if errors.Is(err, ErrNIL) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String(), true
+}
+
+func TestLastWriteWins(t *testing.T) {
+	s := newTestStorage(t)
+
+	set(t, s, "", "k", "new", 200)
+	set(t, s, "", "k", "old", 100)
+	if v, _ := get(t, s, "", "k"); v != "new" {
+		t.Fatalf("older write replaced the value: %q", v)
+	}
+
+	del(t, s, "", "k", 150)
+	if v, _ := get(t, s, "", "k"); v != "new" {
+		t.Fatalf("older delete removed the value: %q", v)
+	}
+
+	del(t, s, "", "k", 300)
+	set(t, s, "", "k", "stale", 250)
+	if v, ok := get(t, s, "", "k"); ok {
+		t.Fatalf("write older than the tombstone brought the key back: %q", v)
+	}
+
+	set(t, s, "", "k", "newest", 400)
+	if v, _ := get(t, s, "", "k"); v != "newest" {
+		t.Fatalf("newer write was skipped: %q", v)
+	}
+}
+
+func TestSnapshotTombstones(t *testing.T) {
+	s := newTestStorage(t)
+	set(t, s, "", "a", "1", 100)
+	set(t, s, "", "b", "2", 100)
+	del(t, s, "", "b", 200)
+
+	var buf bytes.Buffer
+	if err := s.Save(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestStorage(t)
+	if err := loaded.Load(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := get(t, loaded, "", "a"); v != "1" {
+		t.Fatalf("a = %q", v)
+	}
+	// a write older than the delete stays deleted
+	set(t, loaded, "", "b", "stale", 150)
+	if v, ok := get(t, loaded, "", "b"); ok {
+		t.Fatalf("tombstone lost in the snapshot, b = %q", v)
+	}
+	st, err := loaded.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := st.Namespaces[DefaultNamespace].Tombstones; n != 1 {
+		t.Fatalf("%d tombstones, want 1", n)
+	}
+}
+
+func TestReadMissingNamespace(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	if _, ok := get(t, s, "missing", "k"); ok {
+		t.Fatal("got a key of a missing namespace")
+	}
+	var out bytes.Buffer
+	if err := s.Scan(ctx, Command{Namespace: "missing", Payload: AppendKey(nil, ""), W: &out}); !errors.Is(err, ErrNIL) {
+		t.Fatalf("scan: %v, want ErrNIL", err)
+	}
+	if err := s.Flush(ctx, Command{Namespace: "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Namespaces["missing"]; ok {
+		t.Fatal("reads created the namespace")
+	}
+}
+
+func TestRenameQuota(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	for _, k := range []string{"a", "b", "c"} {
+		set(t, s, "q", k, k, 0)
+	}
+	rename := func() error {
+		return s.Rename(ctx, Command{Namespace: "q", Payload: AppendKey(AppendKey(nil, "a"), "d")})
+	}
+
+	// the quota lowered below the keys stored
+	if err := s.SetNamespaces(ctx, NamespaceCfg{}, map[string]NamespaceCfg{"q": {MaxKeys: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("rename over quota: %v, want ErrQuotaExceeded", err)
+	}
+	if v, _ := get(t, s, "q", "a"); v != "a" {
+		t.Fatalf("a = %q after a failed rename", v)
+	}
+
+	if err := s.SetNamespaces(ctx, NamespaceCfg{}, map[string]NamespaceCfg{"q": {MaxKeys: 2, Policy: EvictLRU}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rename(); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]bool{"a": false, "b": false, "c": true, "d": true} {
+		if _, ok := get(t, s, "q", k); ok != want {
+			t.Fatalf("%s kept %v, want %v", k, ok, want)
+		}
+	}
+}
+
+func TestApplyLogModified(t *testing.T) {
+	s := newTestStorage(t)
+	apply := func(cmd Command) {
+		t.Helper()
+		if err, _ := s.Apply(&raft.Log{Data: encodeLog(cmd)}).(error); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// replayed entries keep the time stamped by the leader
+	apply(Command{Cmd: Set, Payload: append(AppendKey(nil, "k"), "new"...), Modified: 200})
+	apply(Command{Cmd: Set, Payload: append(AppendKey(nil, "k"), "old"...), Modified: 100})
+	if v, _ := get(t, s, "", "k"); v != "new" {
+		t.Fatalf("older entry replaced the value: %q", v)
+	}
+	apply(Command{Cmd: Del, Payload: AppendKey(nil, "k"), Modified: 300})
+	if v, ok := get(t, s, "", "k"); ok {
+		t.Fatalf("k = %q after a newer delete", v)
+	}
+
+	// entries written without the time are stamped when applied
+	old := append([]byte{byte(Set)}, AppendKey(nil, "")...)
+	old = append(AppendKey(old, "k"), "stamped"...)
+	if err, _ := s.Apply(&raft.Log{Data: old}).(error); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := get(t, s, "", "k"); v != "stamped" {
+		t.Fatalf("k = %q after an entry without the time", v)
+	}
+}
+
+func TestGetCanceledDoesNotWrite(t *testing.T) {
+	s := newTestStorage(t)
+	set(t, s, "", "k", "value", 0)
+
+	// hold the processing goroutine until the Get is queued and canceled
+	ctx := context.Background()
+	release := hold(t, s)
+	getCtx, cancel := context.WithCancel(ctx)
+	out := make(chanWriter, 1)
+	done := make(chan error)
+	go func() {
+		done <- s.Get(getCtx, Command{Payload: AppendKey(nil, "k"), W: out})
+	}()
+	for s.QueueDepth() == 0 {
+		runtime.Gosched()
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("get: %v, want context.Canceled", err)
+	}
+	release()
+
+	// the Get is processed after its caller returned
+	if err := s.exec(ctx, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-out:
+		t.Fatalf("wrote %q after the caller returned", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// hold blocks the processing goroutine of s until release is called.
+func hold(t *testing.T, s *Storage) (release func()) {
+	t.Helper()
+	held, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = s.exec(context.Background(), func() {
+			close(held)
+			<-done
+		})
+	}()
+	<-held
+
+	return func() { close(done) }
+}
+
+func TestSetNamespacesCanceled(t *testing.T) {
+	s := newTestStorage(t)
+	release := hold(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.SetNamespaces(ctx, NamespaceCfg{MaxKeys: 1}, nil)
+	}()
+	for s.QueueDepth() == 0 {
+		runtime.Gosched()
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("set namespaces: %v, want context.Canceled", err)
+	}
+	release()
+
+	// the settings the caller gave up on are not applied later
+	if err := s.exec(context.Background(), func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := s.namespaceCfg("a"); cfg.MaxKeys != 0 {
+		t.Fatalf("namespace settings %+v applied after the caller gave up", cfg)
+	}
+}
+
+type chanWriter chan []byte
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- bytes.Clone(p)
+	return len(p), nil
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/dmitrorezn/dcache/tracing"
+)
+
+var tracer = tracing.Tracer("github.com/dmitrorezn/dcache/storage")
+
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	return err
+}